@@ -42,13 +42,17 @@ type Configuration struct {
 	LsdServer      LsdServerInfo      `yaml:"lsd"`
 	FrontendServer FrontendServerInfo `yaml:"frontend"`
 	LsdNotifyAuth  Auth               `yaml:"lsd_notify_auth"`
+	LsdNotify      LsdNotify          `yaml:"lsd_notify"`
 	LcpUpdateAuth  Auth               `yaml:"lcp_update_auth"`
 	LicenseStatus  LicenseStatus      `yaml:"license_status"`
 	Localization   Localization       `yaml:"localization"`
 	Logging        Logging            `yaml:"logging"`
+	Packaging      Packaging          `yaml:"packaging"`
+	ContentKeys    ContentKeys        `yaml:"content_keys"`
+	Tenants        []Tenant           `yaml:"tenants"`
 
-	// DISABLED, see https://github.com/readium/readium-lcp-server/issues/109
-	//AES256_CBC_OR_GCM string             `yaml:"aes256_cbc_or_gcm,omitempty"`
+	// encryption of publication resources, CBC (the default) or GCM
+	AES256_CBC_OR_GCM string `yaml:"aes256_cbc_or_gcm,omitempty"`
 }
 
 type ServerInfo struct {
@@ -78,9 +82,43 @@ type Auth struct {
 	Password string `yaml:"password"`
 }
 
+// LsdNotify sets the retries of the notifications of the new licenses to the License Status Server
+type LsdNotify struct {
+	MaxAttempts   int `yaml:"max_attempts"`
+	RetryDelay    int `yaml:"retry_delay"`     // seconds before the first retry, doubled after each attempt
+	MaxRetryDelay int `yaml:"max_retry_delay"` // seconds
+}
+
 type Certificate struct {
 	Cert       string `yaml:"cert"`
 	PrivateKey string `yaml:"private_key"`
+	Signer     Signer `yaml:"signer"`
+	// other certificates of the provider, e.g. the next one; the licenses are signed with the valid one issued last
+	Rotation          []Certificate `yaml:"rotation"`
+	RootCA            string        `yaml:"root_ca"`
+	ExpiryWarningDays int           `yaml:"expiry_warning_days"`
+}
+
+// Signer selects where the private key which signs the licenses is: file (the default), pkcs11 or http
+type Signer struct {
+	Type   string       `yaml:"type"`
+	Pkcs11 Pkcs11Signer `yaml:"pkcs11"`
+	Http   HttpSigner   `yaml:"http"`
+}
+
+type Pkcs11Signer struct {
+	Library    string `yaml:"library"`
+	TokenLabel string `yaml:"token_label"`
+	Pin        string `yaml:"pin"`
+	KeyLabel   string `yaml:"key_label"`
+	KeyId      string `yaml:"key_id"`
+}
+
+type HttpSigner struct {
+	Url      string `yaml:"url"`
+	KeyId    string `yaml:"key_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
 }
 
 type FileSystem struct {
@@ -92,6 +130,7 @@ type Storage struct {
 	AccessId   string     `yaml:"access_id"`
 	DisableSSL bool       `yaml:"disable_ssl"`
 	PathStyle  bool       `yaml:"path_style"`
+	SigningKey string     `yaml:"signing_key"`
 	Mode       string
 	Secret     string
 	Endpoint   string
@@ -100,8 +139,45 @@ type Storage struct {
 	Token      string
 }
 
+type Packaging struct {
+	Directory        string `yaml:"directory"`
+	Workers          int    `yaml:"workers"`
+	MaxAttempts      int    `yaml:"max_attempts"`
+	DeobfuscateFonts bool   `yaml:"deobfuscate_fonts"`
+	Validation       string `yaml:"validation"`
+	Thumbnails       []int  `yaml:"thumbnails"`
+}
+
+// ContentKeys lists the master keys which wrap the content keys stored in the index
+type ContentKeys struct {
+	Current string      `yaml:"current"`
+	Keys    []MasterKey `yaml:"keys"`
+}
+
+// MasterKey is a hex encoded AES key, read from a file or an environment variable
+type MasterKey struct {
+	Id   string `yaml:"id"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// Tenant is a publisher or imprint served with its own provider, certificate and links.
+// A request is bound to a tenant by the /tenants/{id} path prefix or by the user it is authenticated with.
+// The settings left empty are taken from the top level of the configuration.
+type Tenant struct {
+	Id             string            `yaml:"id"`
+	Provider       string            `yaml:"provider"`
+	Users          []string          `yaml:"users"`
+	Certificate    Certificate       `yaml:"certificate"`
+	Links          map[string]string `yaml:"links"`
+	LicenseLinkUrl string            `yaml:"license_link_url"`
+}
+
 type License struct {
-	Links map[string]string `yaml:"links"`
+	Links              map[string]string `yaml:"links"`
+	PublicationLinkTTL int               `yaml:"publication_link_ttl"`
+	Profile            string            `yaml:"profile"`
+	ProviderProfiles   map[string]string `yaml:"provider_profiles"`
 }
 
 type LicenseStatus struct {
@@ -140,6 +216,18 @@ func ReadConfig(configFileName string) {
 	}
 }
 
+// Read reads a configuration file without changing the current configuration, e.g. to reload some of its settings
+func Read(configFileName string) (Configuration, error) {
+	var conf Configuration
+	filename, _ := filepath.Abs(configFileName)
+	yamlFile, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return conf, err
+	}
+	err = yaml.Unmarshal(yamlFile, &conf)
+	return conf, err
+}
+
 func SetPublicUrls() error {
 	var lcpPublicBaseUrl, lsdPublicBaseUrl, frontendPublicBaseUrl, lcpHost, lsdHost, frontendHost string
 	var lcpPort, lsdPort, frontendPort int
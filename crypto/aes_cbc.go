@@ -30,6 +30,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 )
 
@@ -42,7 +43,7 @@ const (
 func (e cbcEncrypter) Signature() string {
 	// Use PKCS#7 padding scheme (see https://www.w3.org/TR/WebCryptoAPI/#aes-cbc)
 	// Notice the last parameter "insertPadLengthAll" [true] of PaddedReader.
-	return "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	return ALGORITHM_AES_CBC
 }
 
 func (e cbcEncrypter) GenerateKey() (ContentKey, error) {
@@ -94,18 +95,27 @@ func (c cbcEncrypter) Decrypt(key ContentKey, r io.Reader, w io.Writer) error {
 	}
 
 	var buffer bytes.Buffer
-	io.Copy(&buffer, r)
+	if _, err = io.Copy(&buffer, r); err != nil {
+		return err
+	}
 
 	buf := buffer.Bytes()
+	if len(buf) < 2*aes.BlockSize || len(buf)%aes.BlockSize != 0 {
+		return errors.New("Invalid length of encrypted data")
+	}
 	iv := buf[:aes.BlockSize]
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(buf[aes.BlockSize:], buf[aes.BlockSize:])
 
 	padding := buf[len(buf)-1] // padding length valid for both PKCS#7 and W3C schemes
-	w.Write(buf[aes.BlockSize : len(buf)-int(padding)])
+	if padding == 0 || int(padding) > aes.BlockSize {
+		// most likely a wrong key
+		return errors.New("Invalid padding of decrypted data")
+	}
+	_, err = w.Write(buf[aes.BlockSize : len(buf)-int(padding)])
 
-	return nil
+	return err
 }
 
 func NewAESCBCEncrypter() Encrypter {
@@ -137,4 +137,16 @@ func TestKeyWrap(t *testing.T) {
 	if !bytes.Equal(out, expected) {
 		t.Errorf("Expected %x, got %x", expected, out)
 	}
+
+	unwrapped, err := KeyUnwrap(key, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, plain) {
+		t.Errorf("Expected %x, got %x", plain, unwrapped)
+	}
+	out[0] ^= 1
+	if _, err = KeyUnwrap(key, out); err != ErrKeyUnwrap {
+		t.Error("Expected a corrupted wrapped key to be refused")
+	}
 }
\ No newline at end of file
@@ -28,17 +28,16 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"encoding/binary"
+	"crypto/rand"
+	"errors"
 	"io"
 	"io/ioutil"
 )
 
-type gcmEncrypter struct {
-	counter uint64
-}
+type gcmEncrypter struct{}
 
 func (e gcmEncrypter) Signature() string {
-	return "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+	return ALGORITHM_AES_GCM
 }
 
 func (e gcmEncrypter) GenerateKey() (ContentKey, error) {
@@ -46,24 +45,31 @@ func (e gcmEncrypter) GenerateKey() (ContentKey, error) {
 	return ContentKey(slice), err
 }
 
-func (e *gcmEncrypter) Encrypt(key ContentKey, r io.Reader, w io.Writer) error {
+func newGCM(key ContentKey) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	counter := e.counter
-	e.counter++
-
-	gcm, err := cipher.NewGCM(block)
+// Encrypt writes the nonce followed by the ciphertext and the authentication tag.
+// The nonce is random, as many resources are encrypted with the same key.
+func (e gcmEncrypter) Encrypt(key ContentKey, r io.Reader, w io.Writer) error {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return err
 	}
 
 	nonce := make([]byte, gcm.NonceSize())
-	binary.BigEndian.PutUint64(nonce, counter)
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
 
 	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
 	out := gcm.Seal(nonce, nonce, data, nil)
 
 	_, err = w.Write(out)
@@ -71,6 +77,30 @@ func (e *gcmEncrypter) Encrypt(key ContentKey, r io.Reader, w io.Writer) error {
 	return err
 }
 
+func (e gcmEncrypter) Decrypt(key ContentKey, r io.Reader, w io.Writer) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < gcm.NonceSize() {
+		return errors.New("Invalid GCM data, shorter than the nonce")
+	}
+
+	out, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+
+	return err
+}
+
 func NewAESGCMEncrypter() Encrypter {
-	return &gcmEncrypter{}
-}
\ No newline at end of file
+	return gcmEncrypter{}
+}
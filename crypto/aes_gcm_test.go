@@ -66,4 +66,32 @@ func TestEncryptGCM(t *testing.T) {
 		t.Logf("After cycle: %#v", clear)
 		t.Errorf("Expected encryption-decryption to return original")
 	}
-}
\ No newline at end of file
+}
+func TestDecryptGCM(t *testing.T) {
+	encrypter := NewAESGCMEncrypter()
+	key, _ := encrypter.GenerateKey()
+	data := []byte("The quick brown fox jumps over the lazy dog")
+
+	var encrypted bytes.Buffer
+	if err := encrypter.Encrypt(key, bytes.NewReader(data), &encrypted); err != nil {
+		t.Fatal("Encryption failed", err)
+	}
+
+	decrypter, err := NewAESDecrypter(encrypter.Signature())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clear bytes.Buffer
+	if err = decrypter.Decrypt(key, bytes.NewReader(encrypted.Bytes()), &clear); err != nil {
+		t.Fatal("Decryption failed", err)
+	}
+	if !bytes.Equal(data, clear.Bytes()) {
+		t.Errorf("Expected encryption-decryption to return original")
+	}
+
+	tampered := encrypted.Bytes()
+	tampered[len(tampered)-1] ^= 1
+	if err = decrypter.Decrypt(key, bytes.NewReader(tampered), &clear); err == nil {
+		t.Errorf("Expected decryption of tampered data to fail")
+	}
+}
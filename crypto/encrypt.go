@@ -26,11 +26,25 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/aes"
+	"errors"
 	"io"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+const (
+	// settings of the encryption of publication resources
+	ENCRYPTION_CBC = "CBC"
+	ENCRYPTION_GCM = "GCM"
+
+	ALGORITHM_AES_CBC = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	ALGORITHM_AES_GCM = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
 )
-//"github.com/readium/readium-lcp-server/config"
-// FOR: config.Config.AES256_CBC_OR_GCM
+
+var ErrUnknownEncryption = errors.New("Unknown encryption setting, must be CBC or GCM")
 
 type Encrypter interface {
 	Encrypt(key ContentKey, r io.Reader, w io.Writer) error
@@ -42,16 +56,37 @@ type Decrypter interface {
 	Decrypt(key ContentKey, r io.Reader, w io.Writer) error
 }
 
+// NewAESEncrypter_PUBLICATION_RESOURCES returns the encrypter selected by
+// config.Config.AES256_CBC_OR_GCM, CBC if it is not set
 func NewAESEncrypter_PUBLICATION_RESOURCES() Encrypter {
-	
-	return NewAESCBCEncrypter()
+	encrypter, err := NewAESEncrypter(config.Config.AES256_CBC_OR_GCM)
+	if err != nil { // the setting is checked when the servers start
+		return NewAESCBCEncrypter()
+	}
+	return encrypter
+}
+
+// NewAESEncrypter returns the encrypter of publication resources for the
+// setting mode, CBC or GCM; CBC is used if mode is empty
+func NewAESEncrypter(mode string) (Encrypter, error) {
+	switch strings.ToUpper(mode) {
+	case "", ENCRYPTION_CBC:
+		return NewAESCBCEncrypter(), nil
+	case ENCRYPTION_GCM:
+		return NewAESGCMEncrypter(), nil
+	}
+	return nil, ErrUnknownEncryption
+}
 
-	// DISABLED, see https://github.com/readium/readium-lcp-server/issues/109
-	// if config.Config.AES256_CBC_OR_GCM == "GCM" {
-	// 	return NewAESGCMEncrypter()
-	// } else { // default to CBC
-	// 	return NewAESCBCEncrypter()
-	// }
+// NewAESDecrypter returns the decrypter of resources encrypted with the algorithm URI
+func NewAESDecrypter(algorithm string) (Decrypter, error) {
+	switch algorithm {
+	case ALGORITHM_AES_CBC:
+		return NewAESCBCEncrypter().(Decrypter), nil
+	case ALGORITHM_AES_GCM:
+		return NewAESGCMEncrypter().(Decrypter), nil
+	}
+	return nil, errors.New("Unsupported encryption algorithm " + algorithm)
 }
 
 func NewAESEncrypter_CONTENT_KEY() Encrypter {
@@ -100,3 +135,39 @@ func KeyWrap(kek []byte, key []byte) []byte {
 	copy(r, a)
 	return r
 }
+
+var ErrKeyUnwrap = errors.New("Invalid wrapped key")
+
+// KeyUnwrap reverses KeyWrap (RFC 3394), and checks the integrity of the wrapped key
+func KeyUnwrap(kek []byte, wrapped []byte) ([]byte, error) {
+	cipher, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, ErrKeyUnwrap
+	}
+	n := len(wrapped)/8 - 1
+	a := make([]byte, len(keywrap_iv))
+	r := make([]byte, n*8)
+	copy(a, wrapped[:8])
+	copy(r, wrapped[8:])
+
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			block := make([]byte, aes.BlockSize)
+			t := n*j + i
+			copy(block, a)
+			block[7] = block[7] ^ byte(t)
+			copy(block[8:], r[(i-1)*8:i*8])
+			cipher.Decrypt(block, block)
+			copy(a, block[0:8])
+			copy(r[(i-1)*8:], block[8:])
+		}
+	}
+
+	if !bytes.Equal(a, keywrap_iv) {
+		return nil, ErrKeyUnwrap
+	}
+	return r, nil
+}
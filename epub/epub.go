@@ -56,10 +56,18 @@ type Epub struct {
 	cleartextResources []string
 }
 
+// Cover returns the cover image of the epub: the manifest item with the cover-image
+// property (EPUB 3), or the item referenced by the cover meta (EPUB 2)
 func (ep Epub) Cover() (bool, *Resource) {
 	for _, p := range ep.Package {
+		coverId := ""
+		for _, meta := range p.Metadata.Metas {
+			if meta.Name == "cover" {
+				coverId = meta.Content
+			}
+		}
 		for _, it := range p.Manifest.Items {
-			if strings.Contains(it.Properties, "cover-image") {
+			if strings.Contains(it.Properties, "cover-image") || (coverId != "" && it.Id == coverId) {
 				path := filepath.Join(p.BasePath, it.Href)
 				for _, r := range ep.Resource {
 					if r.Path == path {
@@ -90,6 +98,12 @@ type Resource struct {
 }
 
 func (ep Epub) CanEncrypt(file string) bool {
+	// already encrypted or obfuscated, e.g. fonts
+	if ep.Encryption != nil {
+		if _, ok := ep.Encryption.DataForFile(file); ok {
+			return false
+		}
+	}
 	i := sort.SearchStrings(ep.cleartextResources, file)
 	return i >= len(ep.cleartextResources) || ep.cleartextResources[i] != file
 }
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package epub
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	ALGORITHM_IDPF_OBFUSCATION  = "http://www.idpf.org/2008/embedding"
+	ALGORITHM_ADOBE_OBFUSCATION = "http://ns.adobe.com/pdf/enc#RC"
+
+	// number of obfuscated bytes at the start of a font
+	idpfObfuscatedLength  = 1040
+	adobeObfuscatedLength = 1024
+)
+
+// IsObfuscation tells whether algorithm is a font obfuscation algorithm
+func IsObfuscation(algorithm string) bool {
+	return algorithm == ALGORITHM_IDPF_OBFUSCATION || algorithm == ALGORITHM_ADOBE_OBFUSCATION
+}
+
+// Deobfuscate restores the fonts obfuscated with the IDPF or Adobe algorithm
+// and removes their entries from the encryption manifest, so that they are
+// then encrypted like any other resource.
+func (ep *Epub) Deobfuscate() error {
+	if ep.Encryption == nil || len(ep.Package) == 0 {
+		return nil
+	}
+	identifier := ep.Package[0].Identifier()
+
+	var kept = ep.Encryption.Data[:0:0]
+	for _, data := range ep.Encryption.Data {
+		var key []byte
+		var length int
+		var err error
+		switch string(data.Method.Algorithm) {
+		case ALGORITHM_IDPF_OBFUSCATION:
+			key, length = idpfKey(identifier), idpfObfuscatedLength
+		case ALGORITHM_ADOBE_OBFUSCATION:
+			key, err = adobeKey(identifier)
+			length = adobeObfuscatedLength
+		default:
+			kept = append(kept, data)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		path := data.CipherData.CipherReference.URI.Path()
+		for _, res := range ep.Resource {
+			if res.Path == path {
+				res.Contents = &deobfuscatingReader{r: res.Contents, key: key, length: length}
+			}
+		}
+	}
+	ep.Encryption.Data = kept
+
+	return nil
+}
+
+// idpfKey is the SHA-1 digest of the unique identifier, stripped of white space
+func idpfKey(identifier string) []byte {
+	identifier = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, identifier)
+	key := sha1.Sum([]byte(identifier))
+	return key[:]
+}
+
+// adobeKey is the 16 bytes of the UUID used as the unique identifier
+func adobeKey(identifier string) ([]byte, error) {
+	uuid := strings.TrimPrefix(strings.TrimPrefix(identifier, "urn:uuid:"), "uuid:")
+	key, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1))
+	if err != nil || len(key) != 16 {
+		return nil, errors.New("Adobe font obfuscation needs a UUID identifier, got " + identifier)
+	}
+	return key, nil
+}
+
+// deobfuscatingReader xors the first length bytes read from r with the key
+type deobfuscatingReader struct {
+	r      io.Reader
+	key    []byte
+	length int
+	offset int
+}
+
+func (d *deobfuscatingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	for i := 0; i < n && d.offset < d.length; i++ {
+		p[i] ^= d.key[d.offset%len(d.key)]
+		d.offset++
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package epub
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/epub/opf"
+	"github.com/readium/readium-lcp-server/xmlenc"
+)
+
+func TestDeobfuscateAdobe(t *testing.T) {
+	font := bytes.Repeat([]byte("font data "), 200)
+	key, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+	obfuscated := append([]byte(nil), font...)
+	for i := 0; i < 1024; i++ {
+		obfuscated[i] ^= key[i%len(key)]
+	}
+
+	var ep Epub
+	ep.Package = []opf.Package{{UniqueIdentifier: "id", Metadata: opf.Metadata{Identifiers: []opf.Identifier{
+		{Value: "isbn"}, {Id: "id", Value: "urn:uuid:01234567-89ab-cdef-0123-456789abcdef"}}}}}
+	ep.Encryption = &xmlenc.Manifest{}
+	ep.Encryption.Data = make([]xmlenc.Data, 1)
+	ep.Encryption.Data[0].Method.Algorithm = ALGORITHM_ADOBE_OBFUSCATION
+	ep.Encryption.Data[0].CipherData.CipherReference.URI = "fonts/font.otf"
+	ep.Add("fonts/font.otf", bytes.NewReader(obfuscated), uint64(len(obfuscated)))
+
+	if ep.CanEncrypt("fonts/font.otf") {
+		t.Errorf("Did not expect an obfuscated font to be encrypted")
+	}
+	if err := ep.Deobfuscate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ep.Encryption.Data) != 0 {
+		t.Errorf("Expected the obfuscation entry to be removed")
+	}
+	clear, _ := ioutil.ReadAll(ep.Resource[0].Contents)
+	if !bytes.Equal(clear, font) {
+		t.Errorf("Expected the font to be deobfuscated")
+	}
+}
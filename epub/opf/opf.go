@@ -28,19 +28,44 @@ package opf
 import (
 	"encoding/xml"
 	"io"
+	"strings"
 )
 
 type Package struct {
-	BasePath string   `xml:"-"`
-	Metadata Metadata `xml:"http://www.idpf.org/2007/opf metadata"`
-	Manifest Manifest `xml:"http://www.idpf.org/2007/opf manifest"`
+	BasePath         string   `xml:"-"`
+	UniqueIdentifier string   `xml:"unique-identifier,attr"`
+	Metadata         Metadata `xml:"http://www.idpf.org/2007/opf metadata"`
+	Manifest         Manifest `xml:"http://www.idpf.org/2007/opf manifest"`
 }
 type Metadata struct {
-	Author string `json:"author" xml:"http://purl.org/dc/elements/1.1/ creator"`
-	Title  string `json:"title" xml:"http://purl.org/dc/elements/1.1/ title"`
-	Isbn   string `json:"isbn" xml:"http://purl.org/dc/elements/1.1/ identifier"`
-	Metas  []Meta `xml:"http://www.idpf.org/2007/opf meta"`
-	Cover  string `json:"cover"`
+	Author      string       `json:"author" xml:"-"`
+	Authors     []string     `json:"-" xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Title       string       `json:"title" xml:"http://purl.org/dc/elements/1.1/ title"`
+	Isbn        string       `json:"isbn" xml:"-"`
+	Identifiers []Identifier `json:"-" xml:"http://purl.org/dc/elements/1.1/ identifier"`
+	Language    []string     `json:"language" xml:"http://purl.org/dc/elements/1.1/ language"`
+	Publisher   string       `json:"publisher" xml:"http://purl.org/dc/elements/1.1/ publisher"`
+	Metas       []Meta       `xml:"http://www.idpf.org/2007/opf meta"`
+	Cover       string       `json:"cover"`
+}
+
+type Identifier struct {
+	Id    string `xml:"id,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Identifier returns the unique identifier of the publication, the identifier
+// referenced by the unique-identifier attribute of the package
+func (p Package) Identifier() string {
+	for _, id := range p.Metadata.Identifiers {
+		if id.Id == p.UniqueIdentifier {
+			return strings.TrimSpace(id.Value)
+		}
+	}
+	if len(p.Metadata.Identifiers) > 0 {
+		return strings.TrimSpace(p.Metadata.Identifiers[0].Value)
+	}
+	return ""
 }
 
 type Manifest struct {
@@ -81,5 +106,11 @@ func Parse(r io.Reader) (Package, error) {
 	var p Package
 	xd := xml.NewDecoder(r)
 	err := xd.Decode(&p)
+	if len(p.Metadata.Identifiers) > 0 {
+		p.Metadata.Isbn = strings.TrimSpace(p.Metadata.Identifiers[0].Value)
+	}
+	if len(p.Metadata.Authors) > 0 {
+		p.Metadata.Author = strings.TrimSpace(p.Metadata.Authors[0])
+	}
 	return p, err
 }
@@ -0,0 +1,273 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package epub
+
+import (
+	"archive/zip"
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/epub/opf"
+	"github.com/readium/readium-lcp-server/xmlenc"
+)
+
+const (
+	// a publication with validation errors is rejected
+	VALIDATION_REJECT = "reject"
+	// validation errors are reported, the publication is processed anyway
+	VALIDATION_WARN = "warn"
+)
+
+var ErrUnknownValidation = errors.New("Unknown validation setting, must be reject or warn")
+
+// Issue is a problem found in a publication
+type Issue struct {
+	Code    string `json:"code"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// Report lists the errors, which break the publication, and the warnings found by Validate
+type Report struct {
+	Errors   []Issue `json:"errors,omitempty"`
+	Warnings []Issue `json:"warnings,omitempty"`
+}
+
+func (r Report) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+func (r Report) Empty() bool {
+	return len(r.Errors) == 0 && len(r.Warnings) == 0
+}
+
+func (r *Report) error(code string, path string, message string) {
+	r.Errors = append(r.Errors, Issue{Code: code, Path: path, Message: message})
+}
+
+func (r *Report) warning(code string, path string, message string) {
+	r.Warnings = append(r.Warnings, Issue{Code: code, Path: path, Message: message})
+}
+
+// ValidationError is returned when a publication is rejected because of its validation errors
+type ValidationError struct {
+	Report Report
+}
+
+func (e ValidationError) Error() string {
+	messages := make([]string, len(e.Report.Errors))
+	for i, issue := range e.Report.Errors {
+		messages[i] = issue.Message
+	}
+	return "Invalid EPUB: " + strings.Join(messages, "; ")
+}
+
+// CheckValidationMode returns an error if mode is not a validation setting;
+// an empty mode is the same as VALIDATION_WARN
+func CheckValidationMode(mode string) error {
+	if mode != "" && mode != VALIDATION_REJECT && mode != VALIDATION_WARN {
+		return ErrUnknownValidation
+	}
+	return nil
+}
+
+// Check validates the epub read from zr. With the VALIDATION_REJECT mode,
+// a ValidationError is returned if the publication has errors.
+func Check(zr *zip.Reader, mode string) (Report, error) {
+	report := Validate(zr)
+	if mode == VALIDATION_REJECT && !report.Valid() {
+		return report, ValidationError{report}
+	}
+	return report, nil
+}
+
+// Validate checks the structure of the epub read from zr:
+// the mimetype file, the container, the package documents and their manifest,
+// and the encryption manifest
+func Validate(zr *zip.Reader) Report {
+	var report Report
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+		if strings.HasPrefix(f.Name, "/") || strings.Contains(f.Name, "\\") || hasParentReference(f.Name) {
+			report.error("invalid-path", f.Name, "The path of the file is not a relative path inside the container")
+		}
+	}
+
+	validateMimetype(zr, &report)
+
+	container, ok := files[ContainerFile]
+	if !ok {
+		report.error("missing-container", ContainerFile, "The container file is missing")
+		return report
+	}
+	rc, err := container.Open()
+	if err != nil {
+		report.error("invalid-container", ContainerFile, err.Error())
+		return report
+	}
+	rootFiles, err := findRootFiles(rc)
+	rc.Close()
+	if err != nil {
+		report.error("invalid-container", ContainerFile, "The container file cannot be parsed: "+err.Error())
+		return report
+	}
+	if len(rootFiles) == 0 {
+		report.error("missing-rootfile", ContainerFile, "The container file has no rootfile")
+	}
+
+	listed := map[string]bool{ContainerFile: true, EncryptionFile: true, LicenseFile: true, "mimetype": true}
+	for _, rootFile := range rootFiles {
+		listed[rootFile.FullPath] = true
+		validatePackage(rootFile.FullPath, files, listed, &report)
+	}
+
+	if f, ok := files[EncryptionFile]; ok {
+		validateEncryption(f, files, &report)
+	}
+
+	for _, f := range zr.File {
+		if !listed[f.Name] && !strings.HasPrefix(f.Name, "META-INF/") && !strings.HasSuffix(f.Name, "/") {
+			report.warning("unlisted-file", f.Name, "The file is not listed in the manifest of a package document")
+		}
+	}
+
+	return report
+}
+
+func validateMimetype(zr *zip.Reader, report *Report) {
+	for i, f := range zr.File {
+		if f.Name != "mimetype" {
+			continue
+		}
+		if i != 0 {
+			report.warning("mimetype-position", f.Name, "The mimetype file is not the first file of the container")
+		}
+		if f.Method != zip.Store {
+			report.warning("mimetype-compressed", f.Name, "The mimetype file is compressed")
+		}
+		rc, err := f.Open()
+		if err != nil {
+			report.error("invalid-mimetype", f.Name, err.Error())
+			return
+		}
+		defer rc.Close()
+		buf := make([]byte, len(ContentType_EPUB)+1)
+		n, _ := rc.Read(buf)
+		if string(buf[:n]) != ContentType_EPUB {
+			report.error("invalid-mimetype", f.Name, "The mimetype file does not contain "+ContentType_EPUB)
+		}
+		return
+	}
+	report.warning("missing-mimetype", "mimetype", "The mimetype file is missing")
+}
+
+func validatePackage(name string, files map[string]*zip.File, listed map[string]bool, report *Report) {
+	f, ok := files[name]
+	if !ok {
+		report.error("missing-package", name, "The package document referenced by the container is missing")
+		return
+	}
+	rc, err := f.Open()
+	if err != nil {
+		report.error("invalid-package", name, err.Error())
+		return
+	}
+	p, err := opf.Parse(rc)
+	rc.Close()
+	if err != nil {
+		report.error("invalid-package", name, "The package document cannot be parsed: "+err.Error())
+		return
+	}
+
+	if len(p.Manifest.Items) == 0 {
+		report.error("empty-manifest", name, "The manifest of the package document has no item")
+	}
+	if p.Metadata.Title == "" {
+		report.warning("missing-title", name, "The package document has no title")
+	}
+	if p.Identifier() == "" {
+		report.warning("missing-identifier", name, "The package document has no identifier")
+	}
+
+	ids := make(map[string]bool)
+	base := path.Dir(name)
+	for _, item := range p.Manifest.Items {
+		if ids[item.Id] {
+			report.warning("duplicate-id", name, "The manifest item id "+item.Id+" is used more than once")
+		}
+		ids[item.Id] = true
+		if item.MediaType == "" {
+			report.warning("missing-media-type", item.Href, "The manifest item "+item.Id+" has no media type")
+		}
+
+		u, err := url.Parse(item.Href)
+		if err != nil {
+			report.error("invalid-href", item.Href, "The href of the manifest item "+item.Id+" is not a valid URL")
+			continue
+		}
+		if u.IsAbs() {
+			continue // remote resource
+		}
+		target := path.Join(base, u.Path)
+		listed[target] = true
+		if _, ok := files[target]; !ok {
+			report.error("missing-resource", target, "The manifest item "+item.Id+" references a file missing from the container")
+		}
+	}
+}
+
+func validateEncryption(f *zip.File, files map[string]*zip.File, report *Report) {
+	rc, err := f.Open()
+	if err != nil {
+		report.error("invalid-encryption", f.Name, err.Error())
+		return
+	}
+	m, err := xmlenc.Read(rc)
+	rc.Close()
+	if err != nil {
+		report.error("invalid-encryption", f.Name, "The encryption file cannot be parsed: "+err.Error())
+		return
+	}
+	for _, data := range m.Data {
+		target := data.CipherData.CipherReference.URI.Path()
+		if _, ok := files[target]; !ok {
+			report.warning("missing-encrypted-resource", target, "The encryption file references a file missing from the container")
+		}
+	}
+}
+
+func hasParentReference(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
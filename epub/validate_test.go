@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// rewriteSample copies the sample epub, skipping the files in skip,
+// and returns a reader on the result
+func rewriteSample(t *testing.T, skip ...string) *zip.Reader {
+	zr, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		if contains(skip, f.Name) {
+			continue
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: f.Method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasIssue(issues []Issue, code string) bool {
+	for _, issue := range issues {
+		if issue.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateSample(t *testing.T) {
+	report := Validate(rewriteSample(t))
+	if !report.Valid() {
+		t.Errorf("Expected the sample to be valid, got %v", report.Errors)
+	}
+}
+
+func TestValidateMissingFiles(t *testing.T) {
+	report := Validate(rewriteSample(t, "mimetype", "OPS/toc.xhtml"))
+	if report.Valid() {
+		t.Fatal("Expected an error for the missing resource")
+	}
+	if !hasIssue(report.Errors, "missing-resource") {
+		t.Errorf("Expected a missing-resource error, got %v", report.Errors)
+	}
+	if !hasIssue(report.Warnings, "missing-mimetype") {
+		t.Errorf("Expected a missing-mimetype warning, got %v", report.Warnings)
+	}
+
+	report = Validate(rewriteSample(t, ContainerFile))
+	if !hasIssue(report.Errors, "missing-container") {
+		t.Errorf("Expected a missing-container error, got %v", report.Errors)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	zr := rewriteSample(t, "OPS/toc.xhtml")
+
+	report, err := Check(zr, VALIDATION_WARN)
+	if err != nil {
+		t.Errorf("Expected no error in warn mode, got %v", err)
+	}
+	if report.Valid() {
+		t.Errorf("Expected the report to contain errors")
+	}
+
+	_, err = Check(zr, VALIDATION_REJECT)
+	if _, ok := err.(ValidationError); !ok {
+		t.Errorf("Expected a ValidationError in reject mode, got %v", err)
+	}
+
+	if CheckValidationMode("strict") != ErrUnknownValidation {
+		t.Errorf("Expected an unknown validation mode to be refused")
+	}
+}
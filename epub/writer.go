@@ -56,6 +56,21 @@ func (w *Writer) Copy(r *Resource) error {
 	return err
 }
 
+// CopyRaw copies a zip entry as is, without decompressing and recompressing it
+func (w *Writer) CopyRaw(f *zip.File) error {
+	header := f.FileHeader
+	fw, err := w.w.CreateRaw(&header)
+	if err != nil {
+		return err
+	}
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
 func (w *Writer) WriteEncryption(enc *xmlenc.Manifest) error {
 	fw, err := w.AddResource(EncryptionFile, zip.Deflate)
 	if err != nil {
@@ -104,6 +119,38 @@ func (ep Epub) Write(dst io.Writer) error {
 	return w.Close()
 }
 
+// AddLicense streams the epub read from zr to dst, copying every entry verbatim
+// and adding the license document as META-INF/license.lcpl.
+// An existing license document in the source is replaced.
+func AddLicense(zr *zip.Reader, license []byte, dst io.Writer) error {
+	return AddFile(zr, LicenseFile, license, dst)
+}
+
+// AddFile streams the zip package read from zr to dst, copying every entry verbatim
+// and adding contents as name. An existing entry with the same name is replaced.
+func AddFile(zr *zip.Reader, name string, contents []byte, dst io.Writer) error {
+	w := NewWriter(dst)
+
+	for _, f := range zr.File {
+		if f.Name == name {
+			continue
+		}
+		if err := w.CopyRaw(f); err != nil {
+			return err
+		}
+	}
+
+	fw, err := w.AddResource(name, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	if _, err = fw.Write(contents); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
 func writeEncryption(ep Epub, w *Writer) error {
 	return w.WriteEncryption(ep.Encryption)
 }
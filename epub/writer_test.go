@@ -137,3 +137,42 @@ func testContentsOfFileInZip(t *testing.T, zr *zip.Reader, m uint16, path, expec
 		}
 	}
 }
+
+func TestAddLicense(t *testing.T) {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	license := `{"id":"test-license"}`
+	var buf bytes.Buffer
+	if err = AddLicense(&z.Reader, []byte(license), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal("Could not read zip", err)
+	}
+
+	if l := len(zr.File); l != len(z.File)+1 {
+		t.Fatalf("Expected %d files, got %d", len(z.File)+1, l)
+	}
+	if name := zr.File[0].Name; name != "mimetype" {
+		t.Errorf("Expected mimetype to be the first file, got %s", name)
+	}
+
+	for i, f := range z.File {
+		out := zr.File[i]
+		if f.Name != out.Name || f.Method != out.Method || f.CRC32 != out.CRC32 || f.CompressedSize64 != out.CompressedSize64 {
+			t.Errorf("Expected %s to be copied as is", f.Name)
+		}
+	}
+
+	testContentsOfFileInZip(t, zr, zip.Deflate, LicenseFile, license)
+
+	if _, err = Read(zr); err != nil {
+		t.Error("Could not construct epub from zip", err)
+	}
+}
@@ -196,7 +196,8 @@ func UpdatePublication(w http.ResponseWriter, r *http.Request, s IServer) {
 	}
 }
 
-// DeletePublication removes a publication in the database
+// DeletePublication removes a publication from the License server and the database
+// the "policy" query parameter (refuse, revoke or ignore) tells what to do with its active licenses
 func DeletePublication(w http.ResponseWriter, r *http.Request, s IServer) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"], 10, 64)
@@ -204,8 +205,15 @@ func DeletePublication(w http.ResponseWriter, r *http.Request, s IServer) {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
-	if err := s.PublicationAPI().Delete(id); err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+	if err := s.PublicationAPI().Delete(id, r.URL.Query().Get("policy")); err != nil {
+		switch err {
+		case webpublication.ErrNotFound:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		case webpublication.ErrActiveLicenses:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusConflict)
+		default:
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		}
 		return
 	}
 	// publication deleted from db
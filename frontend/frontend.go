@@ -42,6 +42,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/epub"
 	"github.com/readium/readium-lcp-server/frontend/server"
 	"github.com/readium/readium-lcp-server/frontend/webpublication"
 	"github.com/readium/readium-lcp-server/frontend/webpurchase"
@@ -69,6 +70,10 @@ func main() {
 		panic(err)
 	}
 
+	if err = epub.CheckValidationMode(config.Config.Packaging.Validation); err != nil {
+		panic(err)
+	}
+
 	log.Println("LCP server = " + config.Config.LcpServer.PublicBaseUrl)
 	log.Println("using login  " + config.Config.LcpUpdateAuth.Username)
 
@@ -32,6 +32,7 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"time"
@@ -58,13 +59,16 @@ const (
 // ErrNotFound error trown when publication is not found
 var ErrNotFound = errors.New("Publication not found")
 
+// ErrActiveLicenses error thrown when a publication with active licenses is not deleted
+var ErrActiveLicenses = errors.New("The publication has active licenses")
+
 // WebPublication interface for publication db interaction
 type WebPublication interface {
 	Get(id int64) (Publication, error)
 	GetByUUID(uuid string) (Publication, error)
 	Add(publication Publication) error
 	Update(publication Publication) error
-	Delete(id int64) error
+	Delete(id int64, policy string) error
 	List(page int, pageNum int) func() (Publication, error)
 }
 
@@ -147,7 +151,10 @@ func (pubManager PublicationManager) Add(pub Publication) error {
 		pubManager.config.FrontendServer.EncryptedRepository, outputFilename)
 
 	// Encrypt file
-	encryptedEpub, err := encrypt.EncryptEpub(inputPath, outputPath)
+	encryptedEpub, err := encrypt.EncryptEpub(inputPath, outputPath, pubManager.config.Packaging.Validation)
+	for _, issue := range encryptedEpub.Validation.Warnings {
+		log.Printf("Publication %s: warning %s %s: %s", pub.MasterFilename, issue.Code, issue.Path, issue.Message)
+	}
 
 	if err != nil {
 		// Unable to encrypt master file
@@ -165,6 +172,8 @@ func (pubManager PublicationManager) Add(pub Publication) error {
 	lcpPublication.ContentDisposition = &contentDisposition
 	lcpPublication.Checksum = &encryptedEpub.Checksum
 	lcpPublication.Size = &encryptedEpub.Size
+	lcpPublication.Algorithm = encryptedEpub.Algorithm
+	lcpPublication.Metadata = &encryptedEpub.Metadata
 
 	jsonBody, err := json.Marshal(lcpPublication)
 	if err != nil {
@@ -234,9 +243,47 @@ func (pubManager PublicationManager) Update(pub Publication) error {
 }
 
 // Delete publication
-func (pubManager PublicationManager) Delete(id int64) error {
+// The content is deleted from the License server first, policy tells it what to do
+// with the active licenses of the publication: refuse (the default), revoke or ignore
+func (pubManager PublicationManager) Delete(id int64, policy string) error {
 	fmt.Print("Delete:")
 	fmt.Println(id)
+	pub, err := pubManager.Get(id)
+	if err != nil {
+		return err
+	}
+
+	lcpServerConfig := pubManager.config.LcpServer
+	lcpURL := lcpServerConfig.PublicBaseUrl + "/contents/" + pub.UUID
+	if policy != "" {
+		lcpURL += "?policy=" + url.QueryEscape(policy)
+	}
+	log.Println("DELETE " + lcpURL)
+	req, err := http.NewRequest("DELETE", lcpURL, nil)
+	if err != nil {
+		return err
+	}
+	lcpUpdateAuth := pubManager.config.LcpUpdateAuth
+	if pubManager.config.LcpUpdateAuth.Username != "" {
+		req.SetBasicAuth(lcpUpdateAuth.Username, lcpUpdateAuth.Password)
+	}
+	var lcpClient = &http.Client{
+		Timeout: time.Second * 30,
+	}
+	resp, err := lcpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotFound:
+		// deleted, or never stored on the License server
+	case http.StatusConflict:
+		return ErrActiveLicenses
+	default:
+		return fmt.Errorf("License server returned HTTP status %d", resp.StatusCode)
+	}
+
 	dbDelete, err := pubManager.db.Prepare("DELETE FROM publication WHERE id = ?")
 	if err != nil {
 		return err
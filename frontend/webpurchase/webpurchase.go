@@ -203,8 +203,11 @@ func (pManager purchaseManager) GenerateLicense(purchase Purchase) (license.Lice
 	// Create LCP license
 	partialLicense := license.License{}
 
-	// Provider
-	partialLicense.Provider = "provider"
+	// Provider, the license server replaces it with the provider of the tenant of the content
+	partialLicense.Provider = config.Config.FrontendServer.ProviderID
+	if partialLicense.Provider == "" {
+		partialLicense.Provider = "provider"
+	}
 
 	// User
 	encryptedAttrs := []string{"email", "name"}
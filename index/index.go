@@ -27,16 +27,40 @@ package index
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
 )
 
 var NotFound = errors.New("Content not found")
 
+var ErrInvalidId = errors.New("Invalid content id")
+
+// reserveAttempts is the number of times a version is reserved again when another one took it meanwhile
+const reserveAttempts = 10
+
+// reservedSuffix matches the suffixes of the storage keys derived from a content id:
+// its versions (.v2), its cover (.cover) and the thumbnails of its cover (.cover.120)
+var reservedSuffix = regexp.MustCompile(`\.(v[0-9]+|cover(\.[0-9]+)?)$`)
+
 type Index interface {
 	Get(id string) (Content, error)
+	GetVersion(id string, version int) (Content, error)
 	Add(c Content) error
+	AddVersion(c Content) error
+	ReserveVersion(id string) (int, error)
 	Update(c Content) error
+	Delete(id string) error
+	Versions(id string) func() (Content, error)
 	List() func() (Content, error)
+	Search(tenant string, title string, isbn string) func() (Content, error)
+	RewrapKeys() (int, error)
 }
 
 type Content struct {
@@ -45,49 +69,402 @@ type Content struct {
 	Location      string `json:"location"`
 	Length        int64  `json:"length"` //not exported in license spec?
 	Sha256        string `json:"sha256"` //not exported in license spec?
+	Type          string `json:"type"`
+	Algorithm     string `json:"algorithm"`
+	Version       int    `json:"version"`
+	// tenant which packaged or added the content, empty without tenants
+	Tenant string `json:"tenant,omitempty"`
+	Metadata
+}
+
+// StorageKey returns the key of the protected publication of this version of the content in the store.
+// The first version is stored under the content id.
+func (c Content) StorageKey() string {
+	if c.Version <= 1 {
+		return c.Id
+	}
+	return fmt.Sprintf("%s.v%d", c.Id, c.Version)
+}
+
+// CheckId checks that a content id chosen by a client can be used as a storage key:
+// it must not contain a path separator or "..", nor end with a suffix reserved for the keys derived from an id
+func CheckId(id string) error {
+	if id == "" || strings.ContainsAny(id, "/\\") || strings.Contains(id, "..") || reservedSuffix.MatchString(id) {
+		return ErrInvalidId
+	}
+	return nil
+}
+
+// ParseStorageKey returns the content id and version stored under a key, the reverse of StorageKey
+func ParseStorageKey(key string) (string, int) {
+	if i := strings.LastIndex(key, ".v"); i > 0 {
+		if version, err := strconv.Atoi(key[i+2:]); err == nil && version > 1 {
+			return key[:i], version
+		}
+	}
+	return key, 1
 }
 
+// Metadata describes the publication, as found in its package document or manifest
+type Metadata struct {
+	Title       string   `json:"title,omitempty"`
+	Authors     []string `json:"authors,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+	Identifiers []string `json:"identifiers,omitempty"`
+}
+
+// Isbn returns the first identifier of the publication which is an ISBN, normalized
+func (m Metadata) Isbn() string {
+	for _, id := range m.Identifiers {
+		if isbn := NormalizeIsbn(id); isbn != "" {
+			return isbn
+		}
+	}
+	return ""
+}
+
+// NormalizeIsbn returns the digits of an ISBN, without the urn:isbn: prefix and separators,
+// or an empty string if id is not an ISBN
+func NormalizeIsbn(id string) string {
+	id = strings.TrimSpace(id)
+	if strings.HasPrefix(strings.ToLower(id), "urn:isbn:") {
+		id = id[len("urn:isbn:"):]
+	}
+	id = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(id))
+	if len(id) != 10 && len(id) != 13 {
+		return ""
+	}
+	for i, c := range id {
+		if (c < '0' || c > '9') && !(c == 'X' && i == 9 && len(id) == 10) {
+			return ""
+		}
+	}
+	return id
+}
+
+const contentColumns = "id,encryption_key,location,length,sha256,type,algorithm,title,authors,language,publisher,identifiers,version,kek_id,tenant"
+
+// versionColumns are the contentColumns of a version of the content, which has its own key and file
+const versionColumns = "c.id,v.encryption_key,v.location,v.length,v.sha256,v.type,v.algorithm,c.title,c.authors,c.language,c.publisher,c.identifiers,v.version,v.kek_id,c.tenant"
+
 type dbIndex struct {
 	db   *sql.DB
 	get  *sql.Stmt
 	add  *sql.Stmt
 	list *sql.Stmt
+	keys *KeyRing
 }
 
 func (i dbIndex) Get(id string) (Content, error) {
 	records, err := i.get.Query(id)
+	if err != nil {
+		return Content{}, err
+	}
 	defer records.Close()
 	if records.Next() {
-		var c Content
-		err = records.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256)
-		return c, err
+		return i.scanContent(records)
 	}
 
 	return Content{}, NotFound
 }
 
+// GetVersion returns a version of the content, with the metadata of the content
+func (i dbIndex) GetVersion(id string, version int) (Content, error) {
+	records, err := i.db.Query("SELECT "+versionColumns+" FROM content c JOIN content_version v ON v.content_id = c.id WHERE c.id = ? AND v.version = ?", id, version)
+	if err != nil {
+		return Content{}, err
+	}
+	defer records.Close()
+	if records.Next() {
+		return i.scanContent(records)
+	}
+
+	return Content{}, NotFound
+}
+
+// Versions lists the versions of the content, the oldest first
+func (i dbIndex) Versions(id string) func() (Content, error) {
+	return i.iterate(i.db.Query("SELECT "+versionColumns+" FROM content c JOIN content_version v ON v.content_id = c.id WHERE c.id = ? ORDER BY v.version", id))
+}
+
+// scanContent reads the contentColumns of the current row, and unwraps the content key
+func (i dbIndex) scanContent(rows *sql.Rows) (Content, error) {
+	var c Content
+	var title, language, publisher, kekId, tenant sql.NullString
+	var authors, identifiers []byte
+	err := rows.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256, &c.Type, &c.Algorithm,
+		&title, &authors, &language, &publisher, &identifiers, &c.Version, &kekId, &tenant)
+	if err != nil {
+		return c, err
+	}
+	if c.EncryptionKey, err = i.keys.unwrap(c.EncryptionKey, kekId.String); err != nil {
+		return c, err
+	}
+	c.Title, c.Language, c.Publisher, c.Tenant = title.String, language.String, publisher.String, tenant.String
+	if len(authors) > 0 {
+		err = json.Unmarshal(authors, &c.Authors)
+	}
+	if err == nil && len(identifiers) > 0 {
+		err = json.Unmarshal(identifiers, &c.Identifiers)
+	}
+	return c, err
+}
+
+// metadataValues returns the values of the metadata columns of c,
+// the lists of authors and identifiers are stored as json
+func metadataValues(c Content) []interface{} {
+	return []interface{}{c.Title, jsonList(c.Authors), c.Language, c.Publisher, jsonList(c.Identifiers), c.Isbn()}
+}
+
+func jsonList(list []string) interface{} {
+	if len(list) == 0 {
+		return nil
+	}
+	out, _ := json.Marshal(list)
+	return string(out)
+}
+
+// Add indexes a new content, as its first version
 func (i dbIndex) Add(c Content) error {
-	add, err := i.db.Prepare("INSERT INTO content (id,encryption_key,location,length,sha256) VALUES (?, ?, ?, ?, ?)")
+	c.Version = 1
+	tx, err := i.db.Begin()
 	if err != nil {
 		return err
 	}
-	defer add.Close()
-	_, err = add.Exec(c.Id, c.EncryptionKey, c.Location, c.Length, c.Sha256)
+	err = i.insertContent(tx, c)
+	if err == nil {
+		err = i.addVersion(tx, c)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReserveVersion allocates the next version of a content before its publication is stored,
+// so that concurrent versions of a content never share a storage key. The version is then indexed by AddVersion.
+func (i dbIndex) ReserveVersion(id string) (int, error) {
+	for attempt := 1; ; attempt++ {
+		var version int
+		err := i.db.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM (
+		SELECT version FROM content_version WHERE content_id = ?
+		UNION ALL SELECT version FROM content_version_reserved WHERE content_id = ?) v`, id, id).Scan(&version)
+		if err != nil {
+			return 0, err
+		}
+		// the primary key fails the insert if another request reserved the same version meanwhile
+		_, err = i.db.Exec("INSERT INTO content_version_reserved (content_id, version) VALUES (?, ?)", id, version)
+		if err == nil {
+			return version, nil
+		}
+		if attempt == reserveAttempts {
+			return 0, err
+		}
+	}
+}
+
+// AddVersion records c.Version, reserved by ReserveVersion, as a new version of a content.
+// It becomes the latest version of the content unless a later version was indexed first;
+// the content is created with the first version indexed.
+// The previous versions are kept for the licenses issued for them.
+func (i dbIndex) AddVersion(c Content) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = i.addVersion(tx, c)
+	if err == nil {
+		var latest int
+		err = tx.QueryRow("SELECT version FROM content WHERE id = ?", c.Id).Scan(&latest)
+		if err == sql.ErrNoRows {
+			err = i.insertContent(tx, c)
+		} else if err == nil && latest < c.Version {
+			err = i.updateContent(tx, c, "version=?,", c.Version)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM content_version_reserved WHERE content_id=? AND version=?", c.Id, c.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (i dbIndex) insertContent(tx *sql.Tx, c Content) error {
+	key, kekId := i.keys.wrap(c.EncryptionKey)
+	values := []interface{}{c.Id, key, c.Location, c.Length, c.Sha256, contentType(c), algorithm(c)}
+	values = append(values, metadataValues(c)...)
+	_, err := tx.Exec("INSERT INTO content (id,encryption_key,location,length,sha256,type,algorithm,title,authors,language,publisher,identifiers,isbn,version,kek_id,tenant) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		append(values, c.Version, kekId, c.Tenant)...)
 	return err
 }
 
+// Update changes the latest version of the content in place
 func (i dbIndex) Update(c Content) error {
-	add, err := i.db.Prepare("UPDATE content SET encryption_key=? , location=?, length=?,sha256=? WHERE id=?")
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	key, kekId := i.keys.wrap(c.EncryptionKey)
+	_, err = tx.Exec("UPDATE content_version SET encryption_key=?, kek_id=?, location=?, length=?, sha256=?, type=?, algorithm=? WHERE content_id=? AND version=(SELECT version FROM content WHERE id=?)",
+		key, kekId, c.Location, c.Length, c.Sha256, contentType(c), algorithm(c), c.Id, c.Id)
+	if err == nil {
+		err = i.updateContent(tx, c, "")
+	}
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	defer add.Close()
-	_, err = add.Exec(c.EncryptionKey, c.Location, c.Length, c.Sha256, c.Id)
+	return tx.Commit()
+}
+
+// updateContent updates the content row with c, and the extra assignments set
+func (i dbIndex) updateContent(tx *sql.Tx, c Content, set string, args ...interface{}) error {
+	key, kekId := i.keys.wrap(c.EncryptionKey)
+	values := append(args, key, kekId, c.Location, c.Length, c.Sha256, contentType(c), algorithm(c))
+	values = append(values, metadataValues(c)...)
+	_, err := tx.Exec("UPDATE content SET "+set+"encryption_key=? , kek_id=?, location=?, length=?,sha256=?,type=?,algorithm=?,title=?,authors=?,language=?,publisher=?,identifiers=?,isbn=? WHERE id=?",
+		append(values, c.Id)...)
 	return err
 }
 
+func (i dbIndex) addVersion(tx *sql.Tx, c Content) error {
+	key, kekId := i.keys.wrap(c.EncryptionKey)
+	_, err := tx.Exec("INSERT INTO content_version (content_id,version,encryption_key,kek_id,location,length,sha256,type,algorithm) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		c.Id, c.Version, key, kekId, c.Location, c.Length, c.Sha256, contentType(c), algorithm(c))
+	return err
+}
+
+// Delete removes the content and all its versions
+func (i dbIndex) Delete(id string) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM content WHERE id=?", id)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM content_version WHERE content_id=?", id)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM content_version_reserved WHERE content_id=?", id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return NotFound
+	}
+	return tx.Commit()
+}
+
+// RewrapKeys wraps with the current master key the content keys wrapped with another master key, or not wrapped.
+// Each key is updated on its own, only if it was not changed meanwhile, so that the index stays in use
+// during a rotation: the previous master keys must stay in the key ring until RewrapKeys is done.
+// It returns the number of versions of contents whose key was re-wrapped.
+func (i dbIndex) RewrapKeys() (int, error) {
+	if i.keys == nil {
+		return 0, ErrUnknownMasterKey
+	}
+	// the content table holds a copy of the key of the latest version
+	if _, err := i.rewrapTable("content"); err != nil {
+		return 0, err
+	}
+	return i.rewrapTable("content_version")
+}
+
+// rewrapTable re-wraps the content keys of a table, content or content_version
+func (i dbIndex) rewrapTable(table string) (int, error) {
+	id, version := "id", "version"
+	if table == "content_version" {
+		id = "content_id"
+	}
+	rows, err := i.db.Query("SELECT "+id+","+version+",encryption_key,kek_id FROM "+table+" WHERE kek_id IS NULL OR kek_id <> ?", i.keys.current)
+	if err != nil {
+		return 0, err
+	}
+	type wrappedKey struct {
+		id      string
+		version int
+		key     []byte
+		kekId   sql.NullString
+	}
+	var keys []wrappedKey
+	for rows.Next() {
+		var k wrappedKey
+		if err = rows.Scan(&k.id, &k.version, &k.key, &k.kekId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	count := 0
+	for _, k := range keys {
+		key, err := i.keys.unwrap(k.key, k.kekId.String)
+		if err != nil {
+			return count, err
+		}
+		wrapped, kekId := i.keys.wrap(key)
+		result, err := i.db.Exec("UPDATE "+table+" SET encryption_key=?, kek_id=? WHERE "+id+"=? AND "+version+"=? AND encryption_key=?",
+			wrapped, kekId, k.id, k.version, k.key)
+		if err != nil {
+			return count, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// contentType returns the content type of c, EPUB if none is set
+func contentType(c Content) string {
+	if c.Type == "" {
+		return epub.ContentType_EPUB
+	}
+	return c.Type
+}
+
+// algorithm returns the encryption algorithm of the resources of c, CBC if none is set
+func algorithm(c Content) string {
+	if c.Algorithm == "" {
+		return crypto.ALGORITHM_AES_CBC
+	}
+	return c.Algorithm
+}
+
 func (i dbIndex) List() func() (Content, error) {
-	rows, err := i.list.Query()
+	return i.iterate(i.list.Query())
+}
+
+// Search lists the content of a tenant whose title contains title, ignoring case, and with the given isbn.
+// An empty parameter is not used as a filter.
+func (i dbIndex) Search(tenant string, title string, isbn string) func() (Content, error) {
+	query := "SELECT " + contentColumns + " FROM content WHERE 1=1"
+	var args []interface{}
+	if tenant != "" {
+		query += " AND tenant = ?"
+		args = append(args, tenant)
+	}
+	if title != "" {
+		query += " AND LOWER(title) LIKE ?"
+		args = append(args, "%"+strings.ToLower(title)+"%")
+	}
+	if isbn != "" {
+		query += " AND isbn = ?"
+		args = append(args, NormalizeIsbn(isbn))
+	}
+	return i.iterate(i.db.Query(query, args...))
+}
+
+func (i dbIndex) iterate(rows *sql.Rows, err error) func() (Content, error) {
 	if err != nil {
 		return func() (Content, error) { return Content{}, err }
 	}
@@ -95,34 +472,134 @@ func (i dbIndex) List() func() (Content, error) {
 		var c Content
 		var err error
 		if rows.Next() {
-			err = rows.Scan(&c.Id, &c.EncryptionKey, &c.Location, &c.Length, &c.Sha256)
-		} else {
-			rows.Close()
+			c, err = i.scanContent(rows)
+		} else if err = rows.Err(); err == nil {
 			err = NotFound
 		}
+		if err != nil {
+			rows.Close()
+		}
 		return c, err
 	}
 }
 
+// addColumn adds a column missing from a content table created by an older version
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	if _, err := db.Exec("SELECT " + column + " FROM " + table + " LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// Open opens an index which stores the content keys as they are
 func Open(db *sql.DB) (i Index, err error) {
+	return OpenWithKeys(db, nil)
+}
+
+// OpenWithKeys opens an index which stores the content keys wrapped with the master keys of the key ring.
+// The content keys stored before a key ring was used are read as they are, until they are re-wrapped.
+func OpenWithKeys(db *sql.DB, keys *KeyRing) (i Index, err error) {
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS content (
 	id varchar(255) PRIMARY KEY, 
 	encryption_key varchar(64) NOT NULL, 
 	location text NOT NULL, 
 	length bigint,
 	sha256 varchar(64),
+	type varchar(255) NOT NULL DEFAULT 'application/epub+zip',
+	algorithm varchar(255) NOT NULL DEFAULT 'http://www.w3.org/2001/04/xmlenc#aes256-cbc',
+	title varchar(255) DEFAULT NULL,
+	authors text DEFAULT NULL,
+	language varchar(64) DEFAULT NULL,
+	publisher varchar(255) DEFAULT NULL,
+	identifiers text DEFAULT NULL,
+	isbn varchar(13) DEFAULT NULL,
+	version int NOT NULL DEFAULT 1,
+	kek_id varchar(64) DEFAULT NULL,
+	tenant varchar(255) DEFAULT NULL,
 	FOREIGN KEY(id) REFERENCES license(content_fk))`)
 	if err != nil {
 		return
 	}
-	get, err := db.Prepare("SELECT id,encryption_key,location,length,sha256 FROM content WHERE id = ? LIMIT 1")
+	// content indexed before the type and algorithm were recorded is EPUB encrypted with CBC
+	err = addColumn(db, "content", "type", "varchar(255) NOT NULL DEFAULT 'application/epub+zip'")
+	if err != nil {
+		return
+	}
+	err = addColumn(db, "content", "algorithm", "varchar(255) NOT NULL DEFAULT 'http://www.w3.org/2001/04/xmlenc#aes256-cbc'")
+	if err != nil {
+		return
+	}
+	// the publication metadata is unknown for content indexed before it was recorded
+	metadataColumns := [][2]string{
+		{"title", "varchar(255) DEFAULT NULL"},
+		{"authors", "text DEFAULT NULL"},
+		{"language", "varchar(64) DEFAULT NULL"},
+		{"publisher", "varchar(255) DEFAULT NULL"},
+		{"identifiers", "text DEFAULT NULL"},
+		{"isbn", "varchar(13) DEFAULT NULL"},
+	}
+	for _, column := range metadataColumns {
+		err = addColumn(db, "content", column[0], column[1])
+		if err != nil {
+			return
+		}
+	}
+	// content indexed before versions were recorded has a single version
+	err = addColumn(db, "content", "version", "int NOT NULL DEFAULT 1")
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS content_version (
+	content_id varchar(255) NOT NULL,
+	version int NOT NULL,
+	encryption_key varchar(64) NOT NULL,
+	location text NOT NULL,
+	length bigint,
+	sha256 varchar(64),
+	type varchar(255) NOT NULL,
+	algorithm varchar(255) NOT NULL,
+	kek_id varchar(64) DEFAULT NULL,
+	PRIMARY KEY (content_id, version))`)
+	if err != nil {
+		return
+	}
+	// versions allocated to publications being stored, before they are indexed
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS content_version_reserved (
+	content_id varchar(255) NOT NULL,
+	version int NOT NULL,
+	PRIMARY KEY (content_id, version))`)
+	if err != nil {
+		return
+	}
+	// the content keys stored before they were wrapped have no master key
+	err = addColumn(db, "content", "kek_id", "varchar(64) DEFAULT NULL")
+	if err != nil {
+		return
+	}
+	err = addColumn(db, "content_version", "kek_id", "varchar(64) DEFAULT NULL")
+	if err != nil {
+		return
+	}
+	// content indexed before tenants were configured belongs to the default tenant
+	err = addColumn(db, "content", "tenant", "varchar(255) DEFAULT NULL")
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`INSERT INTO content_version (content_id,version,encryption_key,kek_id,location,length,sha256,type,algorithm)
+	SELECT id,version,encryption_key,kek_id,location,length,sha256,type,algorithm FROM content
+	WHERE id NOT IN (SELECT content_id FROM content_version)`)
+	if err != nil {
+		return
+	}
+	get, err := db.Prepare("SELECT " + contentColumns + " FROM content WHERE id = ? LIMIT 1")
 	if err != nil {
 		return
 	}
-	list, err := db.Prepare("SELECT id,encryption_key,location,length,sha256 FROM content")
+	list, err := db.Prepare("SELECT " + contentColumns + " FROM content")
 	if err != nil {
 		return
 	}
-	i = dbIndex{db, get, nil, list}
+	i = dbIndex{db, get, nil, list, keys}
 	return
 }
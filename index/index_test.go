@@ -26,6 +26,7 @@
 package index
 
 import (
+	"bytes"
 	"database/sql"
 	"testing"
 
@@ -41,7 +42,7 @@ func TestIndexCreation(t *testing.T) {
 		t.FailNow()
 	}
 
-	c := Content{"test", []byte("1234"), "test.epub"}
+	c := Content{Id: "test", EncryptionKey: []byte("1234"), Location: "test.epub"}
 	err = idx.Add(c)
 	if err != nil {
 		t.Error(err)
@@ -51,3 +52,259 @@ func TestIndexCreation(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestIndexSearch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	idx, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moby := Content{Id: "moby", EncryptionKey: []byte("1234"), Location: "moby.epub"}
+	moby.Metadata = Metadata{Title: "Moby-Dick", Authors: []string{"Herman Melville"}, Identifiers: []string{"urn:isbn:978-0-316-00000-0"}}
+	other := Content{Id: "other", EncryptionKey: []byte("5678"), Location: "other.epub", Tenant: "alpha"}
+	other.Metadata = Metadata{Title: "Another Book"}
+	for _, c := range []Content{moby, other} {
+		if err = idx.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := idx.Get("moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Title != "Moby-Dick" || len(c.Authors) != 1 || c.Authors[0] != "Herman Melville" {
+		t.Errorf("Unexpected metadata %v", c.Metadata)
+	}
+
+	found := func(fn func() (Content, error)) []string {
+		var ids []string
+		for c, err := fn(); err == nil; c, err = fn() {
+			ids = append(ids, c.Id)
+		}
+		return ids
+	}
+	if ids := found(idx.Search("", "moby", "")); len(ids) != 1 || ids[0] != "moby" {
+		t.Errorf("Expected moby when searching by title, got %v", ids)
+	}
+	if ids := found(idx.Search("", "", "9780316000000")); len(ids) != 1 || ids[0] != "moby" {
+		t.Errorf("Expected moby when searching by isbn, got %v", ids)
+	}
+	if ids := found(idx.Search("", "", "")); len(ids) != 2 {
+		t.Errorf("Expected all the content without filter, got %v", ids)
+	}
+	if ids := found(idx.Search("alpha", "", "")); len(ids) != 1 || ids[0] != "other" {
+		t.Errorf("Expected the content of the tenant, got %v", ids)
+	}
+	if c, _ = idx.Get("other"); c.Tenant != "alpha" {
+		t.Errorf("Expected the tenant of the content, got %q", c.Tenant)
+	}
+}
+
+func TestIndexDelete(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	idx, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = idx.Add(Content{Id: "test", EncryptionKey: []byte("1234"), Location: "test.epub"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.Delete("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = idx.Get("test"); err != NotFound {
+		t.Errorf("Expected the content to be deleted, got %v", err)
+	}
+	if err = idx.Delete("test"); err != NotFound {
+		t.Errorf("Expected NotFound when deleting twice, got %v", err)
+	}
+}
+
+func TestIndexVersions(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	idx, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Content{Id: "test", EncryptionKey: []byte("1234"), Location: "test.epub", Sha256: "first"}
+	c.Title = "Test"
+	if err = idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.StorageKey() != "test" {
+		t.Errorf("Expected the first version to be stored under the content id, got %s", c.StorageKey())
+	}
+
+	c.Version, c.EncryptionKey, c.Sha256 = 2, []byte("5678"), "second"
+	if err = idx.AddVersion(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.StorageKey() != "test.v2" {
+		t.Errorf("Expected the second version to be stored under test.v2, got %s", c.StorageKey())
+	}
+	if id, version := ParseStorageKey(c.StorageKey()); id != "test" || version != 2 {
+		t.Errorf("Expected test.v2 to be the second version of test, got %s %d", id, version)
+	}
+	if id, version := ParseStorageKey("test"); id != "test" || version != 1 {
+		t.Errorf("Expected test to be the first version of test, got %s %d", id, version)
+	}
+
+	latest, err := idx.Get("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version != 2 || latest.Sha256 != "second" {
+		t.Errorf("Expected the second version to be the latest, got %d (%s)", latest.Version, latest.Sha256)
+	}
+	first, err := idx.GetVersion("test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.EncryptionKey) != "1234" || first.Sha256 != "first" || first.Title != "Test" {
+		t.Errorf("Unexpected first version %v", first)
+	}
+
+	fn := idx.Versions("test")
+	var versions []int
+	for v, err := fn(); err == nil; v, err = fn() {
+		versions = append(versions, v.Version)
+	}
+	if len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+		t.Errorf("Expected versions 1 and 2, got %v", versions)
+	}
+}
+
+func TestIndexKeyRotation(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	contentKey := bytes.Repeat([]byte{0x42}, 32)
+
+	// a key stored in the clear before master keys were configured
+	plain, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = plain.Add(Content{Id: "old", EncryptionKey: contentKey, Location: "old.epub"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := NewKeyRing("first", map[string][]byte{"first": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := OpenWithKeys(db, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = idx.Add(Content{Id: "new", EncryptionKey: contentKey, Location: "new.epub"}); err != nil {
+		t.Fatal(err)
+	}
+	var stored []byte
+	if err = db.QueryRow("SELECT encryption_key FROM content_version WHERE content_id = 'new'").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(stored, contentKey) {
+		t.Error("Expected the content key to be wrapped in the database")
+	}
+	for _, id := range []string{"old", "new"} {
+		if c, err := idx.Get(id); err != nil || !bytes.Equal(c.EncryptionKey, contentKey) {
+			t.Errorf("Expected the content key of %s, got %x (%v)", id, c.EncryptionKey, err)
+		}
+	}
+
+	// rotation: the previous master key stays until all keys are re-wrapped
+	second, err := NewKeyRing("second", map[string][]byte{"first": bytes.Repeat([]byte{1}, 32), "second": bytes.Repeat([]byte{2}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = OpenWithKeys(db, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := idx.RewrapKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 re-wrapped keys, got %d", count)
+	}
+
+	last, _ := NewKeyRing("second", map[string][]byte{"second": bytes.Repeat([]byte{2}, 32)})
+	idx, err = OpenWithKeys(db, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"old", "new"} {
+		c, err := idx.GetVersion(id, 1)
+		if err != nil || !bytes.Equal(c.EncryptionKey, contentKey) {
+			t.Errorf("Expected the content key of %s with the new master key, got %x (%v)", id, c.EncryptionKey, err)
+		}
+	}
+	if count, _ = idx.RewrapKeys(); count != 0 {
+		t.Errorf("Expected no key to re-wrap, got %d", count)
+	}
+
+	if _, err = NewKeyRing("missing", map[string][]byte{"second": bytes.Repeat([]byte{2}, 32)}); err != ErrUnknownMasterKey {
+		t.Error("Expected a key ring without its current key to be refused")
+	}
+}
+
+func TestCheckId(t *testing.T) {
+	for _, id := range []string{"test", "9782070360024", "urn:uuid:1234", "v2", "test.v", "test.covers"} {
+		if err := CheckId(id); err != nil {
+			t.Errorf("Expected %q to be accepted, got %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "../test", "dir/test", `dir\test`, "test..", "test.v2", "test.cover", "test.cover.120"} {
+		if err := CheckId(id); err != ErrInvalidId {
+			t.Errorf("Expected %q to be rejected, got %v", id, err)
+		}
+	}
+}
+
+// TestIndexReserveVersion indexes two versions reserved at once, the later one first
+func TestIndexReserveVersion(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	idx, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := idx.ReserveVersion("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := idx.ReserveVersion("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 || second != 2 {
+		t.Fatalf("Expected versions 1 and 2, got %d and %d", first, second)
+	}
+
+	c := Content{Id: "test", EncryptionKey: []byte("5678"), Location: "test.epub", Sha256: "second", Version: second}
+	if err = idx.AddVersion(c); err != nil {
+		t.Fatal(err)
+	}
+	c.Version, c.EncryptionKey, c.Sha256 = first, []byte("1234"), "first"
+	if err = idx.AddVersion(c); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := idx.Get("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Version != 2 || latest.Sha256 != "second" {
+		t.Errorf("Expected the second version to be the latest, got %d (%s)", latest.Version, latest.Sha256)
+	}
+	if next, err := idx.ReserveVersion("test"); err != nil || next != 3 {
+		t.Errorf("Expected version 3, got %d (%v)", next, err)
+	}
+}
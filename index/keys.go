@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package index
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/crypto"
+)
+
+var ErrUnknownMasterKey = errors.New("Unknown master key")
+
+// KeyRing holds the master keys (key-encryption keys) which wrap the content keys at rest.
+// New content keys are wrapped with the current master key; the other keys unwrap
+// the content keys which have not been re-wrapped yet.
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing checks that the master keys are AES keys and that the current key is one of them
+func NewKeyRing(current string, keys map[string][]byte) (*KeyRing, error) {
+	for id, key := range keys {
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, errors.New("The master key " + id + " is not a 128, 192 or 256 bit key")
+		}
+	}
+	if _, present := keys[current]; !present {
+		return nil, ErrUnknownMasterKey
+	}
+	return &KeyRing{current: current, keys: keys}, nil
+}
+
+// LoadKeyRing reads the master keys of the configuration, it returns nil if none is configured
+func LoadKeyRing(conf config.ContentKeys) (*KeyRing, error) {
+	if conf.Current == "" && len(conf.Keys) == 0 {
+		return nil, nil
+	}
+	keys := make(map[string][]byte)
+	for _, k := range conf.Keys {
+		value := os.Getenv(k.Env)
+		if k.File != "" {
+			data, err := ioutil.ReadFile(k.File)
+			if err != nil {
+				return nil, err
+			}
+			value = string(data)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(key) == 0 {
+			return nil, errors.New("The master key " + k.Id + " must be hex encoded in its file or environment variable")
+		}
+		keys[k.Id] = key
+	}
+	return NewKeyRing(conf.Current, keys)
+}
+
+// wrap returns the content key wrapped with the current master key, and the id of this key.
+// Without a key ring, the content key is stored as is, with no id.
+func (k *KeyRing) wrap(key []byte) ([]byte, interface{}) {
+	if k == nil {
+		return key, nil
+	}
+	return crypto.KeyWrap(k.keys[k.current], key), k.current
+}
+
+// unwrap returns the content key wrapped with the master key id, a content key with no id is not wrapped
+func (k *KeyRing) unwrap(wrapped []byte, id string) ([]byte, error) {
+	if id == "" {
+		return wrapped, nil
+	}
+	if k == nil {
+		return nil, ErrUnknownMasterKey
+	}
+	kek, present := k.keys[id]
+	if !present {
+		return nil, ErrUnknownMasterKey
+	}
+	return crypto.KeyUnwrap(kek, wrapped)
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package integrity compares the store of protected publications with the content index
+package integrity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+// actions on the orphaned items of the store
+const (
+	ORPHANS_REPORT     = "report"
+	ORPHANS_QUARANTINE = "quarantine"
+	ORPHANS_DELETE     = "delete"
+)
+
+// QUARANTINE_PREFIX is prepended to the key of a quarantined item, which is then ignored by the scans
+const QUARANTINE_PREFIX = "quarantine."
+
+// DEFAULT_MIN_AGE is the default age under which an unindexed item is not an orphan yet:
+// a publication is stored before its content is added to the index
+const DEFAULT_MIN_AGE = 24 * time.Hour
+
+var ErrOrphansAction = errors.New("Unknown action on orphans, must be report, quarantine or delete")
+
+// Options of a scan
+type Options struct {
+	Orphans   string        // action on the orphaned items, ORPHANS_REPORT by default
+	Checksums bool          // read every item to check its checksum, and not only its size
+	MinAge    time.Duration // unindexed items modified more recently are not orphans yet
+}
+
+// Problem is a version of a content whose protected publication is missing or corrupted
+type Problem struct {
+	ContentId string `json:"content_id"`
+	Version   int    `json:"version"`
+	Key       string `json:"key"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Report lists the problems found by a scan
+type Report struct {
+	Items       int       `json:"items"`
+	Contents    int       `json:"contents"`
+	Missing     []Problem `json:"missing"`
+	Corrupted   []Problem `json:"corrupted"`
+	Orphans     []string  `json:"orphans"`
+	Recent      []string  `json:"recent,omitempty"`
+	Quarantined []string  `json:"quarantined,omitempty"`
+	Deleted     []string  `json:"deleted,omitempty"`
+}
+
+// CheckOrphansAction returns an error if the action on orphans is unknown; an empty action is a report
+func CheckOrphansAction(action string) error {
+	switch action {
+	case "", ORPHANS_REPORT, ORPHANS_QUARANTINE, ORPHANS_DELETE:
+		return nil
+	}
+	return ErrOrphansAction
+}
+
+// Scan walks the store and the index. It reports the versions of contents which are missing from the store
+// or whose stored item does not match their length or checksum, and the items of the store which belong to
+// no content: orphans are reported, quarantined or deleted. Unindexed items younger than options.MinAge
+// are only listed as recent. An error reading the index stops the scan before any orphan is touched.
+func Scan(st storage.Store, idx index.Index, options Options) (Report, error) {
+	report := Report{Missing: []Problem{}, Corrupted: []Problem{}, Orphans: []string{}}
+	if err := CheckOrphansAction(options.Orphans); err != nil {
+		return report, err
+	}
+
+	items, err := st.List()
+	if err != nil {
+		return report, err
+	}
+	stored := make(map[string]storage.Item)
+	for _, item := range items {
+		if !strings.HasPrefix(item.Key(), QUARANTINE_PREFIX) {
+			stored[item.Key()] = item
+		}
+	}
+	report.Items = len(stored)
+
+	// the storage keys of all versions, and the ids which may own a cover
+	known := make(map[string]bool)
+	ids := make(map[string]bool)
+	fn := idx.List()
+	var contents []index.Content
+	c, err := fn()
+	for ; err == nil; c, err = fn() {
+		contents = append(contents, c)
+	}
+	if err != index.NotFound {
+		return report, err
+	}
+	report.Contents = len(contents)
+	for _, c := range contents {
+		ids[c.Id] = true
+		versions := idx.Versions(c.Id)
+		v, err := versions()
+		for ; err == nil; v, err = versions() {
+			known[v.StorageKey()] = true
+			item, present := stored[v.StorageKey()]
+			if !present {
+				report.Missing = append(report.Missing, Problem{ContentId: v.Id, Version: v.Version, Key: v.StorageKey()})
+				continue
+			}
+			reason, err := check(item, v, options.Checksums)
+			if err != nil {
+				return report, err
+			}
+			if reason != "" {
+				report.Corrupted = append(report.Corrupted, Problem{ContentId: v.Id, Version: v.Version, Key: v.StorageKey(), Reason: reason})
+			}
+		}
+		if err != index.NotFound {
+			return report, err
+		}
+	}
+
+	for _, item := range items {
+		key := item.Key()
+		if _, present := stored[key]; !present || known[key] || ids[coverOwner(key)] {
+			continue
+		}
+		info, err := item.Stat()
+		if err != nil {
+			return report, err
+		}
+		if time.Since(info.ModTime) < options.MinAge {
+			report.Recent = append(report.Recent, key)
+			continue
+		}
+		report.Orphans = append(report.Orphans, key)
+		switch options.Orphans {
+		case ORPHANS_QUARANTINE:
+			if err = quarantine(st, item); err != nil {
+				return report, err
+			}
+			report.Quarantined = append(report.Quarantined, key)
+		case ORPHANS_DELETE:
+			if err = st.Remove(key); err != nil {
+				return report, err
+			}
+			report.Deleted = append(report.Deleted, key)
+		}
+	}
+	return report, nil
+}
+
+// check returns why a stored item does not match its version of the content, or an empty string
+func check(item storage.Item, c index.Content, checksum bool) (string, error) {
+	info, err := item.Stat()
+	if err != nil {
+		return "", err
+	}
+	if c.Length > 0 && info.Size != c.Length {
+		return "length " + strconv.FormatInt(info.Size, 10) + ", expected " + strconv.FormatInt(c.Length, 10), nil
+	}
+	if !checksum || c.Sha256 == "" {
+		return "", nil
+	}
+	contents, err := item.Contents()
+	if err != nil {
+		return "", err
+	}
+	defer contents.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, contents); err != nil {
+		return "", err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(sum, c.Sha256) {
+		return "sha256 " + sum + ", expected " + c.Sha256, nil
+	}
+	return "", nil
+}
+
+// coverOwner returns the id of the content whose cover or thumbnail is stored under key, if key is one
+func coverOwner(key string) string {
+	i := strings.LastIndex(key, pack.CoverKey(""))
+	if i <= 0 {
+		return ""
+	}
+	id, width := key[:i], key[i+len(pack.CoverKey("")):]
+	if width == "" {
+		return id
+	}
+	if w, err := strconv.Atoi(strings.TrimPrefix(width, ".")); err == nil && key == pack.ThumbnailKey(id, w) {
+		return id
+	}
+	return ""
+}
+
+// quarantine moves an item under the quarantine prefix of the store
+func quarantine(st storage.Store, item storage.Item) error {
+	reader, size, err := item.ReaderAt()
+	if err != nil {
+		return err
+	}
+	_, err = st.Add(QUARANTINE_PREFIX+item.Key(), io.NewSectionReader(reader, 0, size))
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	return st.Remove(item.Key())
+}
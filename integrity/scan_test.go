@@ -0,0 +1,183 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package integrity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/storage"
+)
+
+func TestScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := storage.NewFileSystem(dir, "http://localhost/files")
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("first"))
+	c := index.Content{Id: "book", EncryptionKey: []byte("1234"), Location: "book.epub", Length: 5, Sha256: hex.EncodeToString(sum[:])}
+	if err = idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	c.Version, c.Length = 2, 6
+	if err = idx.AddVersion(c); err != nil {
+		t.Fatal(err)
+	}
+	missing := index.Content{Id: "missing", EncryptionKey: []byte("1234"), Location: "missing.epub"}
+	if err = idx.Add(missing); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first version matches, the second has the length but not the checksum
+	for key, contents := range map[string]string{
+		"book":                         "first",
+		"book.v2":                      "second",
+		pack.CoverKey("book"):          "cover",
+		pack.ThumbnailKey("book", 150): "thumbnail",
+		"orphan":                       "orphan",
+		pack.CoverKey("deleted"):       "cover",
+	} {
+		if _, err = st.Add(key, bytes.NewReader([]byte(contents))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Scan(st, idx, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Items != 6 || report.Contents != 2 {
+		t.Errorf("Expected 6 items and 2 contents, got %d and %d", report.Items, report.Contents)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Key != "missing" {
+		t.Errorf("Expected the content missing to be missing, got %v", report.Missing)
+	}
+	if len(report.Corrupted) != 0 {
+		t.Errorf("Expected no corrupted item without checksums, got %v", report.Corrupted)
+	}
+	if len(report.Orphans) != 2 {
+		t.Errorf("Expected 2 orphans, got %v", report.Orphans)
+	}
+
+	report, err = Scan(st, idx, Options{Orphans: ORPHANS_QUARANTINE, Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0].Key != "book.v2" {
+		t.Errorf("Expected the second version to be corrupted, got %v", report.Corrupted)
+	}
+	if len(report.Quarantined) != 2 {
+		t.Errorf("Expected 2 quarantined items, got %v", report.Quarantined)
+	}
+	if _, err = st.Get(QUARANTINE_PREFIX + "orphan"); err != nil {
+		t.Error("Expected the orphan to be quarantined")
+	}
+
+	report, err = Scan(st, idx, Options{Orphans: ORPHANS_DELETE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 || report.Items != 4 {
+		t.Errorf("Expected quarantined items to be ignored, got %v in %d items", report.Orphans, report.Items)
+	}
+
+	if _, err = Scan(st, idx, Options{Orphans: "burn"}); err != ErrOrphansAction {
+		t.Errorf("Expected an unknown action to be refused, got %v", err)
+	}
+}
+
+// failingIndex is an index whose contents can not be listed
+type failingIndex struct {
+	index.Index
+}
+
+func (failingIndex) List() func() (index.Content, error) {
+	return func() (index.Content, error) { return index.Content{}, errors.New("database is locked") }
+}
+
+func TestScanOrphansSafety(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcp_integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st := storage.NewFileSystem(dir, "http://localhost/files")
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.Add("book", bytes.NewReader([]byte("book"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// an item stored by a job which has not indexed it yet
+	report, err := Scan(st, idx, Options{Orphans: ORPHANS_DELETE, MinAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 || len(report.Recent) != 1 {
+		t.Errorf("Expected a recent item, got %v orphans and %v recent items", report.Orphans, report.Recent)
+	}
+	if _, err = st.Get("book"); err != nil {
+		t.Error("Expected a recent item to be kept")
+	}
+
+	// an incomplete listing of the index must not make every item an orphan
+	if _, err = Scan(st, failingIndex{idx}, Options{Orphans: ORPHANS_DELETE}); err == nil {
+		t.Error("Expected the index error to be returned")
+	}
+	if _, err = st.Get("book"); err != nil {
+		t.Error("Expected no item to be deleted when the index can not be read")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package jobs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var NotFound = errors.New("Job not found")
+
+const (
+	STATUS_QUEUED  = "queued"
+	STATUS_RUNNING = "running"
+	STATUS_FAILED  = "failed"
+	STATUS_DONE    = "done"
+)
+
+type Jobs interface {
+	Get(id int64) (Job, error)
+	Add(j Job) (Job, error)
+	Update(j Job) error
+	Next() (Job, error)
+	Requeue() error
+}
+
+// Job is a packaging request, persisted until the publication is encrypted and stored
+type Job struct {
+	Id         int64           `json:"id"`
+	ContentId  string          `json:"content_id"`
+	Name       string          `json:"name"`
+	Encryption string          `json:"encryption,omitempty"` // CBC or GCM, the server setting applies if empty
+	Tenant     string          `json:"tenant,omitempty"`     // tenant which the content is packaged for
+	Input      string          `json:"-"`
+	Status     string          `json:"status"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error,omitempty"`
+	Validation json.RawMessage `json:"validation,omitempty"` // validation report of the publication
+	Created    time.Time       `json:"created"`
+	Updated    *time.Time      `json:"updated,omitempty"`
+}
+
+type dbJobs struct {
+	db    *sql.DB
+	get   *sql.Stmt
+	next  *sql.Stmt
+	claim *sql.Stmt
+}
+
+//Get returns a job if it exists in table 'job'
+func (i dbJobs) Get(id int64) (Job, error) {
+	var j Job
+	var validation []byte
+	var tenant sql.NullString
+	row := i.get.QueryRow(id)
+	err := row.Scan(&j.Id, &j.ContentId, &j.Name, &j.Encryption, &tenant, &j.Input, &j.Status, &j.Attempts, &j.Error, &validation, &j.Created, &j.Updated)
+	j.Validation, j.Tenant = validation, tenant.String
+	if err == sql.ErrNoRows {
+		return j, NotFound
+	}
+	return j, err
+}
+
+//Add stores a new job in the 'queued' state and returns it with its id
+func (i dbJobs) Add(j Job) (Job, error) {
+	j.Status = STATUS_QUEUED
+	j.Attempts = 0
+	j.Created = time.Now()
+	result, err := i.db.Exec(`INSERT INTO job (content_id, name, encryption, tenant, input, status, attempts, error, created)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, j.ContentId, j.Name, j.Encryption, j.Tenant, j.Input, j.Status, j.Attempts, j.Error, j.Created)
+	if err != nil {
+		return j, err
+	}
+	j.Id, err = result.LastInsertId()
+	return j, err
+}
+
+//Update saves the status, attempts, error and validation report of a job
+func (i dbJobs) Update(j Job) error {
+	result, err := i.db.Exec("UPDATE job SET status=?, attempts=?, error=?, validation=?, updated=? WHERE id=?",
+		j.Status, j.Attempts, j.Error, []byte(j.Validation), time.Now(), j.Id)
+	if err == nil {
+		if r, _ := result.RowsAffected(); r == 0 {
+			return NotFound
+		}
+	}
+	return err
+}
+
+//Next claims the oldest queued job and marks it as running
+//it returns NotFound if no job is waiting
+func (i dbJobs) Next() (Job, error) {
+	for {
+		var id int64
+		err := i.next.QueryRow(STATUS_QUEUED).Scan(&id)
+		if err == sql.ErrNoRows {
+			return Job{}, NotFound
+		}
+		if err != nil {
+			return Job{}, err
+		}
+		result, err := i.claim.Exec(STATUS_RUNNING, time.Now(), id, STATUS_QUEUED)
+		if err != nil {
+			return Job{}, err
+		}
+		// another worker may have claimed the job in the meantime
+		if r, _ := result.RowsAffected(); r == 1 {
+			return i.Get(id)
+		}
+	}
+}
+
+//Requeue puts back in the queue the jobs left running, e.g. by a server restart
+func (i dbJobs) Requeue() error {
+	_, err := i.db.Exec("UPDATE job SET status=?, updated=? WHERE status=?", STATUS_QUEUED, time.Now(), STATUS_RUNNING)
+	return err
+}
+
+//Open defines scripts for queries & create table 'job' if not exist
+func Open(db *sql.DB) (j Jobs, err error) {
+	_, err = db.Exec(tableDef)
+	if err != nil {
+		return
+	}
+	// jobs queued before tenants were configured package content for the default tenant
+	if _, err = db.Exec("SELECT tenant FROM job LIMIT 1"); err != nil {
+		_, err = db.Exec("ALTER TABLE job ADD COLUMN tenant varchar(255) DEFAULT NULL")
+		if err != nil {
+			return
+		}
+	}
+	get, err := db.Prepare(`SELECT id, content_id, name, encryption, tenant, input, status, attempts, error, validation, created, updated
+	FROM job WHERE id = ? LIMIT 1`)
+	if err != nil {
+		return
+	}
+	next, err := db.Prepare("SELECT id FROM job WHERE status = ? ORDER BY id LIMIT 1")
+	if err != nil {
+		return
+	}
+	claim, err := db.Prepare("UPDATE job SET status=?, updated=? WHERE id=? AND status=?")
+	if err != nil {
+		return
+	}
+	j = dbJobs{db, get, next, claim}
+	return
+}
+
+const tableDef = `CREATE TABLE IF NOT EXISTS job (
+	id INTEGER PRIMARY KEY,
+	content_id varchar(255) NOT NULL,
+	name varchar(255) NOT NULL,
+	encryption varchar(32) NOT NULL DEFAULT '',
+	tenant varchar(255) DEFAULT NULL,
+	input text NOT NULL,
+	status varchar(32) NOT NULL,
+	attempts int NOT NULL DEFAULT 0,
+	error text NOT NULL,
+	validation text DEFAULT NULL,
+	created datetime NOT NULL,
+	updated datetime DEFAULT NULL
+);
+CREATE INDEX IF NOT EXISTS job_status_index on job (status);
+`
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package jobs
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//TestJobLifecycle opens database, queues a job and claims it
+func TestJobLifecycle(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	jbs, err := Open(db)
+	if err != nil {
+		t.Error("Can't open jobs")
+		t.Error(err)
+		t.FailNow()
+	}
+
+	j, err := jbs.Add(Job{ContentId: "content", Name: "test.epub", Input: "/tmp/test.epub", Tenant: "alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != STATUS_QUEUED {
+		t.Errorf("Expected status %s, got %s", STATUS_QUEUED, j.Status)
+	}
+
+	running, err := jbs.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.Id != j.Id || running.Status != STATUS_RUNNING || running.Tenant != "alpha" {
+		t.Errorf("Expected job %d to be running, got job %d %s", j.Id, running.Id, running.Status)
+	}
+	if _, err = jbs.Next(); err != NotFound {
+		t.Errorf("Expected no other queued job, got %v", err)
+	}
+
+	err = jbs.Requeue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err = jbs.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running.Status = STATUS_DONE
+	running.Attempts = 1
+	if err = jbs.Update(running); err != nil {
+		t.Fatal(err)
+	}
+	done, err := jbs.Get(j.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Status != STATUS_DONE || done.Attempts != 1 || done.Updated == nil {
+		t.Errorf("Expected job to be done after 1 attempt, got %#v", done)
+	}
+}
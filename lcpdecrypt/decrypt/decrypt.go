@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decrypt
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/xmlenc"
+)
+
+// ContentKeyRetrievalURI identifies the resources encrypted with the LCP content key
+const ContentKeyRetrievalURI = "license.lcpl#/encryption/content_key"
+
+var ErrWrongPassphrase = errors.New("The passphrase does not match the key check of the license")
+
+// UserKey computes the hash of a passphrase, which the encryption profile of a license transforms into its user key
+func UserKey(passphrase string) []byte {
+	hash := sha256.Sum256([]byte(passphrase))
+	return hash[:]
+}
+
+// ReadLicense decodes a license document
+func ReadLicense(r io.Reader) (license.License, error) {
+	var l license.License
+	err := json.NewDecoder(r).Decode(&l)
+	return l, err
+}
+
+// FindLicense returns the license document embedded in a protected epub
+func FindLicense(zr *zip.Reader) (license.License, error) {
+	for _, f := range zr.File {
+		if f.Name == epub.LicenseFile {
+			r, err := f.Open()
+			if err != nil {
+				return license.License{}, err
+			}
+			defer r.Close()
+			return ReadLicense(r)
+		}
+	}
+	return license.License{}, errors.New("No license found in the publication")
+}
+
+// ContentKey derives the user key from the hash of the passphrase with the encryption profile of the license,
+// checks it against the key check of the license, then returns the content key decrypted with the user key
+func ContentKey(l license.License, hash []byte) (crypto.ContentKey, error) {
+	profile, err := license.GetProfile(l.Encryption.Profile)
+	if err != nil {
+		return nil, errors.New("Unsupported encryption profile " + l.Encryption.Profile)
+	}
+	userKey := profile.UserKey(hash)
+	decrypter, err := crypto.NewAESDecrypter(l.Encryption.ContentKey.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	var check bytes.Buffer
+	err = decrypter.Decrypt(userKey, bytes.NewReader(l.Encryption.UserKey.Check), &check)
+	if err != nil || check.String() != l.Id {
+		return nil, ErrWrongPassphrase
+	}
+
+	var key bytes.Buffer
+	err = decrypter.Decrypt(userKey, bytes.NewReader(l.Encryption.ContentKey.Value), &key)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ContentKey(key.Bytes()), nil
+}
+
+// DecryptEpub writes to w a clear copy of the protected epub read from zr:
+// every resource encrypted with the content key is decrypted (and inflated if
+// it was compressed before encryption), the license is removed and the
+// encryption document only keeps the entries not related to LCP, if any
+func DecryptEpub(zr *zip.Reader, key crypto.ContentKey, w io.Writer) error {
+	var manifest xmlenc.Manifest
+	for _, f := range zr.File {
+		if f.Name == epub.EncryptionFile {
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			manifest, err = xmlenc.Read(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	remaining := xmlenc.Manifest{}
+	lcpData := make(map[string]xmlenc.Data)
+	for _, data := range manifest.Data {
+		if data.KeyInfo != nil && data.KeyInfo.RetrievalMethod.URI == ContentKeyRetrievalURI {
+			lcpData[string(data.CipherData.CipherReference.URI)] = data
+		} else {
+			remaining.Data = append(remaining.Data, data)
+		}
+	}
+
+	ew := epub.NewWriter(w)
+	for _, f := range zr.File {
+		if f.Name == epub.EncryptionFile || f.Name == epub.LicenseFile {
+			continue
+		}
+		data, encrypted := lcpData[f.Name]
+		if !encrypted {
+			if err := ew.CopyRaw(f); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := decryptFile(f, data, key, ew); err != nil {
+			return errors.New("Error decrypting " + f.Name + ": " + err.Error())
+		}
+	}
+
+	if len(remaining.Data) > 0 {
+		if err := ew.WriteEncryption(&remaining); err != nil {
+			return err
+		}
+	}
+
+	return ew.Close()
+}
+
+func decryptFile(f *zip.File, data xmlenc.Data, key crypto.ContentKey, w *epub.Writer) error {
+	decrypter, err := crypto.NewAESDecrypter(string(data.Method.Algorithm))
+	if err != nil {
+		return err
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var clear bytes.Buffer
+	if err = decrypter.Decrypt(key, r, &clear); err != nil {
+		return err
+	}
+
+	var contents io.Reader = &clear
+	if isCompressed(data) {
+		inflater := flate.NewReader(&clear)
+		defer inflater.Close()
+		contents = inflater
+	}
+
+	fw, err := w.AddResource(f.Name, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, contents)
+	return err
+}
+
+func isCompressed(data xmlenc.Data) bool {
+	if data.Properties == nil {
+		return false
+	}
+	for _, prop := range data.Properties.Properties {
+		if prop.Compression.Method == 8 {
+			return true
+		}
+	}
+	return false
+}
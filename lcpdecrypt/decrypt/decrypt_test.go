@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decrypt
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/pack"
+)
+
+// protect encrypts the sample epub and embeds a license bound to passphrase
+func protect(t *testing.T, passphrase string) (*zip.Reader, *zip.ReadCloser) {
+	z, err := zip.OpenReader("../../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := epub.Read(&z.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var encrypted bytes.Buffer
+	_, key, err := pack.Do(crypto.NewAESEncrypter_PUBLICATION_RESOURCES(), ep, &encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := license.New()
+	userKey := UserKey(passphrase)
+	encrypter := crypto.NewAESEncrypter_CONTENT_KEY()
+	var value, check bytes.Buffer
+	encrypter.Encrypt(userKey, bytes.NewReader(key), &value)
+	encrypter.Encrypt(userKey, bytes.NewBufferString(l.Id), &check)
+	l.Encryption.ContentKey.Algorithm = encrypter.Signature()
+	l.Encryption.ContentKey.Value = value.Bytes()
+	l.Encryption.UserKey.Check = check.Bytes()
+	lic, _ := json.Marshal(l)
+
+	zr, err := zip.NewReader(bytes.NewReader(encrypted.Bytes()), int64(encrypted.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var protected bytes.Buffer
+	if err = epub.AddLicense(zr, lic, &protected); err != nil {
+		t.Fatal(err)
+	}
+	zr, err = zip.NewReader(bytes.NewReader(protected.Bytes()), int64(protected.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr, z
+}
+
+func TestDecryptEpub(t *testing.T) {
+	zr, source := protect(t, "secret")
+	defer source.Close()
+
+	l, err := FindLicense(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ContentKey(l, UserKey("wrong")); err != ErrWrongPassphrase {
+		t.Errorf("Expected a wrong passphrase error, got %v", err)
+	}
+	key, err := ContentKey(l, UserKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clear bytes.Buffer
+	if err = DecryptEpub(zr, key, &clear); err != nil {
+		t.Fatal(err)
+	}
+	out, err := zip.NewReader(bytes.NewReader(clear.Bytes()), int64(clear.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range out.File {
+		files[f.Name] = f
+	}
+	if _, ok := files[epub.LicenseFile]; ok {
+		t.Error("Did not expect a license in the clear epub")
+	}
+	for _, f := range source.File {
+		clearFile, ok := files[f.Name]
+		if !ok {
+			t.Errorf("Could not find %s in the clear epub", f.Name)
+			continue
+		}
+		expected, _ := readFile(f)
+		got, _ := readFile(clearFile)
+		if !bytes.Equal(expected, got) {
+			t.Errorf("Expected %s to be equal before and after", f.Name)
+		}
+	}
+}
+
+func readFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/lcpdecrypt/decrypt"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+func showHelpAndExit() {
+	log.Println("lcpdecrypt decrypts an lcp protected epub file, given its license and the user passphrase")
+	log.Println("-input        protected epub file")
+	log.Println("[-license]    optional license document (.lcpl); if omitted, the license embedded in the epub is used")
+	log.Println("-passphrase   user passphrase")
+	log.Println("[-output]     optional target location for the clear epub")
+	log.Println("[-help] :     help information")
+	os.Exit(0)
+	return
+}
+
+func exitWithError(message string, err error, errorlevel int) {
+	os.Stderr.WriteString(message)
+	os.Stderr.WriteString("\n")
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Stderr.WriteString("\n")
+	}
+	os.Exit(errorlevel)
+}
+
+func main() {
+	var inputFilename = flag.String("input", "", "protected epub file")
+	var licenseFilename = flag.String("license", "", "optional license document; if omitted, the license embedded in the epub is used")
+	var passphrase = flag.String("passphrase", "", "user passphrase")
+	var outputFilename = flag.String("output", "", "optional target location for the clear epub")
+
+	var help = flag.Bool("help", false, "shows information")
+
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if *help {
+		showHelpAndExit()
+	}
+
+	if *inputFilename == "" || *passphrase == "" {
+		exitWithError("incorrect parameters, input and passphrase are mandatory, for more information type 'lcpdecrypt -help' ", nil, 80)
+	}
+
+	zr, err := zip.OpenReader(*inputFilename)
+	if err != nil {
+		exitWithError("Error opening the epub file", err, 70)
+	}
+	defer zr.Close()
+
+	// read the license, either standalone or embedded in the publication
+	var lic license.License
+	if *licenseFilename != "" {
+		f, err := os.Open(*licenseFilename)
+		if err != nil {
+			exitWithError("Error opening the license file", err, 60)
+		}
+		lic, err = decrypt.ReadLicense(f)
+		f.Close()
+		if err != nil {
+			exitWithError("Error reading the license", err, 60)
+		}
+	} else if lic, err = decrypt.FindLicense(&zr.Reader); err != nil {
+		exitWithError("Error reading the license", err, 60)
+	}
+
+	contentKey, err := decrypt.ContentKey(lic, decrypt.UserKey(*passphrase))
+	if err != nil {
+		exitWithError("Error decrypting the content key", err, 50)
+	}
+
+	if *outputFilename == "" { //output not set -> "<input>.clear.epub" in the working directory
+		workingDir, _ := os.Getwd()
+		base := strings.TrimSuffix(filepath.Base(*inputFilename), filepath.Ext(*inputFilename))
+		*outputFilename = filepath.Join(workingDir, base+".clear.epub")
+	}
+	output, err := os.Create(*outputFilename)
+	if err != nil {
+		exitWithError("Error writing output file", err, 40)
+	}
+
+	err = decrypt.DecryptEpub(&zr.Reader, contentKey, output)
+	output.Close()
+	if err != nil {
+		os.Remove(*outputFilename)
+		exitWithError("Error decrypting the publication", err, 30)
+	}
+
+	log.Println("License " + lic.Id + ": clear publication written to " + *outputFilename)
+	os.Exit(0)
+}
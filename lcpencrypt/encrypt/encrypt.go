@@ -36,6 +36,7 @@ import (
 
 	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/index"
 	"github.com/readium/readium-lcp-server/pack"
 )
 
@@ -45,10 +46,14 @@ type EncryptedEpub struct {
 	EncryptionKey []byte
 	Size          int64
 	Checksum      string
+	Algorithm     string
+	Validation    epub.Report
+	Metadata      index.Metadata
 }
 
 // EncryptEpub Encrypt input file to output file
-func EncryptEpub(inputPath string, outputPath string) (EncryptedEpub, error) {
+// The input file is validated first, and rejected if it has errors when validation is "reject"
+func EncryptEpub(inputPath string, outputPath string, validation string) (EncryptedEpub, error) {
 	if _, err := os.Stat(inputPath); err != nil {
 		return EncryptedEpub{}, errors.New("Input file does not exists")
 	}
@@ -65,6 +70,11 @@ func EncryptEpub(inputPath string, outputPath string) (EncryptedEpub, error) {
 		return EncryptedEpub{}, errors.New("Invalid zip (epub) file")
 	}
 
+	report, err := epub.Check(zipReader, validation)
+	if err != nil {
+		return EncryptedEpub{Validation: report}, err
+	}
+
 	epubContent, err := epub.Read(zipReader)
 	if err != nil {
 		return EncryptedEpub{}, errors.New("Invalid epub content")
@@ -98,5 +108,5 @@ func EncryptEpub(inputPath string, outputPath string) (EncryptedEpub, error) {
 	checksum := hex.EncodeToString(hasher.Sum(nil))
 
 	output.Close()
-	return EncryptedEpub{outputPath, encryptionKey, stats.Size(), checksum}, nil
+	return EncryptedEpub{outputPath, encryptionKey, stats.Size(), checksum, encrypter.Signature(), report, pack.EpubMetadata(epubContent)}, nil
 }
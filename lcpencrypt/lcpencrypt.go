@@ -44,8 +44,10 @@ import (
 
 	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/index"
 	"github.com/readium/readium-lcp-server/lcpserver/api"
 	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/rwpm"
 )
 
 // notification of newly added content (Publication)
@@ -82,6 +84,7 @@ func notifyLcpServer(lcpService, contentid string, lcpPublication apilcp.LcpPubl
 // reads and returns the content of
 // a file on the local filesystem
 // or via a GET if the scheme is http:// or https://
+// a local folder is returned as a Readium audiobook package
 func getInputFile(inputFilename string) ([]byte, error) {
 	url, err := url.Parse(inputFilename)
 	if err != nil {
@@ -97,16 +100,24 @@ func getInputFile(inputFilename string) ([]byte, error) {
 	} else if url.Scheme == "ftp" {
 		return nil, errors.New("ftp not supported yet")
 
+	} else if info, err := os.Stat(inputFilename); err == nil && info.IsDir() {
+		var buf bytes.Buffer
+		err = pack.PackageDir(inputFilename, &buf)
+		return buf.Bytes(), err
 	} else {
 		return ioutil.ReadFile(inputFilename)
 	}
 }
 
 func showHelpAndExit() {
-	log.Println("lcpencrypt protects an epub file for usage in an lcp environment")
-	log.Println("-input        source epub file locator (file system or http GET)")
+	log.Println("lcpencrypt protects an epub, pdf or audiobook for usage in an lcp environment")
+	log.Println("-input        source epub, pdf or audiobook file locator (file system or http GET),")
+	log.Println("              or folder of mp3/m4a files with an optional manifest.json")
 	log.Println("[-contentid]  optional content identifier, if omitted a new one will be generated")
 	log.Println("[-output]     optional target location for protected content (file system or http PUT)")
+	log.Println("[-encryption] optional encryption of the resources, CBC (default) or GCM")
+	log.Println("[-deobfuscate] optional, restore the obfuscated fonts and encrypt them like the other resources")
+	log.Println("[-validation] optional, reject an invalid epub or only warn about it: reject, warn (default)")
 	log.Println("[-lcpsv]      optional http endpoint for the License server")
 	log.Println("[-login]      login ( needed for License server) ")
 	log.Println("[-password]   password ( needed for License server)")
@@ -143,10 +154,13 @@ func getChecksum(filename string) string {
 func main() {
 	var err error
 	var addedPublication apilcp.LcpPublication
-	var inputFilename = flag.String("input", "", "source epub file locator (file system or http GET)")
+	var inputFilename = flag.String("input", "", "source epub, pdf or audiobook locator (file system, folder or http GET)")
 	var contentid = flag.String("contentid", "", "optional content identifier; if omitted a new one is generated")
 	var outputFilename = flag.String("output", "", "optional target location for the encrypted content (file system or http PUT)")
 	var lcpsv = flag.String("lcpsv", "", "optional http endpoint of the License server (adds content)")
+	var validation = flag.String("validation", epub.VALIDATION_WARN, "optional, reject an invalid epub or only warn about it (reject, warn)")
+	var deobfuscate = flag.Bool("deobfuscate", false, "optional, restore the obfuscated fonts and encrypt them like the other resources")
+	var encryption = flag.String("encryption", "", "optional encryption of the resources, CBC (default) or GCM")
 	var username = flag.String("login", "", "login (License server)")
 	var password = flag.String("password", "", "password (License server)")
 
@@ -163,6 +177,16 @@ func main() {
 		addedPublication.ErrorMessage = "incorrect parameters, lcpsv needs login and password, for more information type 'lcpencrypt -help' "
 		exitWithError(addedPublication, nil, 80)
 	}
+	encrypter, err := crypto.NewAESEncrypter(*encryption)
+	if err != nil {
+		addedPublication.ErrorMessage = "incorrect parameters, encryption must be CBC or GCM, for more information type 'lcpencrypt -help' "
+		exitWithError(addedPublication, err, 80)
+	}
+	addedPublication.Algorithm = encrypter.Signature()
+	if err = epub.CheckValidationMode(*validation); err != nil {
+		addedPublication.ErrorMessage = "incorrect parameters, validation must be reject or warn, for more information type 'lcpencrypt -help' "
+		exitWithError(addedPublication, err, 80)
+	}
 
 	// read the epub input file content in memory
 	buf, err := getInputFile(*inputFilename)
@@ -174,12 +198,47 @@ func main() {
 		sha := sha256.Sum256(buf)
 		*contentid = fmt.Sprintf("%x", sha)
 	}
+	// a pdf file or a Readium package is protected in a Readium package, other files are epub
+	isPDF := bytes.HasPrefix(buf, []byte("%PDF-"))
+	isRWP := false
+	var zr *zip.Reader
+	addedPublication.ContentType = epub.ContentType_EPUB
+	if isPDF {
+		addedPublication.ContentType = rwpm.ContentType_LCP_PDF
+	} else {
+		zr, err = zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+		if err != nil {
+			addedPublication.ErrorMessage = "Error opening the epub file"
+			exitWithError(addedPublication, err, 60)
+		}
+		manifest, err := rwpm.FindManifest(zr)
+		if err == nil {
+			isRWP = true
+			addedPublication.ContentType = manifest.LCPContentType()
+			metadata := pack.RWPMetadata(manifest)
+			addedPublication.Metadata = &metadata
+			if addedPublication.ContentType == "" {
+				addedPublication.ErrorMessage = "Unsupported Readium package, neither an audiobook nor a pdf"
+				exitWithError(addedPublication, nil, 60)
+			}
+		} else if err != rwpm.ErrNoManifest {
+			addedPublication.ErrorMessage = "Error reading the manifest of the Readium package"
+			exitWithError(addedPublication, err, 60)
+		}
+	}
+	extension := ".epub"
+	if isPDF || isRWP {
+		extension = rwpm.Extension(addedPublication.ContentType)
+	}
 	var basefilename string
 	addedPublication.ContentId = *contentid
 	if *outputFilename == "" { //output not set -> "content-id.epub" in the working directory
 		workingDir, _ := os.Getwd()
-		*outputFilename = strings.Join([]string{workingDir, string(os.PathSeparator), *contentid, ".epub"}, "")
+		*outputFilename = strings.Join([]string{workingDir, string(os.PathSeparator), *contentid, extension}, "")
 		basefilename = filepath.Base(*inputFilename)
+		if isPDF || isRWP {
+			basefilename = strings.TrimSuffix(basefilename, filepath.Ext(basefilename)) + extension
+		}
 	} else {
 		basefilename = filepath.Base(*outputFilename)
 	}
@@ -187,15 +246,28 @@ func main() {
 	addedPublication.Output = *outputFilename
 
 	// read the epub content from the zipped buffer
-	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
-	if err != nil {
-		addedPublication.ErrorMessage = "Error opening the epub file"
-		exitWithError(addedPublication, err, 60)
-	}
-	ep, err := epub.Read(zr)
-	if err != nil {
-		addedPublication.ErrorMessage = "Error reading the epub content"
-		exitWithError(addedPublication, err, 50)
+	var ep epub.Epub
+	if !isPDF && !isRWP {
+		report, err := epub.Check(zr, *validation)
+		if !report.Empty() {
+			// the validation report goes to stderr, stdout is kept for the json result
+			jsonReport, _ := json.MarshalIndent(report, "", "  ")
+			os.Stderr.Write(append(jsonReport, '\n'))
+		}
+		if err != nil {
+			addedPublication.ErrorMessage = "The epub is not valid"
+			exitWithError(addedPublication, err, 50)
+		}
+		ep, err = epub.Read(zr)
+		if err == nil && *deobfuscate {
+			err = ep.Deobfuscate()
+		}
+		if err != nil {
+			addedPublication.ErrorMessage = "Error reading the epub content"
+			exitWithError(addedPublication, err, 50)
+		}
+		metadata := pack.EpubMetadata(ep)
+		addedPublication.Metadata = &metadata
 	}
 
 	// create an output file
@@ -205,9 +277,19 @@ func main() {
 		exitWithError(addedPublication, err, 40)
 	}
 
-	// pack / encrypt the epub content, fill the output file
-	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
-	_, encryptionKey, err := pack.Do(encrypter, ep, output)
+	// pack / encrypt the epub, pdf or audiobook content, fill the output file
+	var encryptionKey crypto.ContentKey
+	if isPDF {
+		title := filepath.Base(*inputFilename)
+		title = strings.TrimSuffix(title, filepath.Ext(title))
+		addedPublication.Metadata = &index.Metadata{Title: title}
+		encryptionKey, err = pack.DoPDF(encrypter, title, bytes.NewReader(buf), output)
+	} else if isRWP {
+		encryptionKey, err = pack.DoRWP(encrypter, zr, output)
+	} else {
+		_, encryptionKey, err = pack.Do(encrypter, ep, output)
+	}
+	packErr := err
 
 	stats, err := output.Stat()
 	if err == nil && (stats.Size() > 0) {
@@ -217,7 +299,8 @@ func main() {
 		addedPublication.Checksum = &cs
 	}
 	output.Close()
-	if err != nil {
+	if packErr != nil {
+		err = packErr
 		addedPublication.ErrorMessage = "Error packaging the publication"
 		exitWithError(addedPublication, err, 30)
 	}
@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/license"
+)
+
+func showHelpAndExit() {
+	log.Println("lcpinspect checks the signature of a license and reports on its content")
+	log.Println("-input        license document (.lcpl) or epub file embedding a license")
+	log.Println("[-help] :     help information")
+	os.Exit(0)
+	return
+}
+
+func exitWithError(message string, err error, errorlevel int) {
+	os.Stderr.WriteString(message)
+	os.Stderr.WriteString("\n")
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Stderr.WriteString("\n")
+	}
+	os.Exit(errorlevel)
+}
+
+// readLicense returns the license document of a .lcpl file, or the one embedded in an epub file
+func readLicense(filename string) ([]byte, error) {
+	if !strings.HasSuffix(strings.ToLower(filename), ".epub") {
+		return ioutil.ReadFile(filename)
+	}
+
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name == epub.LicenseFile {
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func main() {
+	var inputFilename = flag.String("input", "", "license document (.lcpl) or epub file embedding a license")
+	var help = flag.Bool("help", false, "shows information")
+
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	if *help {
+		showHelpAndExit()
+	}
+	if *inputFilename == "" {
+		exitWithError("incorrect parameters, input is mandatory, for more information type 'lcpinspect -help' ", nil, 80)
+	}
+
+	doc, err := readLicense(*inputFilename)
+	if err != nil {
+		exitWithError("Error reading the license", err, 70)
+	}
+	report, err := license.Inspect(doc)
+	if err != nil {
+		exitWithError("Error decoding the license", err, 60)
+	}
+
+	jsonBody, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		exitWithError("Error creating json report", err, 50)
+	}
+	os.Stdout.Write(jsonBody)
+	os.Stdout.WriteString("\n")
+
+	if !report.Valid() {
+		os.Exit(10)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/sign"
+	"github.com/readium/readium-lcp-server/tenant"
+)
+
+// health status of the License Server
+const (
+	HEALTH_OK      = "ok"
+	HEALTH_WARNING = "warning" // the provider certificates expire soon
+	HEALTH_ERROR   = "error"   // no provider certificate is valid, licenses can't be signed
+)
+
+type Health struct {
+	Status  string         `json:"status"`
+	Tenants []TenantHealth `json:"tenants"`
+}
+
+// TenantHealth reports the provider certificates of a tenant
+type TenantHealth struct {
+	Tenant       string                   `json:"tenant,omitempty"`
+	ValidUntil   time.Time                `json:"valid_until"`
+	Warnings     []string                 `json:"warnings,omitempty"`
+	Certificates []sign.CertificateStatus `json:"certificates"`
+}
+
+// CertificateWarnings returns the warnings about the certificates of a tenant,
+// which are raised certificate.expiry_warning_days before they expire
+func CertificateWarnings(t *tenant.Tenant, now time.Time) []string {
+	warn := time.Duration(config.Config.Certificate.ExpiryWarningDays) * 24 * time.Hour
+	return t.Certificate.Warnings(now, warn)
+}
+
+// GetHealth reports the validity of the provider certificates, of all the tenants or of the tenant of the request.
+// The status is 503 Service Unavailable when no certificate of a tenant is valid.
+func GetHealth(w http.ResponseWriter, r *http.Request, s Server) {
+	tenants := s.Tenants().All()
+	if t := s.Tenants().FromRequest(r); t.Id != "" {
+		tenants = []*tenant.Tenant{t}
+	}
+
+	now := time.Now()
+	health := Health{Status: HEALTH_OK, Tenants: make([]TenantHealth, 0, len(tenants))}
+	for _, t := range tenants {
+		th := TenantHealth{
+			Tenant:       t.Id,
+			ValidUntil:   t.Certificate.ValidUntil(now),
+			Warnings:     CertificateWarnings(t, now),
+			Certificates: t.Certificate.Status(now),
+		}
+		if _, err := t.Certificate.At(now); err != nil {
+			health.Status = HEALTH_ERROR
+		} else if len(th.Warnings) > 0 && health.Status == HEALTH_OK {
+			health.Status = HEALTH_WARNING
+		}
+		health.Tenants = append(health.Tenants, th)
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	if health.Status == HEALTH_ERROR {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package apilcp_test
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/jobs"
+	lcpserver "github.com/readium/readium-lcp-server/lcpserver/server"
+	"github.com/readium/readium-lcp-server/tenant"
+)
+
+// newTenantServer returns the handler of a License Server with the tenants alpha, whose user is alice, and beta, whose user is bob;
+// the user admin belongs to no tenant, and every user has the password "password"
+func newTenantServer(t *testing.T, lcp *lcpServer) http.Handler {
+	tenants, err := tenant.New(tenant.Tenant{}, []config.Tenant{{Id: "alpha", Users: []string{"alice"}}, {Id: "beta", Users: []string{"bob"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lcp.tenants = tenants
+	hash := sha1.Sum([]byte("password"))
+	authenticator := auth.NewBasicAuthenticator("test", func(user, realm string) string {
+		return "{SHA}" + base64.StdEncoding.EncodeToString(hash[:])
+	})
+	s := lcpserver.New(":0", "", false, &lcp.idx, &lcp.store, &lcp.lst, &lcp.jbs, lcp.packager, lcp.URLSigner(), tenants, authenticator)
+	return s.Handler
+}
+
+// request sends a request to handler as user, without credentials if user is empty, and returns the HTTP status of the reply
+func request(handler http.Handler, method string, path string, user string) int {
+	r := httptest.NewRequest(method, path, nil)
+	if user != "" {
+		r.SetBasicAuth(user, "password")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestGetJobTenant(t *testing.T) {
+	lcp := newLcpServer(t)
+	handler := newTenantServer(t, lcp)
+	j, err := lcp.jbs.Add(jobs.Job{ContentId: "content", Name: "test.epub", Input: "/tmp/test.epub", Tenant: "alpha"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/jobs/" + strconv.FormatInt(j.Id, 10)
+	tests := []struct {
+		path string
+		user string
+		code int
+	}{
+		{path, "", http.StatusUnauthorized},
+		{"/tenants/alpha" + path, "", http.StatusUnauthorized},
+		{path, "admin", http.StatusOK},
+		{path, "alice", http.StatusOK},
+		{"/tenants/alpha" + path, "alice", http.StatusOK},
+		{path, "bob", http.StatusNotFound},
+		{"/tenants/beta" + path, "admin", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if code := request(handler, "GET", test.path, test.user); code != test.code {
+			t.Errorf("Expected %d on %s as %q, got %d", test.code, test.path, test.user, code)
+		}
+	}
+}
@@ -29,18 +29,17 @@ import (
 	"archive/zip"
 	"bytes"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/mux"
@@ -52,8 +51,10 @@ import (
 	"github.com/readium/readium-lcp-server/index"
 	"github.com/readium/readium-lcp-server/license"
 	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/rwpm"
 	"github.com/readium/readium-lcp-server/sign"
 	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/tenant"
 )
 
 func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
@@ -63,6 +64,10 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 
 	var ExistingLicense license.License
 	ExistingLicense, e := s.Licenses().Get(licenceId)
+	// the licenses of the other tenants are hidden from a request bound to a tenant
+	if e == nil && !s.Tenants().FromRequest(r).Owns(ExistingLicense.Tenant) {
+		e = license.NotFound
+	}
 	if e != nil {
 		if e == license.NotFound {
 			problem.Error(w, r, problem.Problem{Detail: e.Error()}, http.StatusNotFound)
@@ -123,7 +128,7 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 
 		ExistingLicense.Encryption.UserKey.Value = lic.Encryption.UserKey.Value
 
-		err = completeLicense(&ExistingLicense, ExistingLicense.ContentId, s)
+		err = completeLicense(&ExistingLicense, ExistingLicense.ContentId, s.Tenants().FromRequest(r), s)
 		if err != nil {
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 			return
@@ -146,10 +151,14 @@ func GetLicense(w http.ResponseWriter, r *http.Request, s Server) {
 }
 
 // this function only updates the license in the database given a partial license input
-func updateLicenseInDatabase(licenseID string, partialLicense license.License, s Server) (license.License, error) {
+// the license, and the content it is moved to, must belong to the tenant t
+func updateLicenseInDatabase(licenseID string, partialLicense license.License, t *tenant.Tenant, s Server) (license.License, error) {
 
 	var ExistingLicense license.License
 	ExistingLicense, err := s.Licenses().Get(licenseID)
+	if err == nil && !t.Owns(ExistingLicense.Tenant) {
+		err = license.NotFound
+	}
 	if err != nil {
 		return ExistingLicense, err
 	}
@@ -181,8 +190,16 @@ func updateLicenseInDatabase(licenseID string, partialLicense license.License, s
 	if partialLicense.Encryption.UserKey.Hint != "" {
 		ExistingLicense.Encryption.UserKey.Hint = partialLicense.Encryption.UserKey.Hint
 	}
-	if partialLicense.ContentId != "" { //change content
+	if partialLicense.ContentId != "" && partialLicense.ContentId != ExistingLicense.ContentId { //change content, to its latest version
+		c, err := s.Index().Get(partialLicense.ContentId)
+		if err == nil && c.Tenant != ExistingLicense.Tenant {
+			err = index.NotFound
+		}
+		if err != nil {
+			return ExistingLicense, err
+		}
 		ExistingLicense.ContentId = partialLicense.ContentId
+		ExistingLicense.ContentVersion = c.Version
 	}
 	err = s.Licenses().Update(ExistingLicense)
 	if err != nil { // no or incorrect (json) license found in body
@@ -206,7 +223,7 @@ func UpdateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 		problem.Error(w, r, problem.Problem{Detail: "Different license IDs"}, http.StatusNotFound)
 		return
 	}
-	_, err = updateLicenseInDatabase(licenseID, lic, s)
+	_, err = updateLicenseInDatabase(licenseID, lic, s.Tenants().FromRequest(r), s)
 	if err != nil {
 		if err == license.NotFound {
 			problem.Error(w, r, problem.Problem{Detail: license.NotFound.Error()}, http.StatusNotFound)
@@ -279,11 +296,13 @@ func GenerateLicense(w http.ResponseWriter, r *http.Request, s Server) {
 
 	contentID := vars["content_id"]
 	lic.ContentId = ""
-	err = completeLicense(&lic, contentID, s)
+	err = completeLicense(&lic, contentID, s.Tenants().FromRequest(r), s)
 
 	if err != nil {
 		if err == storage.NotFound || err == index.NotFound {
 			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusNotFound)
+		} else if err == license.ErrUnknownProfile {
+			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusBadRequest)
 		} else {
 			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
 		}
@@ -321,7 +340,7 @@ func GenerateProtectedPublication(w http.ResponseWriter, r *http.Request, s Serv
 	licenseID := vars["license_id"] //may be empty (new request or update of existing license/publication
 	if licenseID != "" {            // POST /{license_id}/publication
 		//license update license, regenerate publication, maybe only get from db ?
-		newLicense, err = updateLicenseInDatabase(licenseID, partialLicense, s)
+		newLicense, err = updateLicenseInDatabase(licenseID, partialLicense, s.Tenants().FromRequest(r), s)
 		if err != nil {
 			if err == license.NotFound {
 				problem.Error(w, r, problem.Problem{Detail: license.NotFound.Error()}, http.StatusNotFound)
@@ -336,7 +355,7 @@ func GenerateProtectedPublication(w http.ResponseWriter, r *http.Request, s Serv
 
 		// contentID is not set, get it from the license
 		contentID = newLicense.ContentId
-		err = completeLicense(&newLicense, contentID, s)
+		err = completeLicense(&newLicense, contentID, s.Tenants().FromRequest(r), s)
 		if err != nil {
 			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
 			return
@@ -345,7 +364,7 @@ func GenerateProtectedPublication(w http.ResponseWriter, r *http.Request, s Serv
 		//new license , generate publication
 		newLicense = partialLicense
 		newLicense.ContentId = ""
-		err = completeLicense(&newLicense, contentID, s)
+		err = completeLicense(&newLicense, contentID, s.Tenants().FromRequest(r), s)
 		if err != nil {
 			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
 			return
@@ -363,17 +382,8 @@ func GenerateProtectedPublication(w http.ResponseWriter, r *http.Request, s Serv
 		return
 	}
 
-	epubFile, err := s.Store().Get(contentID)
-	if err != nil {
-		if err == storage.NotFound {
-			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusNotFound)
-			return
-		}
-		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
-		return
-	}
-
-	content, err := s.Index().Get(contentID)
+	// the publication is the version of the content the license was issued for
+	content, err := s.Index().GetVersion(contentID, newLicense.ContentVersion)
 	if err != nil {
 		if err == index.NotFound {
 			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusNotFound)
@@ -382,20 +392,24 @@ func GenerateProtectedPublication(w http.ResponseWriter, r *http.Request, s Serv
 		}
 		return
 	}
-	var b bytes.Buffer
-	contents, err := epubFile.Contents()
+
+	epubFile, err := s.Store().Get(content.StorageKey())
 	if err != nil {
+		if err == storage.NotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusNotFound)
+			return
+		}
 		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
 		return
 	}
-
-	io.Copy(&b, contents)
-	zr, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	contents, size, err := epubFile.ReaderAt()
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
 		return
 	}
-	ep, err := epub.Read(zr)
+	defer contents.Close()
+
+	zr, err := zip.NewReader(contents, size)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentID}, http.StatusInternalServerError)
 		return
@@ -404,18 +418,62 @@ func GenerateProtectedPublication(w http.ResponseWriter, r *http.Request, s Serv
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
 	enc.Encode(newLicense)
-	var buf2 bytes.Buffer
-	buf2.Write(bytes.TrimRight(buf.Bytes(), "\n"))
-	ep.Add(epub.LicenseFile, &buf2, uint64(buf2.Len()))
 
 	//set HTTP headers
-	w.Header().Add("Content-Type", epub.ContentType_EPUB)
+	w.Header().Add("Content-Type", content.Type)
 	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, content.Location))
 	w.Header().Add("X-Lcp-License", newLicense.Id)
 	// must come *after* w.Header().Add()/Set(), but before w.Write()
 	w.WriteHeader(http.StatusCreated)
-	// write HTTP body
-	ep.Write(w)
+	// write HTTP body, streaming the stored entries as is
+	err = epub.AddFile(zr, licenseFile(content.Type), bytes.TrimRight(buf.Bytes(), "\n"), w)
+	if err != nil {
+		log.Println("Error writing protected publication " + contentID + ": " + err.Error())
+	}
+}
+
+// versionLink selects a version of the content in a publication link.
+// The first version is at the plain link, as all content was before it was versioned.
+func versionLink(href string, version int) string {
+	if version <= 1 {
+		return href
+	}
+	separator := "?"
+	if strings.Contains(href, "?") {
+		separator = "&"
+	}
+	return href + separator + "version=" + strconv.Itoa(version)
+}
+
+// licenseFile returns the path of the license document in a package of the given content type
+func licenseFile(contentType string) string {
+	if contentType == epub.ContentType_EPUB {
+		return epub.LicenseFile
+	}
+	return rwpm.LicenseFile
+}
+
+// VerifyLicense checks the signature of the license document passed in the request body
+// and returns a report on its content
+func VerifyLicense(w http.ResponseWriter, r *http.Request, s Server) {
+	doc, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	report, err := license.Inspect(doc)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(report)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
 }
 
 func DecodeJsonLicense(r *http.Request, lic *license.License) error {
@@ -433,39 +491,78 @@ func DecodeJsonLicense(r *http.Request, lic *license.License) error {
 	return err
 }
 
-func completeLicense(l *license.License, contentID string, s Server) error {
-	c, err := s.Index().Get(contentID)
+// completeLicense fills the links, encrypted fields and content key of the license, and signs it.
+// A new license is issued for the latest version of the content, an existing one for its own version.
+// The content of a new license must belong to the tenant of the request, requester.
+func completeLicense(l *license.License, contentID string, requester *tenant.Tenant, s Server) error {
+	isNewLicense := l.ContentId == ""
+	var c index.Content
+	var err error
+	if isNewLicense {
+		c, err = s.Index().Get(contentID)
+		if err == nil && !requester.Owns(c.Tenant) {
+			err = index.NotFound
+		}
+	} else {
+		c, err = s.Index().GetVersion(contentID, l.ContentVersion)
+	}
 	if err != nil {
 		return err
 	}
 
-	isNewLicense := l.ContentId == ""
+	// a new license is issued by the tenant of its content, with its provider, links and certificate
+	if isNewLicense {
+		l.Tenant = c.Tenant
+	}
+	t, err := s.Tenants().Get(l.Tenant)
+	if err != nil {
+		return err
+	}
+
+	// a new license gets the requested or configured profile, an existing one keeps its profile
+	requestedProfile := l.Encryption.Profile
 	if isNewLicense {
 		license.Prepare(l)
 		l.ContentId = contentID
+		l.ContentVersion = c.Version
+		if t.Provider != "" {
+			l.Provider = t.Provider
+		}
+		profile, err := license.SelectProfile(requestedProfile, l.Provider)
+		if err != nil {
+			return err
+		}
+		l.Encryption.Profile = profile.URI()
 	} else {
 		l.Signature = nil // empty signature fields, needs to be recalculated
 	}
 	links := new([]license.Link)
 
 	//verify that mandatory (hint & publication) links are present in the License
-	if value, present := license.DefaultLinks["hint"]; present {
+	if value, present := t.Links["hint"]; present {
 		hint := license.Link{Href: value, Rel: "hint"}
 		*links = append(*links, hint)
 	} else {
 		return errors.New("No hint link present in config")
 	}
 
-	if value, present := license.DefaultLinks["publication"]; present {
+	if value, present := t.Links["publication"]; present {
 		// replace {publication_id} in template link
-		publicationLink := strings.Replace(value, "{publication_id}", c.Id, 1)
-		publication := license.Link{Href: publicationLink, Rel: "publication", Type: epub.ContentType_EPUB, Size: c.Length, Title: c.Location, Checksum: c.Sha256}
+		publicationLink := versionLink(strings.Replace(value, "{publication_id}", c.Id, 1), c.Version)
+		// a signed link to the stored content expires after the configured lifetime
+		if signer := s.URLSigner(); signer != nil {
+			ttl := time.Duration(config.Config.License.PublicationLinkTTL) * time.Second
+			if publicationLink, err = signer.SignedUrl(c.StorageKey(), ttl); err != nil {
+				return err
+			}
+		}
+		publication := license.Link{Href: publicationLink, Rel: "publication", Type: c.Type, Size: c.Length, Title: c.Location, Checksum: c.Sha256}
 		*links = append(*links, publication)
 	} else {
 		return errors.New("No publication link present in config")
 	}
 
-	if value, present := config.Config.License.Links["status"]; present { // add status server to License
+	if value, present := t.Links["status"]; present { // add status server to License
 		statusLink := strings.Replace(value, "{license_id}", l.Id, 1)
 
 		status := license.Link{Href: statusLink, Rel: "status", Type: api.ContentType_LSD_JSON} //status.Type = ??
@@ -484,6 +581,12 @@ func completeLicense(l *license.License, contentID string, s Server) error {
 		hash := sha256.Sum256([]byte(passphrase))
 		encryptionKey = hash[:]
 	}
+	// the user key is the hash of the passphrase transformed by the encryption profile
+	profile, err := license.GetProfile(l.Encryption.Profile)
+	if err != nil {
+		return err
+	}
+	encryptionKey = profile.UserKey(encryptionKey)
 
 	encrypter_content_key := crypto.NewAESEncrypter_CONTENT_KEY()
 
@@ -509,7 +612,7 @@ func completeLicense(l *license.License, contentID string, s Server) error {
 		log.Println("Signature is NOT nil (it should)")
 		l.Signature = nil
 	}
-	err = signLicense(l, s.Certificate())
+	err = signLicense(l, t.Certificate)
 	if err != nil {
 		return err
 	}
@@ -544,7 +647,12 @@ func getField(u *license.UserInfo, field string) reflect.Value {
 	return v.FieldByName(strings.Title(field))
 }
 
-func signLicense(l *license.License, cert *tls.Certificate) error {
+// signLicense signs the license with the certificate which is valid now
+func signLicense(l *license.License, certs *sign.Certificates) error {
+	cert, err := certs.Current()
+	if err != nil {
+		return err
+	}
 	sig, err := sign.NewSigner(cert)
 	if err != nil {
 		return err
@@ -598,7 +706,7 @@ func ListLicenses(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 	licenses := make([]license.LicenseReport, 0)
 	//log.Println("ListAll(" + strconv.Itoa(int(per_page)) + "," + strconv.Itoa(int(page)) + ")")
-	fn := s.Licenses().ListAll(int(per_page), int(page))
+	fn := s.Licenses().ListAll(s.Tenants().FromRequest(r).Id, int(per_page), int(page))
 	for it, err := fn(); err == nil; it, err = fn() {
 		licenses = append(licenses, it)
 	}
@@ -630,7 +738,7 @@ func ListLicensesForContent(w http.ResponseWriter, r *http.Request, s Server) {
 	var err error
 	contentId := vars["key"]
 	//check if license exists
-	_, err = s.Index().Get(contentId)
+	_, err = getContentVersion(r, contentId, "", s)
 	if err == index.NotFound {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
 		return
@@ -663,7 +771,7 @@ func ListLicensesForContent(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 	licenses := make([]license.LicenseReport, 0)
 	//log.Println("List(" + contentId + "," + strconv.Itoa(int(per_page)) + "," + strconv.Itoa(int(page)) + ")")
-	fn := s.Licenses().List(contentId, int(per_page), int(page))
+	fn := s.Licenses().List(s.Tenants().FromRequest(r).Id, contentId, int(per_page), int(page))
 	for it, err := fn(); err == nil; it, err = fn() {
 		licenses = append(licenses, it)
 	}
@@ -688,7 +796,7 @@ func ListLicensesForContent(w http.ResponseWriter, r *http.Request, s Server) {
 func prepareLinks(license license.License, s Server) error {
 	for i := 0; i < len(license.Links); i++ {
 		if license.Links[i].Rel == "publication" {
-			item, err := s.Index().Get(license.ContentId)
+			item, err := s.Index().GetVersion(license.ContentId, license.ContentVersion)
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,89 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// ListNotifications lists the notifications of new licenses waiting in the outbox of the License Status server,
+// the pending or failed ones only if the status parameter is set
+func ListNotifications(w http.ResponseWriter, r *http.Request, s Server) {
+	status := r.FormValue("status")
+	if status != "" && status != license.NOTIFICATION_PENDING && status != license.NOTIFICATION_FAILED {
+		problem.Error(w, r, problem.Problem{Detail: "status must be " + license.NOTIFICATION_PENDING + " or " + license.NOTIFICATION_FAILED}, http.StatusBadRequest)
+		return
+	}
+
+	notifications := make([]license.Notification, 0)
+	fn := s.Licenses().ListNotifications(s.Tenants().FromRequest(r).Id, status)
+	var err error
+	var it license.Notification
+	for it, err = fn(); err == nil; it, err = fn() {
+		notifications = append(notifications, it)
+	}
+	if err != license.NotificationNotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(notifications)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
+
+// ResendNotification sends the notification of a license to the License Status server again, at once
+func ResendNotification(w http.ResponseWriter, r *http.Request, s Server) {
+	licenseId := mux.Vars(r)["license_id"]
+
+	l, err := s.Licenses().Get(licenseId)
+	// the licenses of the other tenants are hidden from a request bound to a tenant
+	if err == nil && !s.Tenants().FromRequest(r).Owns(l.Tenant) {
+		err = license.NotFound
+	}
+	if err == nil {
+		err = s.Licenses().ResendNotification(licenseId)
+	}
+	if err != nil {
+		if err == license.NotFound || err == license.NotificationNotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: licenseId}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: licenseId}, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
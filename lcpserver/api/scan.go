@@ -0,0 +1,83 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package apilcp
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/integrity"
+	"github.com/readium/readium-lcp-server/problem"
+)
+
+// ScanStorage compares the store with the content index and returns the integrity report.
+// The "orphans" parameter selects the action on orphaned items (report, quarantine or delete),
+// only a report is allowed on a GET; "checksums=true" also checks the sha256 of every item.
+// "min_age" (a duration, 24h by default) is the age under which an unindexed item is not an orphan yet.
+// The store is shared by the tenants, it may not be scanned by a request bound to a tenant.
+func ScanStorage(w http.ResponseWriter, r *http.Request, s Server) {
+	if s.Tenants().FromRequest(r).Id != "" {
+		problem.Error(w, r, problem.Problem{Detail: "The storage can not be scanned for a tenant"}, http.StatusForbidden)
+		return
+	}
+	options := integrity.Options{
+		Orphans:   r.FormValue("orphans"),
+		Checksums: r.FormValue("checksums") == "true",
+		MinAge:    integrity.DEFAULT_MIN_AGE,
+	}
+	if minAge := r.FormValue("min_age"); minAge != "" {
+		d, err := time.ParseDuration(minAge)
+		if err != nil || d < 0 {
+			problem.Error(w, r, problem.Problem{Detail: "Invalid min_age, must be a duration such as 48h"}, http.StatusBadRequest)
+			return
+		}
+		options.MinAge = d
+	}
+	if err := integrity.CheckOrphansAction(options.Orphans); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if r.Method == "GET" && options.Orphans != "" && options.Orphans != integrity.ORPHANS_REPORT {
+		problem.Error(w, r, problem.Problem{Detail: "Orphans can only be quarantined or deleted with a POST"}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := integrity.Scan(s.Store(), s.Index(), options)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(report)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+}
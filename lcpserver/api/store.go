@@ -26,90 +26,99 @@
 package apilcp
 
 import (
-	"crypto/tls"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/readium/readium-lcp-server/api"
-	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
 	"github.com/readium/readium-lcp-server/license"
 	"github.com/readium/readium-lcp-server/pack"
 	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/status"
 	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/tenant"
 )
 
 type Server interface {
 	Store() storage.Store
 	Index() index.Index
 	Licenses() license.Store
-	Certificate() *tls.Certificate
-	Source() *pack.ManualSource
+	Jobs() jobs.Jobs
+	Packager() *pack.Packager
+	URLSigner() storage.URLSigner
+	Tenants() *tenant.Tenants
 }
 
 // struct for communication with lcp-server
 type LcpPublication struct {
-	ContentId          string  `json:"content-id"`
-	ContentKey         []byte  `json:"content-encryption-key"`
-	Output             string  `json:"protected-content-location"`
-	Size               *int64  `json:"protected-content-length,omitempty"`
-	Checksum           *string `json:"protected-content-sha256,omitempty"`
-	ContentDisposition *string `json:"protected-content-disposition,omitempty"`
-	ErrorMessage       string  `json:"error"`
+	ContentId          string          `json:"content-id"`
+	ContentKey         []byte          `json:"content-encryption-key"`
+	Output             string          `json:"protected-content-location"`
+	Size               *int64          `json:"protected-content-length,omitempty"`
+	Checksum           *string         `json:"protected-content-sha256,omitempty"`
+	ContentDisposition *string         `json:"protected-content-disposition,omitempty"`
+	ContentType        string          `json:"protected-content-type,omitempty"`
+	Algorithm          string          `json:"protected-content-algorithm,omitempty"`
+	Metadata           *index.Metadata `json:"metadata,omitempty"`
+	ErrorMessage       string          `json:"error"`
 }
 
-func writeRequestFileToTemp(r io.Reader) (int64, *os.File, error) {
-	dir := os.TempDir()
-	file, err := ioutil.TempFile(dir, "readium-lcp")
-	if err != nil {
-		return 0, file, err
-	}
-
-	n, err := io.Copy(file, r)
-
-	// Rewind to the beginning of the file
-	file.Seek(0, 0)
-
-	return n, file, err
-}
+// StoreContent queues the publication sent in the request body for encryption
+// the content id may be set by the client in the "content_id" query parameter, see index.CheckId,
+// otherwise a new one is generated. The publication of an existing content id becomes its new version.
+// The "encryption" query parameter (CBC or GCM) overrides the server setting for this content.
+// A new content belongs to the tenant of the request.
+// The reply is the packaging job, its status is then available at /jobs/{id}
+func StoreContent(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
 
-func cleanupTemp(f *os.File) {
-	if f == nil {
+	contentId := r.URL.Query().Get("content_id")
+	if contentId != "" {
+		if err := index.CheckId(contentId); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentId}, http.StatusBadRequest)
+			return
+		}
+	}
+	t := s.Tenants().FromRequest(r)
+	if contentId != "" && !checkContentTenant(w, r, contentId, t, s) {
 		return
 	}
-	f.Close()
-	os.Remove(f.Name())
-}
-
-func StoreContent(w http.ResponseWriter, r *http.Request, s Server) {
-	vars := mux.Vars(r)
 
-	size, f, err := writeRequestFileToTemp(r.Body)
-	if err != nil {
+	encryption := r.URL.Query().Get("encryption")
+	if _, err := crypto.NewAESEncrypter(encryption); err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
 
-	defer cleanupTemp(f)
-
-	t := pack.NewTask(vars["name"], f, size)
-	result := s.Source().Post(t)
-
-	if result.Error != nil {
-		problem.Error(w, r, problem.Problem{Detail: result.Error.Error()}, http.StatusBadRequest)
+	job, err := s.Packager().Enqueue(t.Id, vars["name"], contentId, encryption, r.Body)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	w.Header().Set("Location", "/jobs/"+strconv.FormatInt(job.Id, 10))
 	// must come *after* w.Header().Add()/Set(), but before w.Write()
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusAccepted)
 
-	json.NewEncoder(w).Encode(result.Id)
+	json.NewEncoder(w).Encode(job)
 }
 
 // AddContent()
@@ -119,6 +128,8 @@ func StoreContent(w http.ResponseWriter, r *http.Request, s Server) {
 // if contentId is different , url key overrides the contentId in the json payload
 // this method adds ths <protected_content_location>  in the store (of encrypted files)
 // and the needed key in the database in order to create the licenses
+// the location is a local path, an http(s) URL or s3://bucket/key; the length and sha256 checksum
+// of the file are computed while it is copied, a mismatch with the payload is rejected
 func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 	vars := mux.Vars(r)
 	decoder := json.NewDecoder(r.Body)
@@ -126,57 +137,93 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 	var publication LcpPublication
 	err := decoder.Decode(&publication)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
 	}
 	contentId := vars["key"]
 	if contentId == "" {
 		problem.Error(w, r, problem.Problem{Detail: "Content ID must be set in url"}, http.StatusBadRequest)
 		return
 	}
-	//read encrypted file from reference
-	file, err := os.Open(publication.Output)
+	if err = index.CheckId(contentId); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error(), Instance: contentId}, http.StatusBadRequest)
+		return
+	}
+	if publication.Algorithm != "" {
+		if _, err = crypto.NewAESDecrypter(publication.Algorithm); err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+	//read encrypted file from reference, and check it is the one lcpencrypt produced
+	source, err := openContent(publication.Output, s)
 	if err != nil {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-	//and add file to storage
-	//var storageItem storage.Item
-	_, err = s.Store().Add(contentId, file)
+	file, size, checksum, err := copyContent(source)
+	source.Close()
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		problem.Error(w, r, problem.Problem{Detail: "Error reading " + publication.Output + ": " + err.Error()}, http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if publication.Size != nil && *publication.Size != size {
+		problem.Error(w, r, problem.Problem{Detail: fmt.Sprintf("Length mismatch: %d bytes expected, %d bytes found", *publication.Size, size), Instance: contentId}, http.StatusBadRequest)
+		return
+	}
+	if publication.Checksum != nil && !strings.EqualFold(*publication.Checksum, checksum) {
+		problem.Error(w, r, problem.Problem{Detail: "Checksum mismatch: sha256 " + *publication.Checksum + " expected, " + checksum + " found", Instance: contentId}, http.StatusBadRequest)
 		return
 	}
 	var c index.Content
-	// insert row in database if key does not exist
+	// insert row in database if key does not exist, add a new version otherwise
 	c, err = s.Index().Get(contentId)
+	if err != nil && err != index.NotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	existing := err == nil
+	t := s.Tenants().FromRequest(r)
+	if !existing {
+		c.Tenant = t.Id
+	} else if !t.Owns(c.Tenant) {
+		problem.Error(w, r, problem.Problem{Detail: "The content belongs to another tenant", Instance: contentId}, http.StatusConflict)
+		return
+	}
+	c.Id = contentId
+	c.Version, err = s.Index().ReserveVersion(contentId)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	//and add file to storage, each version has its own file
+	_, err = s.Store().Add(c.StorageKey(), file)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+		return
+	}
 	c.EncryptionKey = publication.ContentKey
 	if publication.ContentDisposition != nil {
 		c.Location = *publication.ContentDisposition
 	} else {
 		c.Location = ""
 	}
-
-	if publication.Size != nil {
-		c.Length = *publication.Size
-	} else {
-		c.Length = -1
-	}
-
-	if publication.Checksum != nil {
-		c.Sha256 = *publication.Checksum
-	} else {
-		c.Sha256 = ""
+	c.Length = size
+	c.Sha256 = checksum
+	c.Type = publication.ContentType
+	c.Algorithm = publication.Algorithm
+	// the metadata of an updated content is kept if none is sent
+	if publication.Metadata != nil {
+		c.Metadata = *publication.Metadata
 	}
-	//todo? check hash & length
+	//new version of c.Id = publication.ContentId, existing licenses keep the previous one
 	code := http.StatusCreated
-	if err == index.NotFound { //insert into database
-		c.Id = contentId
-		err = s.Index().Add(c)
-	} else { //update encryption key for c.Id = publication.ContentId
-		err = s.Index().Update(c)
+	if existing {
 		code = http.StatusOK
 	}
+	err = s.Index().AddVersion(c)
 	if err != nil { //db not updated
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
@@ -190,8 +237,71 @@ func AddContent(w http.ResponseWriter, r *http.Request, s Server) {
 
 }
 
+// sourceClient fetches the protected publications sent by URL: the source must reply quickly,
+// a large publication may then take longer to transfer
+var sourceClient = &http.Client{
+	Timeout: time.Minute * 10,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: time.Second * 10}).DialContext,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ResponseHeaderTimeout: time.Second * 30,
+	},
+}
+
+// openContent opens the protected publication at location: a local path, an http(s) URL,
+// or s3://bucket/key for an object of the S3 storage bucket
+func openContent(location string, s Server) (io.ReadCloser, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := sourceClient.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.New("GET " + location + " returned HTTP status " + strconv.Itoa(resp.StatusCode))
+		}
+		return resp.Body, nil
+	}
+	if strings.HasPrefix(location, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+		if config.Config.Storage.Mode != "s3" || len(parts) != 2 || parts[0] != config.Config.Storage.Bucket {
+			return nil, errors.New("S3 locations must be objects of the storage bucket")
+		}
+		item, err := s.Store().Get(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		return item.Contents()
+	}
+	return os.Open(location)
+}
+
+// copyContent copies the protected publication into a temporary file,
+// and computes its length and sha256 checksum on the way
+func copyContent(r io.Reader) (*os.File, int64, string, error) {
+	file, err := ioutil.TempFile("", "lcp-content-")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), r)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, "", err
+	}
+	return file, size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ListContents lists the content of the index, with its metadata
+// the list may be filtered with the "title" (part of the title, ignoring case) and "isbn" query parameters
 func ListContents(w http.ResponseWriter, r *http.Request, s Server) {
-	fn := s.Index().List()
+	title, isbn := r.URL.Query().Get("title"), r.URL.Query().Get("isbn")
+	fn := s.Index().Search(s.Tenants().FromRequest(r).Id, title, isbn)
 	contents := make([]index.Content, 0)
 
 	for it, err := fn(); err == nil; it, err = fn() {
@@ -208,10 +318,29 @@ func ListContents(w http.ResponseWriter, r *http.Request, s Server) {
 
 }
 
+// GetContent sends the protected publication
+// or its index entry with the metadata of the publication, if json is requested in the Accept header
+// the latest version is sent, unless another one is selected with the "version" query parameter.
+// The protected publication is downloaded by the readers from the publication link of their license, without credentials;
+// when the publication links are signed, a request without credentials must carry the signature of the stored item.
+// The metadata is only sent to the tenant of the content.
 func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 	vars := mux.Vars(r)
 	contentId := vars["key"]
-	content, err := s.Index().Get(contentId)
+	metadata := strings.Contains(r.Header.Get("Accept"), api.ContentType_JSON)
+	var content index.Content
+	var err error
+	if !metadata && s.Tenants().FromRequest(r).Anonymous() {
+		content, err = findContentVersion(contentId, r.URL.Query().Get("version"), s)
+		if err == nil {
+			if err = verifySignedUrl(r, content.StorageKey(), s); err != nil {
+				problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+				return
+			}
+		}
+	} else {
+		content, err = getContentVersion(r, contentId, r.URL.Query().Get("version"), s)
+	}
 	if err != nil { //item probably  not found
 		if err == index.NotFound {
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
@@ -220,7 +349,12 @@ func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 		}
 		return
 	}
-	item, err := s.Store().Get(contentId)
+	if metadata {
+		w.Header().Set("Content-Type", api.ContentType_JSON)
+		json.NewEncoder(w).Encode(content)
+		return
+	}
+	item, err := s.Store().Get(content.StorageKey())
 	if err != nil { //item probably  not found
 		if err == storage.NotFound {
 			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
@@ -229,20 +363,327 @@ func GetContent(w http.ResponseWriter, r *http.Request, s Server) {
 		}
 		return
 	}
-	contentReadCloser, err := item.Contents()
-	defer contentReadCloser.Close()
-	if err != nil { //file probably not found
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusBadRequest)
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+content.Location)
+	serveItem(w, r, item, content.Type)
+}
+
+// GetFile serves an item of the file system store at its public URL.
+// When URLs are signed, the signature must be valid.
+func GetFile(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	if err := verifySignedUrl(r, key, s); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusForbidden)
+		return
+	}
+	item, err := s.Store().Get(key)
+	if err != nil {
+		if err == storage.NotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
 		return
 	}
+	// protected publications are served with the type of their content, other items with a sniffed type
+	contentType := ""
+	if content, err := s.Index().GetVersion(index.ParseStorageKey(key)); err == nil && content.StorageKey() == key {
+		contentType = content.Type
+	}
+	serveItem(w, r, item, contentType)
+}
 
-	//Send the headers
-	w.Header().Set("Content-Disposition", "attachment; filename="+content.Location)
-	w.Header().Set("Content-Type", epub.ContentType_EPUB)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", content.Length))
+// verifySignedUrl checks the "expires" and "signature" query parameters of a request for the stored item key,
+// when the URLs of the items are signed. The URLs signed by another service, e.g. S3, can not be verified here.
+func verifySignedUrl(r *http.Request, key string, s Server) error {
+	signer := s.URLSigner()
+	if signer == nil {
+		return nil
+	}
+	if hmacSigner, ok := signer.(storage.HMACSigner); ok {
+		return hmacSigner.Verify(key, r.URL.Query().Get("expires"), r.URL.Query().Get("signature"))
+	}
+	return storage.ErrInvalidSignature
+}
+
+// serveItem sends the contents of an item of the store,
+// answering range and conditional requests from its modification time and entity tag
+func serveItem(w http.ResponseWriter, r *http.Request, item storage.Item, contentType string) {
+	info, err := item.Stat()
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	reader, size, err := item.ReaderAt()
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
 
-	io.Copy(w, contentReadCloser)
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, item.Key(), info.ModTime, io.NewSectionReader(reader, 0, size))
+}
 
-	return
+// getContentVersion returns the latest version of a content, or the version given as a string.
+// The content of the other tenants is not found by a request bound to a tenant.
+func getContentVersion(r *http.Request, contentId string, version string, s Server) (index.Content, error) {
+	c, err := findContentVersion(contentId, version, s)
+	if err == nil && !s.Tenants().FromRequest(r).Owns(c.Tenant) {
+		return index.Content{}, index.NotFound
+	}
+	return c, err
+}
 
+// findContentVersion returns the latest version of a content, or the version given as a string, whatever its tenant
+func findContentVersion(contentId string, version string, s Server) (index.Content, error) {
+	if version == "" {
+		return s.Index().Get(contentId)
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return index.Content{}, index.NotFound
+	}
+	return s.Index().GetVersion(contentId, v)
+}
+
+// checkContentTenant tells if the tenant t may add a version to the content contentId,
+// and sends a conflict if the content belongs to another tenant
+func checkContentTenant(w http.ResponseWriter, r *http.Request, contentId string, t *tenant.Tenant, s Server) bool {
+	c, err := s.Index().Get(contentId)
+	if err != nil && err != index.NotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return false
+	}
+	if err == nil && !t.Owns(c.Tenant) {
+		problem.Error(w, r, problem.Problem{Detail: "The content belongs to another tenant", Instance: contentId}, http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// ListContentVersions lists the versions of a content, the oldest first
+func ListContentVersions(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	fn := s.Index().Versions(vars["key"])
+	versions := make([]index.Content, 0)
+	it, err := fn()
+	for ; err == nil; it, err = fn() {
+		versions = append(versions, it)
+	}
+	if err != index.NotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 || !s.Tenants().FromRequest(r).Owns(versions[0].Tenant) {
+		problem.Error(w, r, problem.Problem{Detail: index.NotFound.Error()}, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(versions)
+}
+
+// MigrateLicenses re-issues the licenses of a content for its latest version:
+// they get the content key of the latest version the next time they are fetched,
+// and the License Status server is notified that they were updated
+func MigrateLicenses(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	contentId := vars["key"]
+	c, err := getContentVersion(r, contentId, "", s)
+	if err != nil {
+		if err == index.NotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	migrated, err := s.Licenses().MigrateContentVersion(contentId, c.Version)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentType_JSON)
+	json.NewEncoder(w).Encode(struct {
+		Version  int   `json:"version"`
+		Migrated int64 `json:"migrated"`
+	}{c.Version, migrated})
+}
+
+// GetCover sends the cover image of the latest version of a content, extracted from the publication when it was packaged
+// the "width" query parameter selects one of the thumbnails generated by the packager.
+// The cover is only sent to the tenant of the content.
+func GetCover(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	if _, err := getContentVersion(r, vars["key"], "", s); err != nil {
+		if err == index.NotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	key := pack.CoverKey(vars["key"])
+	if width := r.URL.Query().Get("width"); width != "" {
+		size, err := strconv.Atoi(width)
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: "width must be an integer"}, http.StatusBadRequest)
+			return
+		}
+		key = pack.ThumbnailKey(vars["key"], size)
+	}
+
+	item, err := s.Store().Get(key)
+	if err != nil {
+		if err == storage.NotFound {
+			problem.Error(w, r, problem.Problem{Detail: "No cover for this content"}, http.StatusNotFound)
+		} else {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	contents, err := item.Contents()
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+	cover, err := ioutil.ReadAll(contents)
+	if err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	// the media type of the cover is not stored, it is sniffed from the image
+	w.Header().Set("Content-Type", http.DetectContentType(cover))
+	w.Header().Set("Content-Length", strconv.Itoa(len(cover)))
+	w.Write(cover)
+}
+
+// policies applied by DeleteContent to the licenses of the content which have not expired
+const (
+	DELETE_REFUSE = "refuse" // the content is not deleted (default)
+	DELETE_REVOKE = "revoke" // the licenses are revoked, then the content is deleted
+	DELETE_IGNORE = "ignore" // the content is deleted, the licenses are left as they are
+)
+
+// DeleteContent removes a content: the protected publications of all its versions and its cover from the store,
+// and its rows from the index.
+// The "policy" query parameter tells what to do if the content has licenses which have not expired:
+// refuse the deletion (the default), revoke the licenses or ignore them.
+func DeleteContent(w http.ResponseWriter, r *http.Request, s Server) {
+	vars := mux.Vars(r)
+	contentId := vars["key"]
+
+	policy := r.URL.Query().Get("policy")
+	if policy == "" {
+		policy = DELETE_REFUSE
+	}
+	if policy != DELETE_REFUSE && policy != DELETE_REVOKE && policy != DELETE_IGNORE {
+		problem.Error(w, r, problem.Problem{Detail: "policy must be refuse, revoke or ignore"}, http.StatusBadRequest)
+		return
+	}
+
+	var versions []index.Content
+	fn := s.Index().Versions(contentId)
+	it, err := fn()
+	for ; err == nil; it, err = fn() {
+		versions = append(versions, it)
+	}
+	if err != index.NotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 || !s.Tenants().FromRequest(r).Owns(versions[0].Tenant) {
+		problem.Error(w, r, problem.Problem{Detail: index.NotFound.Error()}, http.StatusNotFound)
+		return
+	}
+
+	if policy != DELETE_IGNORE {
+		var active []string
+		fn := s.Licenses().ListActive(contentId)
+		l, err := fn()
+		for ; err == nil; l, err = fn() {
+			active = append(active, l.Id)
+		}
+		if err != license.NotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		if len(active) > 0 && policy == DELETE_REFUSE {
+			problem.Error(w, r, problem.Problem{Detail: fmt.Sprintf("The content has %d active licenses", len(active)), Instance: contentId}, http.StatusConflict)
+			return
+		}
+		for _, id := range active {
+			if err = revokeLicense(id, s); err != nil {
+				problem.Error(w, r, problem.Problem{Detail: "Unable to revoke license " + id + ": " + err.Error()}, http.StatusBadGateway)
+				return
+			}
+		}
+	}
+
+	for _, version := range versions {
+		if err := s.Store().Remove(version.StorageKey()); err != nil && err != storage.NotFound {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := s.Packager().RemoveCover(contentId); err != nil {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if err := s.Index().Delete(contentId); err != nil && err != index.NotFound {
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeLicense revokes a license through the License Status server, which then ends its rights.
+// Without a License Status server, the rights of the license end now.
+func revokeLicense(id string, s Server) error {
+	lsdBaseUrl := config.Config.LsdServer.PublicBaseUrl
+	if lsdBaseUrl == "" {
+		l, err := s.Licenses().Get(id)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		l.Rights.End = &now
+		return s.Licenses().UpdateRights(l)
+	}
+
+	body, _ := json.Marshal(map[string]string{"status": status.STATUS_REVOKED})
+	req, err := http.NewRequest("PATCH", lsdBaseUrl+"/licenses/"+id+"/status", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	notifyAuth := config.Config.LsdNotifyAuth
+	if notifyAuth.Username != "" {
+		req.SetBasicAuth(notifyAuth.Username, notifyAuth.Password)
+	}
+	req.Header.Add("Content-Type", api.ContentType_JSON)
+
+	lsdClient := &http.Client{
+		Timeout: time.Second * 10,
+	}
+	resp, err := lsdClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("License Status server returned HTTP status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
 }
@@ -0,0 +1,356 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package apilcp_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/lsdserver/api"
+	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/tenant"
+	"github.com/readium/readium-lcp-server/transactions"
+)
+
+type lcpServer struct {
+	store    storage.Store
+	idx      index.Index
+	lst      license.Store
+	jbs      jobs.Jobs
+	packager *pack.Packager
+	signer   storage.URLSigner
+	tenants  *tenant.Tenants
+}
+
+func (s *lcpServer) Store() storage.Store         { return s.store }
+func (s *lcpServer) Index() index.Index           { return s.idx }
+func (s *lcpServer) Licenses() license.Store      { return s.lst }
+func (s *lcpServer) Jobs() jobs.Jobs              { return s.jbs }
+func (s *lcpServer) Packager() *pack.Packager     { return s.packager }
+func (s *lcpServer) URLSigner() storage.URLSigner { return s.signer }
+func (s *lcpServer) Tenants() *tenant.Tenants     { return s.tenants }
+
+type lsdServer struct {
+	trns    transactions.Transactions
+	lst     licensestatuses.LicenseStatuses
+	tenants *tenant.Tenants
+}
+
+func (s *lsdServer) Transactions() transactions.Transactions          { return s.trns }
+func (s *lsdServer) LicenseStatuses() licensestatuses.LicenseStatuses { return s.lst }
+func (s *lsdServer) Tenants() *tenant.Tenants                         { return s.tenants }
+
+func openDB(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newLcpServer(t *testing.T) *lcpServer {
+	tenants, err := tenant.New(tenant.Tenant{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openDB(t, "lcp.sqlite")
+	lcp := &lcpServer{store: storage.NewFileSystem(t.TempDir(), ""), tenants: tenants}
+	if lcp.idx, err = index.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	if lcp.lst, err = license.NewSqlStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if lcp.jbs, err = jobs.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	if lcp.packager, err = pack.NewPackager(lcp.store, lcp.idx, lcp.jbs, config.Packaging{}); err != nil {
+		t.Fatal(err)
+	}
+	return lcp
+}
+
+// TestAddContent adds a protected publication read from an URL, which must match its length and checksum
+func TestAddContent(t *testing.T) {
+	lcp := newLcpServer(t)
+	publication := []byte("protected publication")
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(publication)
+	}))
+	defer source.Close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/contents/{key}", func(w http.ResponseWriter, r *http.Request) { apilcp.AddContent(w, r, lcp) }).Methods("PUT")
+	sum := sha256.Sum256(publication)
+	checksum := hex.EncodeToString(sum[:])
+	size := int64(len(publication))
+	otherSize := size + 1
+	otherChecksum := strings.Repeat("0", 64)
+
+	tests := []struct {
+		size     *int64
+		checksum *string
+		code     int
+	}{
+		{&otherSize, &checksum, http.StatusBadRequest},
+		{&size, &otherChecksum, http.StatusBadRequest},
+		{&size, &checksum, http.StatusCreated},
+	}
+	for _, test := range tests {
+		body, _ := json.Marshal(apilcp.LcpPublication{ContentKey: []byte("1234"), Output: source.URL + "/moby.epub", Size: test.size, Checksum: test.checksum})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("PUT", "/contents/moby", bytes.NewReader(body)))
+		if w.Code != test.code {
+			t.Errorf("Expected %d, got %d: %s", test.code, w.Code, w.Body.String())
+		}
+	}
+
+	c, err := lcp.idx.Get("moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Length != size || c.Sha256 != checksum {
+		t.Errorf("Expected the length and checksum of the publication, got %d %s", c.Length, c.Sha256)
+	}
+}
+
+// TestDeleteContentRevoke deletes a content whose license is registered on a device:
+// the license is revoked through the License Status server, which ends its rights in the License server
+func TestDeleteContentRevoke(t *testing.T) {
+	lcp := newLcpServer(t)
+	tenants := lcp.tenants
+	var err error
+
+	lsdDB := openDB(t, "lsd.sqlite")
+	lsd := &lsdServer{tenants: tenants}
+	if lsd.lst, err = licensestatuses.Open(lsdDB); err != nil {
+		t.Fatal(err)
+	}
+	if lsd.trns, err = transactions.Open(lsdDB); err != nil {
+		t.Fatal(err)
+	}
+
+	lcpRouter := mux.NewRouter()
+	lcpRouter.HandleFunc("/licenses/{license_id}", func(w http.ResponseWriter, r *http.Request) { apilcp.UpdateLicense(w, r, lcp) }).Methods("PATCH")
+	lcpRouter.HandleFunc("/contents/{key}", func(w http.ResponseWriter, r *http.Request) { apilcp.DeleteContent(w, r, lcp) }).Methods("DELETE")
+	lcpHttp := httptest.NewServer(lcpRouter)
+	defer lcpHttp.Close()
+	lsdRouter := mux.NewRouter()
+	lsdRouter.HandleFunc("/licenses/{key}/status", func(w http.ResponseWriter, r *http.Request) { apilsd.CancelLicenseStatus(w, r, lsd) }).Methods("PATCH")
+	lsdHttp := httptest.NewServer(lsdRouter)
+	defer lsdHttp.Close()
+
+	config.Config.LcpServer.PublicBaseUrl = lcpHttp.URL
+	config.Config.LsdServer.PublicBaseUrl = lsdHttp.URL
+	defer func() {
+		config.Config.LcpServer.PublicBaseUrl = ""
+		config.Config.LsdServer.PublicBaseUrl = ""
+	}()
+
+	if err = lcp.idx.Add(index.Content{Id: "moby", EncryptionKey: []byte("1234"), Location: "moby.epub"}); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now().Add(24 * time.Hour)
+	l := license.New()
+	l.User.Id = "user"
+	l.Provider = "provider"
+	l.ContentId = "moby"
+	l.Rights.End = &end
+	l.Encryption.UserKey.Check = []byte("check")
+	if err = lcp.lst.Add(l); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ls := licensestatuses.LicenseStatus{Status: status.STATUS_ACTIVE, LicenseRef: l.Id, CurrentEndLicense: &end,
+		Updated: &licensestatuses.Updated{License: &now, Status: &now}}
+	if err = lsd.lst.Add(ls); err != nil {
+		t.Fatal(err)
+	}
+
+	// the active license is kept by default
+	req, _ := http.NewRequest("DELETE", lcpHttp.URL+"/contents/moby", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected %d, got %d", http.StatusConflict, resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("DELETE", lcpHttp.URL+"/contents/moby?policy=revoke", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if _, err = lcp.idx.Get("moby"); err != index.NotFound {
+		t.Errorf("Expected the content to be deleted, got %v", err)
+	}
+	revoked, err := lsd.lst.GetByLicenseId(l.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.Status != status.STATUS_REVOKED {
+		t.Errorf("Expected the license status to be %s, got %s", status.STATUS_REVOKED, revoked.Status)
+	}
+	updated, err := lcp.lst.Get(l.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Rights.End == nil || updated.Rights.End.After(time.Now()) {
+		t.Errorf("Expected the rights of the license to end, got %v", updated.Rights.End)
+	}
+}
+
+// TestGetContentTenant checks that the metadata of a content is only sent to its tenant, and its protected publication to anyone
+func TestGetContentTenant(t *testing.T) {
+	lcp := newLcpServer(t)
+	handler := newTenantServer(t, lcp)
+	c := index.Content{Id: "book", EncryptionKey: []byte("1234"), Location: "book.epub", Tenant: "alpha"}
+	if err := lcp.idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lcp.store.Add(c.StorageKey(), bytes.NewReader([]byte("protected publication"))); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := func(user string) int {
+		r := httptest.NewRequest("GET", "/contents/book", nil)
+		r.Header.Set("Accept", api.ContentType_JSON)
+		if user != "" {
+			r.SetBasicAuth(user, "password")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	for user, code := range map[string]int{"": http.StatusNotFound, "bob": http.StatusNotFound, "alice": http.StatusOK, "admin": http.StatusOK} {
+		if got := metadata(user); got != code {
+			t.Errorf("Expected %d for the metadata as %q, got %d", code, user, got)
+		}
+	}
+	if code := request(handler, "GET", "/contents/book", ""); code != http.StatusOK {
+		t.Errorf("Expected the protected publication to be sent without credentials, got %d", code)
+	}
+	if code := request(handler, "GET", "/tenants/beta/contents", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected the list of contents to require credentials, got %d", code)
+	}
+
+	if _, err := lcp.store.Add(pack.CoverKey("book"), bytes.NewReader([]byte("cover"))); err != nil {
+		t.Fatal(err)
+	}
+	for user, code := range map[string]int{"": http.StatusUnauthorized, "bob": http.StatusNotFound, "alice": http.StatusOK, "admin": http.StatusOK} {
+		if got := request(handler, "GET", "/contents/book/cover", user); got != code {
+			t.Errorf("Expected %d for the cover as %q, got %d", code, user, got)
+		}
+	}
+}
+
+// TestStoreContentTenant checks that only the tenant of a content may upload a new version of it
+func TestStoreContentTenant(t *testing.T) {
+	lcp := newLcpServer(t)
+	handler := newTenantServer(t, lcp)
+	c := index.Content{Id: "book", EncryptionKey: []byte("1234"), Location: "book.epub", Tenant: "alpha"}
+	if err := lcp.idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for user, code := range map[string]int{"": http.StatusUnauthorized, "bob": http.StatusConflict, "alice": http.StatusAccepted} {
+		if got := request(handler, "POST", "/contents/book.epub?content_id=book", user); got != code {
+			t.Errorf("Expected %d for a new version sent as %q, got %d", code, user, got)
+		}
+	}
+	if code := request(handler, "POST", "/contents/other.epub", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a new content to require credentials, got %d", code)
+	}
+}
+
+// TestGetContentSigned checks that a protected publication is not sent without credentials nor signature when the links are signed
+func TestGetContentSigned(t *testing.T) {
+	lcp := newLcpServer(t)
+	signer := storage.HMACSigner{BaseUrl: "http://localhost/files", Secret: []byte("secret")}
+	lcp.signer = signer
+	handler := newTenantServer(t, lcp)
+	c := index.Content{Id: "book", EncryptionKey: []byte("1234"), Location: "book.epub", Tenant: "alpha"}
+	if err := lcp.idx.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lcp.store.Add(c.StorageKey(), bytes.NewReader([]byte("protected publication"))); err != nil {
+		t.Fatal(err)
+	}
+	link, err := signer.SignedUrl(c.StorageKey(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := link[strings.Index(link, "?"):]
+	expired, _ := signer.SignedUrl(c.StorageKey(), -time.Minute)
+
+	tests := []struct {
+		path string
+		user string
+		code int
+	}{
+		{"/contents/book", "", http.StatusForbidden},
+		{"/contents/book" + expired[strings.Index(expired, "?"):], "", http.StatusForbidden},
+		{"/contents/book" + query, "", http.StatusOK},
+		{"/contents/book", "alice", http.StatusOK},
+		{"/contents/book", "bob", http.StatusNotFound},
+		{"/files/" + c.StorageKey(), "", http.StatusForbidden},
+		{"/files/" + c.StorageKey() + query, "", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := request(handler, "GET", test.path, test.user); code != test.code {
+			t.Errorf("Expected %d on %s as %q, got %d", test.code, test.path, test.user, code)
+		}
+	}
+}
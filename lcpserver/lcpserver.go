@@ -26,8 +26,9 @@
 package main
 
 import (
-	"crypto/tls"
 	"database/sql"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -37,6 +38,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/abbot/go-http-auth"
 	_ "github.com/go-sql-driver/mysql"
@@ -44,11 +46,18 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
 	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/integrity"
+	"github.com/readium/readium-lcp-server/jobs"
+	"github.com/readium/readium-lcp-server/lcpserver/api"
 	"github.com/readium/readium-lcp-server/lcpserver/server"
 	"github.com/readium/readium-lcp-server/license"
 	"github.com/readium/readium-lcp-server/pack"
+	"github.com/readium/readium-lcp-server/sign"
 	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/tenant"
 )
 
 func dbFromURI(uri string) (string, string) {
@@ -61,6 +70,14 @@ func main() {
 	var readonly bool = false
 	var err error
 
+	// admin command: lcpserver -scan report|quarantine|delete [-checksums] [-min-age 24h]
+	var scan = flag.String("scan", "", "compare the storage with the content index, print the report and exit; the value is the action on orphaned items: report, quarantine or delete")
+	var checksums = flag.Bool("checksums", false, "with -scan, check the sha256 of every stored item")
+	var minAge = flag.Duration("min-age", integrity.DEFAULT_MIN_AGE, "with -scan, the age under which an unindexed item is not an orphan yet")
+	// admin command: lcpserver -rewrap-keys
+	var rewrapKeys = flag.Bool("rewrap-keys", false, "wrap all content keys with the current master key and exit")
+	flag.Parse()
+
 	if config_file = os.Getenv("READIUM_LICENSE_CONFIG"); config_file == "" {
 		config_file = "config.yaml"
 	}
@@ -73,6 +90,9 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if _, err = crypto.NewAESEncrypter(config.Config.AES256_CBC_OR_GCM); err != nil {
+		panic(err)
+	}
 	static = config.Config.LcpServer.Directory
 	if static == "" {
 		_, file, _, _ := runtime.Caller(0)
@@ -112,12 +132,22 @@ func main() {
 	if certFile = config.Config.Certificate.Cert; certFile == "" {
 		panic("Must specify a certificate")
 	}
-	if privKeyFile = config.Config.Certificate.PrivateKey; privKeyFile == "" {
+	// the private key is only needed in a file when no other signer is selected
+	signerType := config.Config.Certificate.Signer.Type
+	if privKeyFile = config.Config.Certificate.PrivateKey; privKeyFile == "" && (signerType == "" || signerType == sign.SIGNER_FILE) {
 		panic("Must specify a private key")
 	}
-	cert, err := tls.LoadX509KeyPair(certFile, privKeyFile)
-	if err != nil {
-		panic(err)
+	if config.Config.Certificate.ExpiryWarningDays <= 0 {
+		config.Config.Certificate.ExpiryWarningDays = 30
+	}
+	if config.Config.LsdNotify.MaxAttempts <= 0 {
+		config.Config.LsdNotify.MaxAttempts = 10
+	}
+	if config.Config.LsdNotify.RetryDelay <= 0 {
+		config.Config.LsdNotify.RetryDelay = 30
+	}
+	if config.Config.LsdNotify.MaxRetryDelay <= 0 {
+		config.Config.LsdNotify.MaxRetryDelay = 3600
 	}
 
 	driver, cnxn := dbFromURI(dbURI)
@@ -131,18 +161,44 @@ func main() {
 			panic(err)
 		}
 	}
-	idx, err := index.Open(db)
+	// content keys are wrapped with a master key when one is configured
+	keys, err := index.LoadKeyRing(config.Config.ContentKeys)
+	if err != nil {
+		panic(err)
+	}
+	idx, err := index.OpenWithKeys(db, keys)
 	if err != nil {
 		panic(err)
 	}
+	if *rewrapKeys {
+		count, err := idx.RewrapKeys()
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Content keys re-wrapped with the master key " + config.Config.ContentKeys.Current + ": " + strconv.Itoa(count))
+		os.Exit(0)
+	}
 
 	lst, err := license.NewSqlStore(db)
 
 	if err != nil {
 		panic(err)
 	}
+	if config.Config.LsdServer.PublicBaseUrl != "" && !readonly {
+		lst.StartNotifier(config.Config.LsdNotify)
+	}
 
 	license.CreateLinks()
+	// the settings of the top level of the configuration are those of the default tenant
+	def := tenant.Tenant{Links: config.Config.License.Links, LicenseLinkUrl: config.Config.LsdServer.LicenseLinkUrl}
+	tenants, err := tenant.New(def, config.Config.Tenants)
+	if err != nil {
+		panic(err)
+	}
+	if err = tenants.LoadCertificates(config.Config.Certificate); err != nil {
+		panic(err)
+	}
+	logCertificateWarnings(tenants)
 	var store storage.Store
 
 	if mode := config.Config.Storage.Mode; mode == "s3" {
@@ -153,7 +209,57 @@ func main() {
 		store = storage.NewFileSystem(storagePath, config.Config.LcpServer.PublicBaseUrl+"/files")
 	}
 
-	packager := pack.NewPackager(store, idx, 4)
+	// publication links expire when a lifetime is configured: S3 presigns them, the file system store needs a signing key
+	var signer storage.URLSigner
+	if config.Config.License.PublicationLinkTTL > 0 {
+		if s3signer, ok := store.(storage.URLSigner); ok {
+			signer = s3signer
+		} else if key := config.Config.Storage.SigningKey; key != "" {
+			signer = storage.HMACSigner{BaseUrl: config.Config.LcpServer.PublicBaseUrl + "/files", Secret: []byte(key)}
+		} else {
+			panic("Must have a storage signing_key to sign the publication links")
+		}
+	}
+
+	if *scan != "" {
+		report, err := integrity.Scan(store, idx, integrity.Options{Orphans: *scan, Checksums: *checksums, MinAge: *minAge})
+		if err != nil {
+			panic(err)
+		}
+		jsonBody, _ := json.MarshalIndent(report, "", "  ")
+		os.Stdout.Write(jsonBody)
+		os.Stdout.WriteString("\n")
+		if len(report.Missing) > 0 || len(report.Corrupted) > 0 || len(report.Orphans) > 0 {
+			os.Exit(10)
+		}
+		os.Exit(0)
+	}
+
+	jbs, err := jobs.Open(db)
+	if err != nil {
+		panic(err)
+	}
+	packaging := config.Config.Packaging
+	if packaging.Directory == "" {
+		packaging.Directory = "packaging"
+	}
+	os.MkdirAll(packaging.Directory, os.ModePerm) //ignore the error, the folder can already exist
+	if packaging.Workers <= 0 {
+		packaging.Workers = 4
+	}
+	if packaging.MaxAttempts <= 0 {
+		packaging.MaxAttempts = 3
+	}
+	if packaging.Thumbnails == nil {
+		packaging.Thumbnails = []int{150, 300}
+	}
+	if err = epub.CheckValidationMode(packaging.Validation); err != nil {
+		panic(err)
+	}
+	packager, err := pack.NewPackager(store, idx, jbs, packaging)
+	if err != nil {
+		panic(err)
+	}
 
 	authFile := config.Config.LcpServer.AuthFile
 	if authFile == "" {
@@ -166,9 +272,9 @@ func main() {
 	htpasswd := auth.HtpasswdFileProvider(authFile)
 	authenticator := auth.NewBasicAuthenticator("Readium License Content Protection Server", htpasswd)
 
-	HandleSignals()
+	HandleSignals(config_file, tenants)
 	parsedPort := strconv.Itoa(config.Config.LcpServer.Port)
-	s := lcpserver.New(":"+parsedPort, static, readonly, &idx, &store, &lst, &cert, packager, authenticator)
+	s := lcpserver.New(":"+parsedPort, static, readonly, &idx, &store, &lst, &jbs, packager, signer, tenants, authenticator)
 	if readonly {
 		log.Println("License server running in readonly mode on port " + parsedPort)
 	} else {
@@ -187,12 +293,16 @@ func main() {
 
 }
 
-func HandleSignals() {
+// HandleSignals dumps the goroutines on SIGQUIT, stops the server on SIGINT and SIGTERM,
+// and reloads the provider certificates from the configuration file on SIGHUP
+func HandleSignals(configFile string, tenants *tenant.Tenants) {
 	sigChan := make(chan os.Signal)
 	go func() {
 		stacktrace := make([]byte, 1<<20)
 		for sig := range sigChan {
 			switch sig {
+			case syscall.SIGHUP:
+				reloadCertificates(configFile, tenants)
 			case syscall.SIGQUIT:
 				length := runtime.Stack(stacktrace, true)
 				fmt.Println(string(stacktrace[:length]))
@@ -204,7 +314,35 @@ func HandleSignals() {
 			}
 		}
 	}()
-	signal.Notify(sigChan, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// reloadCertificates loads the provider certificates listed in the configuration file again,
+// the certificates in use are kept if the new ones can't be loaded
+func reloadCertificates(configFile string, tenants *tenant.Tenants) {
+	conf, err := config.Read(configFile)
+	if err == nil {
+		err = tenants.ReloadCertificates(conf.Certificate, conf.Tenants)
+	}
+	if err != nil {
+		log.Println("Error reloading the provider certificates: " + err.Error())
+		return
+	}
+	log.Println("Provider certificates reloaded")
+	logCertificateWarnings(tenants)
+}
+
+// logCertificateWarnings warns about the provider certificates which expire soon
+func logCertificateWarnings(tenants *tenant.Tenants) {
+	now := time.Now()
+	for _, t := range tenants.All() {
+		for _, warning := range apilcp.CertificateWarnings(t, now) {
+			if t.Id != "" {
+				warning = "Tenant " + t.Id + ": " + warning
+			}
+			log.Println("WARNING: " + warning)
+		}
+	}
 }
 
 func s3ConfigFromYAML() storage.S3Config {
@@ -26,7 +26,6 @@
 package lcpserver
 
 import (
-	"crypto/tls"
 	"net/http"
 	"time"
 
@@ -34,11 +33,14 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
 	"github.com/readium/readium-lcp-server/lcpserver/api"
 	"github.com/readium/readium-lcp-server/license"
 	"github.com/readium/readium-lcp-server/pack"
 	"github.com/readium/readium-lcp-server/storage"
+	"github.com/readium/readium-lcp-server/tenant"
 )
 
 type Server struct {
@@ -47,8 +49,10 @@ type Server struct {
 	idx      *index.Index
 	st       *storage.Store
 	lst      *license.Store
-	cert     *tls.Certificate
-	source   pack.ManualSource
+	jbs      *jobs.Jobs
+	packager *pack.Packager
+	signer   storage.URLSigner
+	tenants  *tenant.Tenants
 }
 
 func (s *Server) Store() storage.Store {
@@ -63,21 +67,29 @@ func (s *Server) Licenses() license.Store {
 	return *s.lst
 }
 
-func (s *Server) Certificate() *tls.Certificate {
-	return s.cert
+func (s *Server) Jobs() jobs.Jobs {
+	return *s.jbs
 }
 
-func (s *Server) Source() *pack.ManualSource {
-	return &s.source
+func (s *Server) Packager() *pack.Packager {
+	return s.packager
 }
 
-func New(bindAddr string, static string, readonly bool, idx *index.Index, st *storage.Store, lst *license.Store, cert *tls.Certificate, packager *pack.Packager, basicAuth *auth.BasicAuth) *Server {
+func (s *Server) URLSigner() storage.URLSigner {
+	return s.signer
+}
+
+func (s *Server) Tenants() *tenant.Tenants {
+	return s.tenants
+}
+
+func New(bindAddr string, static string, readonly bool, idx *index.Index, st *storage.Store, lst *license.Store, jbs *jobs.Jobs, packager *pack.Packager, signer storage.URLSigner, tenants *tenant.Tenants, basicAuth *auth.BasicAuth) *Server {
 
 	sr := api.CreateServerRouter(static)
 
 	s := &Server{
 		Server: http.Server{
-			Handler:        sr.N,
+			Handler:        tenants.Handler(sr.N, basicAuth),
 			Addr:           bindAddr,
 			WriteTimeout:   15 * time.Second,
 			ReadTimeout:    15 * time.Second,
@@ -87,8 +99,10 @@ func New(bindAddr string, static string, readonly bool, idx *index.Index, st *st
 		idx:      idx,
 		st:       st,
 		lst:      lst,
-		cert:     cert,
-		source:   pack.ManualSource{},
+		jbs:      jbs,
+		packager: packager,
+		signer:   signer,
+		tenants:  tenants,
 	}
 
 	// Route.PathPrefix: http://www.gorillatoolkit.org/pkg/mux#Route.PathPrefix
@@ -98,23 +112,35 @@ func New(bindAddr string, static string, readonly bool, idx *index.Index, st *st
 	contentRoutesPathPrefix := "/contents"
 	contentRoutes := sr.R.PathPrefix(contentRoutesPathPrefix).Subrouter().StrictSlash(false)
 
-	s.handleFunc(sr.R, contentRoutesPathPrefix, apilcp.ListContents).Methods("GET")
+	s.handlePrivateFunc(sr.R, contentRoutesPathPrefix, apilcp.ListContents, basicAuth).Methods("GET")
 
 	s.handleFunc(contentRoutes, "/{key}", apilcp.GetContent).Methods("GET")
+	s.handlePrivateFunc(contentRoutes, "/{key}/cover", apilcp.GetCover, basicAuth).Methods("GET")
+	s.handlePrivateFunc(contentRoutes, "/{key}/versions", apilcp.ListContentVersions, basicAuth).Methods("GET")
 	s.handlePrivateFunc(contentRoutes, "/{key}/licenses", apilcp.ListLicensesForContent, basicAuth).Methods("GET")
 	if !readonly {
-		s.handleFunc(contentRoutes, "/{name}", apilcp.StoreContent).Methods("POST")
+		s.handlePrivateFunc(contentRoutes, "/{name}", apilcp.StoreContent, basicAuth).Methods("POST")
 		s.handlePrivateFunc(contentRoutes, "/{key}", apilcp.AddContent, basicAuth).Methods("PUT")
+		s.handlePrivateFunc(contentRoutes, "/{key}", apilcp.DeleteContent, basicAuth).Methods("DELETE")
+		s.handlePrivateFunc(contentRoutes, "/{key}/licenses/migrate", apilcp.MigrateLicenses, basicAuth).Methods("POST")
 		s.handlePrivateFunc(contentRoutes, "/{content_id}/licenses", apilcp.GenerateLicense, basicAuth).Methods("POST")
 		s.handlePrivateFunc(contentRoutes, "/{content_id}/publications", apilcp.GenerateProtectedPublication, basicAuth).Methods("POST")
 		s.handlePrivateFunc(contentRoutes, "/{content_id}/publication", apilcp.GenerateProtectedPublication, basicAuth).Methods("POST")
 	}
 
+	// the items of the file system store are served at their public URL
+	if config.Config.Storage.Mode != "s3" {
+		s.handleFunc(sr.R, "/files/{key}", apilcp.GetFile).Methods("GET", "HEAD")
+	}
+
 	licenseRoutesPathPrefix := "/licenses"
 	licenseRoutes := sr.R.PathPrefix(licenseRoutesPathPrefix).Subrouter().StrictSlash(false)
 
 	s.handlePrivateFunc(sr.R, licenseRoutesPathPrefix, apilcp.ListLicenses, basicAuth).Methods("GET")
 
+	// must be declared before the /{license_id} routes
+	s.handlePrivateFunc(licenseRoutes, "/verify", apilcp.VerifyLicense, basicAuth).Methods("POST")
+
 	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.GetLicense, basicAuth).Methods("GET")
 	s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.GetLicense, basicAuth).Methods("POST")
 	s.handlePrivateFunc(licenseRoutes, "/{license_id}/publication", apilcp.GenerateProtectedPublication, basicAuth).Methods("POST")
@@ -122,7 +148,24 @@ func New(bindAddr string, static string, readonly bool, idx *index.Index, st *st
 		s.handlePrivateFunc(licenseRoutes, "/{license_id}", apilcp.UpdateLicense, basicAuth).Methods("PATCH")
 	}
 
-	s.source.Feed(packager.Incoming)
+	s.handlePrivateFunc(sr.R, "/notifications", apilcp.ListNotifications, basicAuth).Methods("GET")
+	if !readonly {
+		s.handlePrivateFunc(sr.R, "/notifications/{license_id}/resend", apilcp.ResendNotification, basicAuth).Methods("POST")
+	}
+
+	s.handlePrivateFunc(sr.R, "/storage/scan", apilcp.ScanStorage, basicAuth).Methods("GET")
+	if !readonly {
+		s.handlePrivateFunc(sr.R, "/storage/scan", apilcp.ScanStorage, basicAuth).Methods("POST")
+	}
+
+	// the report holds the tenant ids and certificate files, it is not public
+	s.handlePrivateFunc(sr.R, "/health", apilcp.GetHealth, basicAuth).Methods("GET")
+
+	jobRoutesPathPrefix := "/jobs"
+	jobRoutes := sr.R.PathPrefix(jobRoutesPathPrefix).Subrouter().StrictSlash(false)
+
+	s.handlePrivateFunc(jobRoutes, "/{id}", apilcp.GetJob, basicAuth).Methods("GET")
+
 	return s
 }
 
@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package license
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"time"
+
+	"github.com/readium/readium-lcp-server/sign"
+)
+
+// Report describes a license document and the result of its verification
+type Report struct {
+	Id              string          `json:"id"`
+	Provider        string          `json:"provider"`
+	Issued          time.Time       `json:"issued"`
+	Updated         *time.Time      `json:"updated,omitempty"`
+	Profile         string          `json:"profile"`
+	Signature       SignatureReport `json:"signature"`
+	Links           []Link          `json:"links"`
+	Rights          []string        `json:"rights"`
+	EncryptedFields []string        `json:"encrypted_fields"`
+	Errors          []string        `json:"errors,omitempty"`
+}
+
+type SignatureReport struct {
+	Algorithm   string             `json:"algorithm,omitempty"`
+	Valid       bool               `json:"valid"`
+	Error       string             `json:"error,omitempty"`
+	Certificate *CertificateReport `json:"certificate,omitempty"`
+}
+
+type CertificateReport struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	ValidAtIssue bool      `json:"valid_at_issue"`
+}
+
+// Valid is true if the license is correctly signed by a certificate which was valid when the license was issued
+func (r Report) Valid() bool {
+	return r.Signature.Valid && r.Signature.Certificate != nil && r.Signature.Certificate.ValidAtIssue && len(r.Errors) == 0
+}
+
+// Inspect decodes a license document and checks its signature against the embedded certificate.
+// The signature is computed on the document as received, minus its signature,
+// so that members unknown to this server are not lost in the canonical form.
+func Inspect(doc []byte) (Report, error) {
+	var l License
+	if err := json.Unmarshal(doc, &l); err != nil {
+		return Report{}, err
+	}
+
+	var unsigned map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&unsigned); err != nil {
+		return Report{}, err
+	}
+	delete(unsigned, "signature")
+
+	report := Report{
+		Id:              l.Id,
+		Provider:        l.Provider,
+		Issued:          l.Issued,
+		Updated:         l.Updated,
+		Profile:         l.Encryption.Profile,
+		Links:           l.Links,
+		Rights:          []string{},
+		EncryptedFields: []string{},
+	}
+
+	if l.Signature == nil {
+		report.Errors = append(report.Errors, "The license is not signed")
+	} else {
+		report.Signature.Algorithm = l.Signature.Algorithm
+		if err := sign.Verify(unsigned, *l.Signature); err != nil {
+			report.Signature.Error = err.Error()
+		} else {
+			report.Signature.Valid = true
+		}
+		if cert, err := x509.ParseCertificate(l.Signature.Certificate); err == nil {
+			report.Signature.Certificate = &CertificateReport{
+				Subject:      cert.Subject.String(),
+				Issuer:       cert.Issuer.String(),
+				NotBefore:    cert.NotBefore,
+				NotAfter:     cert.NotAfter,
+				ValidAtIssue: !l.Issued.Before(cert.NotBefore) && !l.Issued.After(cert.NotAfter),
+			}
+			if !report.Signature.Certificate.ValidAtIssue {
+				report.Errors = append(report.Errors, "The certificate was not valid when the license was issued")
+			}
+		}
+	}
+
+	hasLink := map[string]bool{}
+	for _, link := range l.Links {
+		hasLink[link.Rel] = true
+	}
+	for _, rel := range []string{"hint", "publication"} {
+		if !hasLink[rel] {
+			report.Errors = append(report.Errors, "The license has no "+rel+" link")
+		}
+	}
+
+	if r := l.Rights; r != nil {
+		if r.Print != nil {
+			report.Rights = append(report.Rights, "print")
+		}
+		if r.Copy != nil {
+			report.Rights = append(report.Rights, "copy")
+		}
+		if r.Start != nil {
+			report.Rights = append(report.Rights, "start")
+		}
+		if r.End != nil {
+			report.Rights = append(report.Rights, "end")
+		}
+	}
+	report.EncryptedFields = append(report.EncryptedFields, l.User.Encrypted...)
+
+	return report, nil
+}
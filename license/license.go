@@ -84,7 +84,8 @@ type UserRights struct {
 	End   *time.Time `json:"end,omitempty"`
 }
 
-const DEFAULT_PROFILE = "http://readium.org/lcp/profile-1.0"
+// DEFAULT_PROFILE is the profile of licenses when none is requested or configured
+const DEFAULT_PROFILE = BASIC_PROFILE
 
 var DefaultLinks map[string]string
 
@@ -99,6 +100,10 @@ type License struct {
 	Rights     *UserRights     `json:"rights,omitempty"`
 	Signature  *sign.Signature `json:"signature,omitempty"`
 	ContentId  string          `json:"-"`
+	// version of the content the license was issued for
+	ContentVersion int `json:"-"`
+	// tenant the license was issued for, empty without tenants
+	Tenant string `json:"-"`
 }
 
 type LicenseReport struct {
@@ -25,7 +25,15 @@
 
 package license
 
-import "testing"
+import (
+	"crypto/tls"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/sign"
+)
 
 func TestLicense(t *testing.T) {
 	l := New()
@@ -34,6 +42,113 @@ func TestLicense(t *testing.T) {
 	}
 
 	if l.Encryption.Profile != DEFAULT_PROFILE {
-		t.Error("Expected %s, got %s", DEFAULT_PROFILE, l.Encryption.Profile)
+		t.Errorf("Expected %s, got %s", DEFAULT_PROFILE, l.Encryption.Profile)
+	}
+}
+
+const testProfile = "http://example.com/lcp/test-profile"
+
+// reversedProfile stands for a production profile, with a transform of its own
+type reversedProfile struct{}
+
+func (reversedProfile) URI() string {
+	return testProfile
+}
+
+func (reversedProfile) UserKey(hash []byte) []byte {
+	key := make([]byte, len(hash))
+	for i := range hash {
+		key[i] = hash[len(hash)-1-i]
+	}
+	return key
+}
+
+func TestProfiles(t *testing.T) {
+	RegisterProfile(reversedProfile{})
+
+	p, err := SelectProfile("", "provider")
+	if err != nil || p.URI() != BASIC_PROFILE {
+		t.Errorf("Expected the basic profile by default, got %v", err)
+	}
+	if key := p.UserKey([]byte{1, 2}); key[0] != 1 {
+		t.Error("Expected the basic profile to use the hash of the passphrase as the user key")
+	}
+
+	config.Config.License.ProviderProfiles = map[string]string{"provider": testProfile}
+	defer func() { config.Config.License.ProviderProfiles = nil }()
+	p, err = SelectProfile("", "provider")
+	if err != nil || p.URI() != testProfile {
+		t.Errorf("Expected the profile of the provider, got %v", err)
+	}
+	if key := p.UserKey([]byte{1, 2}); key[0] != 2 {
+		t.Error("Expected the user key transform of the profile")
+	}
+	if p, err = SelectProfile(BASIC_PROFILE, "provider"); err != nil || p.URI() != BASIC_PROFILE {
+		t.Errorf("Expected the requested profile, got %v", err)
+	}
+
+	if _, err = SelectProfile(PRODUCTION_PROFILE, "provider"); err != ErrUnknownProfile {
+		t.Error("Expected an unregistered profile to be refused")
+	}
+	config.Config.License.ProviderProfiles["provider"] = PRODUCTION_PROFILE
+	if _, err = SelectProfile("", "provider"); err != ErrUnknownProfile {
+		t.Error("Expected a new license not to be issued with the legacy alias of the production profile")
+	}
+
+	// licenses issued with the production profile URI before the profiles were pluggable
+	p, err = GetProfile(PRODUCTION_PROFILE)
+	if err != nil || p.URI() != PRODUCTION_PROFILE {
+		t.Fatalf("Expected the legacy production profile, got %v", err)
+	}
+	if key := p.UserKey([]byte{1, 2}); key[0] != 1 {
+		t.Error("Expected the legacy production profile to use the hash of the passphrase as the user key")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../sign/cert/sample_rsa.crt", "../sign/cert/sample_rsa.pem")
+	if err != nil {
+		t.Fatal("Couldn't load sample certificate ", err)
+	}
+	signer, err := sign.NewSigner(&cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := New()
+	l.Issued = time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC) // within the validity of the sample certificate
+	l.Links = []Link{{Rel: "hint", Href: "http://example.com/hint"}, {Rel: "publication", Href: "http://example.com/publication"}}
+	print := int32(10)
+	l.Rights.Print = &print
+	l.User = UserInfo{Id: "user", Email: "user@example.com", Encrypted: []string{"email"}}
+	sig, err := signer.Sign(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Signature = &sig
+	doc, _ := json.Marshal(l)
+
+	report, err := Inspect(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() {
+		t.Errorf("Expected the license to be valid, got %#v", report)
+	}
+	if len(report.Rights) != 1 || report.Rights[0] != "print" {
+		t.Errorf("Expected the print right only, got %v", report.Rights)
+	}
+	if len(report.EncryptedFields) != 1 || report.EncryptedFields[0] != "email" {
+		t.Errorf("Expected the email field to be encrypted, got %v", report.EncryptedFields)
+	}
+
+	l.User.Email = "someone@example.com"
+	doc, _ = json.Marshal(l)
+	report, err = Inspect(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Signature.Valid || report.Valid() {
+		t.Error("Expected the signature of a tampered license to be invalid")
 	}
 }
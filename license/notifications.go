@@ -0,0 +1,272 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package license
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/readium/readium-lcp-server/api"
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/tenant"
+)
+
+var NotificationNotFound = errors.New("Notification not found")
+
+// status of the notification of a new license to the License Status server,
+// a notification is removed from the outbox once the license status document is created
+const (
+	NOTIFICATION_PENDING = "pending"
+	NOTIFICATION_FAILED  = "failed"
+)
+
+// notificationPollInterval is the longest time the notifier waits before looking for notifications to send
+const notificationPollInterval = 10 * time.Second
+
+// Notification is the notification of a new license, kept in the outbox until the License Status server acknowledges it
+type Notification struct {
+	LicenseId   string     `json:"license_id"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Updated     *time.Time `json:"updated,omitempty"`
+}
+
+// ListNotifications lists the notifications of the outbox with a given status, the oldest first.
+// An empty status lists all of them, an empty tenant the notifications of all the tenants.
+func (s *sqlStore) ListNotifications(tenant string, status string) func() (Notification, error) {
+	rows, err := s.db.Query(`SELECT n.license_id, n.status, n.attempts, n.next_attempt, n.error, n.created, n.updated
+	FROM lsd_notification n JOIN license l ON l.id = n.license_id
+	WHERE (? = '' OR l.tenant = ?) AND (? = '' OR n.status = ?)
+	ORDER BY n.created`, tenant, tenant, status, status)
+	if err != nil {
+		return func() (Notification, error) { return Notification{}, err }
+	}
+	return func() (Notification, error) {
+		var n Notification
+		var lastError sql.NullString
+		if rows.Next() {
+			err := rows.Scan(&n.LicenseId, &n.Status, &n.Attempts, &n.NextAttempt, &lastError, &n.Created, &n.Updated)
+			n.Error = lastError.String
+			return n, err
+		}
+		rows.Close()
+		return n, NotificationNotFound
+	}
+}
+
+// ResendNotification sends a notification of the outbox again as soon as possible,
+// with a new series of attempts if it failed
+func (s *sqlStore) ResendNotification(licenseId string) error {
+	result, err := s.db.Exec("UPDATE lsd_notification SET status=?, attempts=0, next_attempt=?, updated=? WHERE license_id=?",
+		NOTIFICATION_PENDING, time.Now(), time.Now(), licenseId)
+	if err != nil {
+		return err
+	}
+	if r, _ := result.RowsAffected(); r == 0 {
+		return NotificationNotFound
+	}
+	s.wakeNotifier()
+	return nil
+}
+
+// queueNotifications queues the notifications of the licenses matching the condition where,
+// the notifications already in the outbox are sent again with a new series of attempts
+func queueNotifications(tx *sql.Tx, where string, args ...interface{}) error {
+	now := time.Now()
+	_, err := tx.Exec("UPDATE lsd_notification SET status=?, attempts=0, next_attempt=?, updated=? WHERE license_id IN (SELECT id FROM license WHERE "+where+")",
+		append([]interface{}{NOTIFICATION_PENDING, now, now}, args...)...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO lsd_notification (license_id, status, attempts, next_attempt, created)
+	SELECT id, ?, 0, ?, ? FROM license WHERE (`+where+`) AND id NOT IN (SELECT license_id FROM lsd_notification)`,
+		append([]interface{}{NOTIFICATION_PENDING, now, now}, args...)...)
+	return err
+}
+
+// StartNotifier starts the worker which sends the notifications of the outbox to the License Status server.
+// A failed attempt is retried after conf.RetryDelay seconds, a delay doubled after each attempt up to conf.MaxRetryDelay;
+// the notification fails after conf.MaxAttempts attempts, or when the License Status server rejects it.
+func (s *sqlStore) StartNotifier(conf config.LsdNotify) {
+	go func() {
+		for {
+			n, err := s.nextNotification(conf)
+			if err != nil {
+				if err != NotificationNotFound {
+					log.Println("Error fetching the next notification to the License Status server: " + err.Error())
+				}
+				select {
+				case <-s.wake:
+				case <-time.After(notificationPollInterval):
+				}
+				continue
+			}
+			s.sendNotification(n, conf)
+		}
+	}()
+}
+
+func (s *sqlStore) wakeNotifier() {
+	select {
+	case s.wake <- struct{}{}:
+	default: // the notifier is busy, it looks for the next notification when it is done
+	}
+}
+
+// nextNotification claims the next pending notification which is due:
+// its next attempt is set in advance, so that another server sharing the database does not send it meanwhile
+func (s *sqlStore) nextNotification(conf config.LsdNotify) (Notification, error) {
+	for {
+		var n Notification
+		now := time.Now()
+		err := s.db.QueryRow(`SELECT license_id, attempts FROM lsd_notification WHERE status=? AND next_attempt <= ?
+		ORDER BY next_attempt LIMIT 1`, NOTIFICATION_PENDING, now).Scan(&n.LicenseId, &n.Attempts)
+		if err == sql.ErrNoRows {
+			return n, NotificationNotFound
+		}
+		if err != nil {
+			return n, err
+		}
+		n.NextAttempt = now.Add(retryDelay(n.Attempts+1, conf))
+		result, err := s.db.Exec("UPDATE lsd_notification SET attempts=?, next_attempt=?, updated=? WHERE license_id=? AND attempts=? AND status=?",
+			n.Attempts+1, n.NextAttempt, now, n.LicenseId, n.Attempts, NOTIFICATION_PENDING)
+		if err != nil {
+			return n, err
+		}
+		if r, _ := result.RowsAffected(); r == 1 {
+			n.Attempts++
+			n.Status = NOTIFICATION_PENDING
+			return n, nil
+		}
+	}
+}
+
+// retryDelay returns the delay before the attempt following a given attempt
+func retryDelay(attempt int, conf config.LsdNotify) time.Duration {
+	delay := time.Duration(conf.RetryDelay) * time.Second
+	max := time.Duration(conf.MaxRetryDelay) * time.Second
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// sendNotification sends a new license to the License Status server, and updates its notification with the result
+func (s *sqlStore) sendNotification(n Notification, conf config.LsdNotify) {
+	l, err := s.Get(n.LicenseId)
+	code := 0
+	if err == nil {
+		code, err = postLicense(l)
+		status := int32(code)
+		if err != nil {
+			status = -1
+		}
+		_ = s.UpdateLsdStatus(l.Id, status)
+	}
+	// the License Status server replies 200 to a license it already knows
+	if err == nil && (code == http.StatusCreated || code == http.StatusOK) {
+		if _, err = s.db.Exec("DELETE FROM lsd_notification WHERE license_id=?", n.LicenseId); err != nil {
+			log.Println("Error removing the notification of license " + n.LicenseId + ": " + err.Error())
+		}
+		return
+	}
+
+	// the License Status server rejects a license whose notification will not get better
+	permanent := err == NotFound || (code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests)
+	if err == nil {
+		err = errors.New("The License Status server returned HTTP status " + strconv.Itoa(code))
+	}
+	if permanent || n.Attempts >= conf.MaxAttempts {
+		n.Status = NOTIFICATION_FAILED
+	}
+	log.Printf("Notification of license %s to the License Status server, attempt %d: %s", n.LicenseId, n.Attempts, err.Error())
+	_, dbErr := s.db.Exec("UPDATE lsd_notification SET status=?, error=?, updated=? WHERE license_id=?",
+		n.Status, err.Error(), time.Now(), n.LicenseId)
+	if dbErr != nil {
+		log.Println("Error updating the notification of license " + n.LicenseId + ": " + dbErr.Error())
+	}
+}
+
+// postLicense informs the License Status server of a new license, and returns the HTTP status of its reply.
+// The license is sent to the path of its tenant, which the status document then belongs to.
+func postLicense(l License) (int, error) {
+	var lsdClient = &http.Client{
+		Timeout: time.Second * 10,
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_ = json.NewEncoder(pw).Encode(l)
+		pw.Close() // signal end writing
+	}()
+	path := "/licenses"
+	if l.Tenant != "" {
+		path = tenant.PATH_PREFIX + url.PathEscape(l.Tenant) + path
+	}
+	req, err := http.NewRequest("PUT", config.Config.LsdServer.PublicBaseUrl+path, pr)
+	if err != nil {
+		return 0, err
+	}
+
+	// Set credentials on lsd request
+	notifyAuth := config.Config.LsdNotifyAuth
+	if notifyAuth.Username != "" {
+		req.SetBasicAuth(notifyAuth.Username, notifyAuth.Password)
+	}
+
+	req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
+
+	response, err := lsdClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+const notificationTableDef = `CREATE TABLE IF NOT EXISTS lsd_notification (
+	license_id varchar(255) PRIMARY KEY,
+	status varchar(32) NOT NULL,
+	attempts int NOT NULL DEFAULT 0,
+	next_attempt datetime NOT NULL,
+	error text DEFAULT NULL,
+	created datetime NOT NULL,
+	updated datetime DEFAULT NULL
+);
+CREATE INDEX IF NOT EXISTS lsd_notification_next_index on lsd_notification (status, next_attempt);`
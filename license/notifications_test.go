@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package license
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestNotifications(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	lsd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer lsd.Close()
+	config.Config.LsdServer.PublicBaseUrl = lsd.URL
+	defer func() { config.Config.LsdServer.PublicBaseUrl = "" }()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	lst, err := NewSqlStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := lst.(*sqlStore)
+
+	l := New()
+	l.User.Id = "user"
+	l.Provider = "provider"
+	l.ContentId = "content"
+	l.Issued = time.Now()
+	l.Encryption.UserKey.Check = []byte("check")
+	if err = s.Add(l); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config.LsdNotify{MaxAttempts: 2, RetryDelay: 60, MaxRetryDelay: 90}
+	n, err := s.nextNotification(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.LicenseId != l.Id || n.Attempts != 1 {
+		t.Fatalf("Expected the first attempt of %s, got %d of %s", l.Id, n.Attempts, n.LicenseId)
+	}
+	if _, err = s.nextNotification(conf); err != NotificationNotFound {
+		t.Fatalf("Expected the notification to be claimed until its next attempt, got %v", err)
+	}
+	s.sendNotification(n, conf)
+
+	// the server error is retried, until the last attempt fails
+	_, err = db.Exec("UPDATE lsd_notification SET next_attempt=?", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = s.nextNotification(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sendNotification(n, conf)
+	fn := s.ListNotifications("", NOTIFICATION_FAILED)
+	n, err = fn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.LicenseId != l.Id || n.Attempts != 2 || n.Error == "" {
+		t.Errorf("Expected the notification of %s to fail after 2 attempts, got %+v", l.Id, n)
+	}
+	if _, err = fn(); err != NotificationNotFound {
+		t.Errorf("Expected a single failed notification, got %v", err)
+	}
+
+	// a resent notification is removed from the outbox once the license status document is created
+	status = http.StatusCreated
+	if err = s.ResendNotification(l.Id); err != nil {
+		t.Fatal(err)
+	}
+	n, err = s.nextNotification(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sendNotification(n, conf)
+	if _, err = s.ListNotifications("", "")(); err != NotificationNotFound {
+		t.Errorf("Expected an empty outbox, got %v", err)
+	}
+	if err = s.ResendNotification(l.Id); err != NotificationNotFound {
+		t.Errorf("Expected %v, got %v", NotificationNotFound, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	conf := config.LsdNotify{RetryDelay: 30, MaxRetryDelay: 100}
+	expected := []time.Duration{30 * time.Second, 60 * time.Second, 100 * time.Second, 100 * time.Second}
+	for i, delay := range expected {
+		if d := retryDelay(i+1, conf); d != delay {
+			t.Errorf("Attempt %d: expected %v, got %v", i+1, delay, d)
+		}
+	}
+}
+
+// TestMigrationNotifications checks that the License Status server is notified of the licenses migrated to a new version
+func TestNotificationPath(t *testing.T) {
+	var path string
+	lsd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer lsd.Close()
+	config.Config.LsdServer.PublicBaseUrl = lsd.URL
+	defer func() { config.Config.LsdServer.PublicBaseUrl = "" }()
+
+	l := New()
+	if _, err := postLicense(l); err != nil || path != "/licenses" {
+		t.Errorf("Expected a license without tenant to be sent to /licenses, got %s (%v)", path, err)
+	}
+	l.Tenant = "imprint"
+	if _, err := postLicense(l); err != nil || path != "/tenants/imprint/licenses" {
+		t.Errorf("Expected the license to be sent to the path of its tenant, got %s (%v)", path, err)
+	}
+}
+
+func TestMigrationNotifications(t *testing.T) {
+	config.Config.LsdServer.PublicBaseUrl = "http://lsd.example.com"
+	defer func() { config.Config.LsdServer.PublicBaseUrl = "" }()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	lst, err := NewSqlStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := New()
+	l.User.Id = "user"
+	l.Provider = "provider"
+	l.ContentId = "content"
+	l.Encryption.UserKey.Check = []byte("check")
+	if err = lst.Add(l); err != nil {
+		t.Fatal(err)
+	}
+	// the notification of the new license was acknowledged
+	if _, err = db.Exec("DELETE FROM lsd_notification"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := lst.MigrateContentVersion("content", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("Expected a migrated license, got %d", migrated)
+	}
+	fn := lst.ListNotifications("", NOTIFICATION_PENDING)
+	n, err := fn()
+	if err != nil || n.LicenseId != l.Id {
+		t.Fatalf("Expected the notification of %s, got %+v (%v)", l.Id, n, err)
+	}
+	fn()
+
+	if migrated, err = lst.MigrateContentVersion("content", 2); err != nil || migrated != 0 {
+		t.Errorf("Expected no license to migrate again, got %d (%v)", migrated, err)
+	}
+}
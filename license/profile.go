@@ -0,0 +1,133 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package license
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// URIs of the LCP encryption profiles
+const (
+	BASIC_PROFILE      = "http://readium.org/lcp/basic-profile"
+	PRODUCTION_PROFILE = "http://readium.org/lcp/profile-1.0"
+)
+
+var ErrUnknownProfile = errors.New("Unknown encryption profile")
+
+// Profile is an LCP encryption profile. Its user key transform derives the user key,
+// which encrypts the content key, the key check and the encrypted user fields,
+// from the SHA-256 hash of the user passphrase.
+type Profile interface {
+	URI() string
+	UserKey(hash []byte) []byte
+}
+
+// the basic profile uses the hash of the passphrase as the user key
+type basicProfile struct{}
+
+func (basicProfile) URI() string {
+	return BASIC_PROFILE
+}
+
+func (basicProfile) UserKey(hash []byte) []byte {
+	return hash
+}
+
+// a legacy profile is a URI which this server used to issue licenses with the basic transform
+type legacyProfile struct {
+	uri string
+}
+
+func (p legacyProfile) URI() string {
+	return p.uri
+}
+
+func (legacyProfile) UserKey(hash []byte) []byte {
+	return hash
+}
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = map[string]Profile{BASIC_PROFILE: basicProfile{}}
+	// licenses were issued with the production profile URI and the basic transform
+	// until the profiles were made pluggable: the URI is an alias of the basic transform
+	// for these existing licenses, as long as the production transform is not registered.
+	// New licenses are never issued with an alias.
+	legacyProfiles = map[string]Profile{PRODUCTION_PROFILE: legacyProfile{PRODUCTION_PROFILE}}
+)
+
+// RegisterProfile makes an encryption profile available by its URI.
+// The transform of the production profile is provided by EDRLab to certified providers,
+// in a package which registers it from its init function, like a database driver;
+// it then replaces the legacy alias of the production profile URI.
+func RegisterProfile(p Profile) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	if _, dup := profiles[p.URI()]; dup {
+		panic("RegisterProfile called twice for profile " + p.URI())
+	}
+	profiles[p.URI()] = p
+}
+
+// GetProfile returns the profile of an existing license: a registered profile, or else a legacy alias;
+// the default profile if uri is empty
+func GetProfile(uri string) (Profile, error) {
+	if p, err := registeredProfile(uri); err != ErrUnknownProfile {
+		return p, err
+	}
+	if p, ok := legacyProfiles[uri]; ok {
+		return p, nil
+	}
+	return nil, ErrUnknownProfile
+}
+
+// registeredProfile returns a registered profile, the default profile if uri is empty
+func registeredProfile(uri string) (Profile, error) {
+	if uri == "" {
+		uri = DEFAULT_PROFILE
+	}
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	if p, ok := profiles[uri]; ok {
+		return p, nil
+	}
+	return nil, ErrUnknownProfile
+}
+
+// SelectProfile returns the registered profile of a new license: the profile requested in the partial license,
+// or else the profile configured for its provider, or else the configured default profile
+func SelectProfile(requested string, provider string) (Profile, error) {
+	if requested != "" {
+		return registeredProfile(requested)
+	}
+	if uri, ok := config.Config.License.ProviderProfiles[provider]; ok {
+		return registeredProfile(uri)
+	}
+	return registeredProfile(config.Config.License.Profile)
+}
@@ -27,15 +27,9 @@ package license
 
 import (
 	"database/sql"
-	"encoding/json"
 	"errors"
-	"io"
-	"log"
-	"net/http"
-	"strconv"
 	"time"
 
-	"github.com/readium/readium-lcp-server/api"
 	"github.com/readium/readium-lcp-server/config"
 )
 
@@ -43,63 +37,63 @@ var NotFound = errors.New("License not found")
 
 type Store interface {
 	//List() func() (License, error)
-	List(ContentId string, page int, pageNum int) func() (LicenseReport, error)
-	ListAll(page int, pageNum int) func() (LicenseReport, error)
+	List(tenant string, ContentId string, page int, pageNum int) func() (LicenseReport, error)
+	ListAll(tenant string, page int, pageNum int) func() (LicenseReport, error)
+	ListActive(ContentId string) func() (LicenseReport, error)
+	MigrateContentVersion(ContentId string, version int) (int64, error)
 	UpdateRights(l License) error
 	Update(l License) error
 	UpdateLsdStatus(id string, status int32) error
 	Add(l License) error
 	Get(id string) (License, error)
+	ListNotifications(tenant string, status string) func() (Notification, error)
+	ResendNotification(licenseId string) error
+	StartNotifier(conf config.LsdNotify)
 }
 
 type sqlStore struct {
-	db *sql.DB
+	db   *sql.DB
+	wake chan struct{}
 }
 
-// notifyLsdServer informs LSD server of a new License
-// and saves the result of the http request in the DB (using the *Store)
-func notifyLsdServer(l License, s Store) {
-	if config.Config.LsdServer.PublicBaseUrl != "" {
-		var lsdClient = &http.Client{
-			Timeout: time.Second * 10,
-		}
-		pr, pw := io.Pipe()
-		defer pr.Close()
-		go func() {
-			_ = json.NewEncoder(pw).Encode(l)
-			pw.Close() // signal end writing
-		}()
-		req, err := http.NewRequest("PUT", config.Config.LsdServer.PublicBaseUrl+"/licenses", pr)
-
-		// Set credentials on lsd request
-		notifyAuth := config.Config.LsdNotifyAuth
-		if notifyAuth.Username != "" {
-			req.SetBasicAuth(notifyAuth.Username, notifyAuth.Password)
-		}
+//ListAll, lists all licenses in ante-chronological order
+// pageNum starting at 0, an empty tenant lists the licenses of all the tenants
+func (s *sqlStore) ListAll(tenant string, page int, pageNum int) func() (LicenseReport, error) {
+	listLicenses, err := s.db.Query(`SELECT id, user_id, provider, issued, updated,
+	rights_print, rights_copy, rights_start, rights_end, content_fk
+	FROM license
+	WHERE ? = '' OR tenant = ?
+	ORDER BY issued desc LIMIT ? OFFSET ? `, tenant, tenant, page, pageNum*page)
+	if err != nil {
+		return func() (LicenseReport, error) { return LicenseReport{}, err }
+	}
+	return func() (LicenseReport, error) {
+		var l LicenseReport
+		l.User = UserInfo{}
+		l.Rights = new(UserRights)
+		if listLicenses.Next() {
+			err := listLicenses.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
+				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId)
 
-		req.Header.Add("Content-Type", api.ContentType_LCP_JSON)
+			if err != nil {
+				return l, err
+			}
 
-		response, err := lsdClient.Do(req)
-		if err != nil {
-			log.Println("Error Notify LsdServer of new License (" + l.Id + "):" + err.Error())
-			_ = s.UpdateLsdStatus(l.Id, -1)
 		} else {
-			defer req.Body.Close()
-			_ = s.UpdateLsdStatus(l.Id, int32(response.StatusCode))
-			if response.StatusCode != 201 { //bad request or server error
-				log.Println("Notify LsdServer of new License (" + l.Id + ") = " + strconv.Itoa(response.StatusCode))
-			}
+			listLicenses.Close()
+			err = NotFound
 		}
+		return l, err
 	}
 }
 
-//ListAll, lists all licenses in ante-chronological order
-// pageNum starting at 0
-func (s *sqlStore) ListAll(page int, pageNum int) func() (LicenseReport, error) {
+//List() list licenses for a given ContentId
+//pageNum starting at 0, an empty tenant lists the licenses of all the tenants
+func (s *sqlStore) List(tenant string, ContentId string, page int, pageNum int) func() (LicenseReport, error) {
 	listLicenses, err := s.db.Query(`SELECT id, user_id, provider, issued, updated,
 	rights_print, rights_copy, rights_start, rights_end, content_fk
 	FROM license
-	ORDER BY issued desc LIMIT ? OFFSET ? `, page, pageNum*page)
+	WHERE content_fk=? AND (? = '' OR tenant = ?) LIMIT ? OFFSET ? `, ContentId, tenant, tenant, page, pageNum*page)
 	if err != nil {
 		return func() (LicenseReport, error) { return LicenseReport{}, err }
 	}
@@ -108,13 +102,12 @@ func (s *sqlStore) ListAll(page int, pageNum int) func() (LicenseReport, error)
 		l.User = UserInfo{}
 		l.Rights = new(UserRights)
 		if listLicenses.Next() {
+
 			err := listLicenses.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
 				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId)
-
 			if err != nil {
 				return l, err
 			}
-
 		} else {
 			listLicenses.Close()
 			err = NotFound
@@ -123,13 +116,12 @@ func (s *sqlStore) ListAll(page int, pageNum int) func() (LicenseReport, error)
 	}
 }
 
-//List() list licenses for a given ContentId
-//pageNum starting at 0
-func (s *sqlStore) List(ContentId string, page int, pageNum int) func() (LicenseReport, error) {
+//ListActive lists the licenses of a given ContentId which have not expired
+func (s *sqlStore) ListActive(ContentId string) func() (LicenseReport, error) {
 	listLicenses, err := s.db.Query(`SELECT id, user_id, provider, issued, updated,
 	rights_print, rights_copy, rights_start, rights_end, content_fk
 	FROM license
-	WHERE content_fk=? LIMIT ? OFFSET ? `, ContentId, page, pageNum*page)
+	WHERE content_fk=? AND (rights_end IS NULL OR rights_end > ?)`, ContentId, time.Now())
 	if err != nil {
 		return func() (LicenseReport, error) { return LicenseReport{}, err }
 	}
@@ -138,7 +130,6 @@ func (s *sqlStore) List(ContentId string, page int, pageNum int) func() (License
 		l.User = UserInfo{}
 		l.Rights = new(UserRights)
 		if listLicenses.Next() {
-
 			err := listLicenses.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
 				&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End, &l.ContentId)
 			if err != nil {
@@ -151,6 +142,38 @@ func (s *sqlStore) List(ContentId string, page int, pageNum int) func() (License
 		return l, err
 	}
 }
+
+//MigrateContentVersion binds the licenses of a given ContentId issued for an older version to version
+//it returns the number of licenses migrated, their content key changes when they are next fetched.
+//The License Status server is notified of the migrated licenses, so that reading systems fetch them again.
+func (s *sqlStore) MigrateContentVersion(ContentId string, version int) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	const older = "content_fk=? AND (content_version IS NULL OR content_version < ?)"
+	if config.Config.LsdServer.PublicBaseUrl != "" {
+		err = queueNotifications(tx, older, ContentId, version)
+	}
+	var migrated int64
+	if err == nil {
+		var result sql.Result
+		result, err = tx.Exec("UPDATE license SET content_version=?, updated=? WHERE "+older, version, time.Now(), ContentId, version)
+		if err == nil {
+			migrated, err = result.RowsAffected()
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.wakeNotifier()
+	return migrated, nil
+}
+
 func (s *sqlStore) UpdateRights(l License) error {
 	result, err := s.db.Exec("UPDATE license SET rights_print=?, rights_copy=?, rights_start=?, rights_end=?,updated=?  WHERE id=?",
 		l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End, time.Now(), l.Id)
@@ -162,26 +185,45 @@ func (s *sqlStore) UpdateRights(l License) error {
 	}
 	return err
 }
+
+// Add saves a new license, and its notification to the License Status server in the same transaction:
+// the notifier sends it even if the server stops meanwhile
 func (s *sqlStore) Add(l License) error {
-	_, err := s.db.Exec(`INSERT INTO license (id, user_id, provider, issued, updated,
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO license (id, user_id, provider, issued, updated,
 	rights_print, rights_copy, rights_start, rights_end,
-	user_key_hint, user_key_hash, user_key_algorithm, content_fk) 
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?,  ?, ?, ?, ?, ?)`,
+	user_key_hint, user_key_hash, user_key_algorithm, content_fk, content_version, profile, tenant) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?,  ?, ?, ?, ?, ?, ?, ?, ?)`,
 		l.Id, l.User.Id, l.Provider, l.Issued, nil, l.Rights.Print, l.Rights.Copy, l.Rights.Start,
 		l.Rights.End, l.Encryption.UserKey.Hint, l.Encryption.UserKey.Check,
-		l.Encryption.UserKey.Key.Algorithm, l.ContentId)
-	go notifyLsdServer(l, s)
-	return err
+		l.Encryption.UserKey.Key.Algorithm, l.ContentId, contentVersion(l.ContentVersion), l.Encryption.Profile, l.Tenant)
+	if err == nil && config.Config.LsdServer.PublicBaseUrl != "" {
+		now := time.Now()
+		_, err = tx.Exec("INSERT INTO lsd_notification (license_id, status, attempts, next_attempt, created) VALUES (?, ?, 0, ?, ?)",
+			l.Id, NOTIFICATION_PENDING, now, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	s.wakeNotifier()
+	return nil
 }
 
 func (s *sqlStore) Update(l License) error {
 	_, err := s.db.Exec(`UPDATE license SET user_id=?,provider=?,issued=?,updated=?,
 				rights_print=?,	rights_copy=?,	rights_start=?,	rights_end=?,
-				user_key_hint=?, content_fk =?
+				user_key_hint=?, content_fk =?, content_version=?
 				WHERE id=?`, // user_key_hash=?, user_key_algorithm=?,
 		l.User.Id, l.Provider, l.Issued, time.Now(),
 		l.Rights.Print, l.Rights.Copy, l.Rights.Start, l.Rights.End,
-		l.Encryption.UserKey.Hint, l.ContentId,
+		l.Encryption.UserKey.Hint, l.ContentId, contentVersion(l.ContentVersion),
 		l.Id)
 
 	return err
@@ -202,13 +244,22 @@ func (s *sqlStore) Get(id string) (License, error) {
 	createForeigns(&l)
 
 	row := s.db.QueryRow(`SELECT id, user_id, provider, issued, updated, rights_print, rights_copy,
-	rights_start, rights_end, user_key_hint, user_key_hash, user_key_algorithm, content_fk FROM license
+	rights_start, rights_end, user_key_hint, user_key_hash, user_key_algorithm, content_fk, content_version, profile, tenant FROM license
 	where id = ?`, id)
 
+	var version sql.NullInt64
+	var profile, tenant sql.NullString
 	err := row.Scan(&l.Id, &l.User.Id, &l.Provider, &l.Issued, &l.Updated,
 		&l.Rights.Print, &l.Rights.Copy, &l.Rights.Start, &l.Rights.End,
 		&l.Encryption.UserKey.Hint, &l.Encryption.UserKey.Check, &l.Encryption.UserKey.Key.Algorithm,
-		&l.ContentId)
+		&l.ContentId, &version, &profile, &tenant)
+	l.ContentVersion = contentVersion(int(version.Int64))
+	l.Tenant = tenant.String
+	// licenses issued before the profile was recorded used the basic user key transform
+	l.Encryption.Profile = BASIC_PROFILE
+	if profile.Valid {
+		l.Encryption.Profile = profile.String
+	}
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -221,13 +272,52 @@ func (s *sqlStore) Get(id string) (License, error) {
 	return l, nil
 }
 
+// contentVersion returns the version of the content of a license,
+// licenses issued before content was versioned are bound to the first version
+func contentVersion(version int) int {
+	if version <= 0 {
+		return 1
+	}
+	return version
+}
+
 func NewSqlStore(db *sql.DB) (Store, error) {
 	_, err := db.Exec(tableDef)
 	if err != nil {
 		return nil, err
 	}
+	if _, err = db.Exec("SELECT content_version FROM license LIMIT 1"); err != nil {
+		_, err = db.Exec("ALTER TABLE license ADD COLUMN content_version int DEFAULT NULL")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err = db.Exec("SELECT profile FROM license LIMIT 1"); err != nil {
+		_, err = db.Exec("ALTER TABLE license ADD COLUMN profile varchar(255) DEFAULT NULL")
+		if err != nil {
+			return nil, err
+		}
+	}
+	// licenses issued before tenants were configured belong to the default tenant
+	if _, err = db.Exec("SELECT tenant FROM license LIMIT 1"); err != nil {
+		_, err = db.Exec("ALTER TABLE license ADD COLUMN tenant varchar(255) DEFAULT NULL")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err = db.Exec(notificationTableDef); err != nil {
+		return nil, err
+	}
+	// the notifications which failed before the outbox are sent again
+	_, err = db.Exec(`INSERT INTO lsd_notification (license_id, status, attempts, next_attempt, created)
+	SELECT id, ?, 0, ?, ? FROM license
+	WHERE (lsd_status = -1 OR lsd_status >= 500) AND id NOT IN (SELECT license_id FROM lsd_notification)`,
+		NOTIFICATION_PENDING, time.Now(), time.Now())
+	if err != nil {
+		return nil, err
+	}
 
-	return &sqlStore{db}, nil
+	return &sqlStore{db, make(chan struct{}, 1)}, nil
 }
 
 const tableDef = `CREATE TABLE IF NOT EXISTS license (
@@ -244,4 +334,7 @@ const tableDef = `CREATE TABLE IF NOT EXISTS license (
 	user_key_hash varchar(64) NOT NULL,
 	user_key_algorithm varchar(255) NOT NULL,
 	content_fk varchar(255) NOT NULL,
-	lsd_status integer default 0)`
+	lsd_status integer default 0,
+	content_version int DEFAULT NULL,
+	profile varchar(255) DEFAULT NULL,
+	tenant varchar(255) DEFAULT NULL)`
@@ -45,7 +45,7 @@ func TestStoreInit(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	it := st.List()
+	it := st.ListAll("", 10, 0)
 	if _, err := it(); err != NotFound {
 		t.Errorf("Didn't expect the iterator to have a value")
 	}
@@ -63,7 +63,10 @@ func TestStoreAdd(t *testing.T) {
 	}
 
 	l := New()
-	Prepare(&l)
+	l.User.Id = "user"
+	l.Provider = "provider"
+	l.ContentId = "content"
+	l.Encryption.UserKey.Check = []byte("check")
 	err = st.Add(l)
 	if err != nil {
 		t.Fatal(err)
@@ -74,6 +77,8 @@ func TestStoreAdd(t *testing.T) {
 		t.Error(err)
 	}
 
+	// the signature is not stored, licenses are signed when they are fetched
+	l2.Signature = l.Signature
 	js1, err := sign.Canon(l)
 	js2, err2 := sign.Canon(l2)
 	if err != nil || err2 != nil || !bytes.Equal(js1, js2) {
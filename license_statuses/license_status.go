@@ -60,4 +60,5 @@ type LicenseStatus struct {
 	PotentialRights   *PotentialRights     `json:"potential_rights,omitempty"`
 	Events            []transactions.Event `json:"events,omitempty"`
 	CurrentEndLicense *time.Time           `json:"-"`
+	Tenant            string               `json:"-"`
 }
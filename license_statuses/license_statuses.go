@@ -28,6 +28,7 @@ package licensestatuses
 import (
 	"database/sql"
 	"errors"
+	"log"
 	"time"
 
 	"github.com/readium/readium-lcp-server/status"
@@ -35,12 +36,23 @@ import (
 
 var NotFound = errors.New("License Status not found")
 
+// StatusChanged is returned when the status of a license status changed since it was read
+var StatusChanged = errors.New("License Status changed meanwhile")
+
 type LicenseStatuses interface {
 	//Get(id int) (LicenseStatus, error)
 	Add(ls LicenseStatus) error
-	List(deviceLimit int64, limit int64, offset int64) func() (LicenseStatus, error)
+	List(tenant string, deviceLimit int64, limit int64, offset int64) func() (LicenseStatus, error)
 	GetByLicenseId(id string) (*LicenseStatus, error)
 	Update(ls LicenseStatus) error
+	Transition(ls LicenseStatus, from string, record func(tx *sql.Tx) error) error
+	QueueSync(licenseRef string) error
+	StartSync(push func(ls LicenseStatus) error)
+}
+
+// execer runs a statement in the database or in a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
 type dbLicenseStatuses struct {
@@ -50,6 +62,7 @@ type dbLicenseStatuses struct {
 	list           *sql.Stmt
 	getbylicenseid *sql.Stmt
 	update         *sql.Stmt
+	wake           chan struct{}
 }
 
 // //Get gets license status by id
@@ -75,7 +88,7 @@ type dbLicenseStatuses struct {
 
 //Add adds license status to database
 func (i dbLicenseStatuses) Add(ls LicenseStatus) error {
-	add, err := i.db.Prepare("INSERT INTO license_status (status, license_updated, status_updated, device_count, potential_rights_end, license_ref,  rights_end) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	add, err := i.db.Prepare("INSERT INTO license_status (status, license_updated, status_updated, device_count, potential_rights_end, license_ref,  rights_end, tenant) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -88,7 +101,7 @@ func (i dbLicenseStatuses) Add(ls LicenseStatus) error {
 		if ls.PotentialRights != nil && ls.PotentialRights.End != nil && !(*ls.PotentialRights.End).IsZero() {
 			end = *ls.PotentialRights.End
 		}
-		_, err = add.Exec(statusDB, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, &end, ls.LicenseRef, ls.CurrentEndLicense)
+		_, err = add.Exec(statusDB, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, &end, ls.LicenseRef, ls.CurrentEndLicense, ls.Tenant)
 	}
 
 	return err
@@ -96,8 +109,9 @@ func (i dbLicenseStatuses) Add(ls LicenseStatus) error {
 
 //List gets license statuses which have devices count more than devices limit
 //input parameters: limit - how much license statuses need to get, offset - from what position need to start
-func (i dbLicenseStatuses) List(deviceLimit int64, limit int64, offset int64) func() (LicenseStatus, error) {
-	rows, err := i.list.Query(deviceLimit, limit, offset)
+//an empty tenant lists the license statuses of all the tenants
+func (i dbLicenseStatuses) List(tenant string, deviceLimit int64, limit int64, offset int64) func() (LicenseStatus, error) {
+	rows, err := i.list.Query(deviceLimit, tenant, tenant, limit, offset)
 	if err != nil {
 		return func() (LicenseStatus, error) { return LicenseStatus{}, err }
 	}
@@ -129,12 +143,14 @@ func (i dbLicenseStatuses) GetByLicenseId(licenseFk string) (*LicenseStatus, err
 	var potentialRightsEnd *time.Time
 	var licenseUpdate *time.Time
 	var statusUpdate *time.Time
+	var tenant sql.NullString
 
 	row := i.getbylicenseid.QueryRow(licenseFk)
-	err := row.Scan(&ls.Id, &statusDB, &licenseUpdate, &statusUpdate, &ls.DeviceCount, &potentialRightsEnd, &ls.LicenseRef, &ls.CurrentEndLicense)
+	err := row.Scan(&ls.Id, &statusDB, &licenseUpdate, &statusUpdate, &ls.DeviceCount, &potentialRightsEnd, &ls.LicenseRef, &ls.CurrentEndLicense, &tenant)
 
 	if err == nil {
 		status.GetStatus(statusDB, &ls.Status)
+		ls.Tenant = tenant.String
 
 		ls.Updated = new(Updated)
 
@@ -158,6 +174,36 @@ func (i dbLicenseStatuses) GetByLicenseId(licenseFk string) (*LicenseStatus, err
 
 //Update updates license status
 func (i dbLicenseStatuses) Update(ls LicenseStatus) error {
+	return update(i.db, ls, "")
+}
+
+//Transition updates a license status whose status is still from, and records its events with record
+//in the same database transaction: nothing is saved if the status changed meanwhile or if record fails
+func (i dbLicenseStatuses) Transition(ls LicenseStatus, from string, record func(tx *sql.Tx) error) error {
+	fromInt, err := status.SetStatus(from)
+	if err != nil {
+		return err
+	}
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = update(tx, ls, " AND status=?", fromInt)
+	if err == NotFound {
+		err = StatusChanged
+	}
+	if err == nil && record != nil {
+		err = record(tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//update updates a license status matching the condition cond on its columns
+func update(db execer, ls LicenseStatus, cond string, args ...interface{}) error {
 
 	statusInt, err := status.SetStatus(ls.Status)
 	if err != nil {
@@ -171,8 +217,8 @@ func (i dbLicenseStatuses) Update(ls LicenseStatus) error {
 	}
 
 	var result sql.Result
-	result, err = i.db.Exec("UPDATE license_status SET status=?, license_updated=?, status_updated=?, device_count=?,potential_rights_end=?,  rights_end=?  WHERE id=?",
-		statusInt, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, potentialRightsEnd, ls.CurrentEndLicense, ls.Id)
+	result, err = db.Exec("UPDATE license_status SET status=?, license_updated=?, status_updated=?, device_count=?,potential_rights_end=?,  rights_end=?  WHERE id=?"+cond,
+		append([]interface{}{statusInt, ls.Updated.License, ls.Updated.Status, ls.DeviceCount, potentialRightsEnd, ls.CurrentEndLicense, ls.Id}, args...)...)
 
 	if err == nil {
 		if r, _ := result.RowsAffected(); r == 0 {
@@ -188,20 +234,36 @@ func Open(db *sql.DB) (l LicenseStatuses, err error) {
 	if err != nil {
 		return
 	}
+	_, err = db.Exec(syncTableDef)
+	if err != nil {
+		return
+	}
+	// license statuses created before tenants were configured belong to the default tenant
+	if _, err = db.Exec("SELECT tenant FROM license_status LIMIT 1"); err != nil {
+		_, err = db.Exec("ALTER TABLE license_status ADD COLUMN tenant varchar(255) DEFAULT NULL")
+		if err != nil {
+			return
+		}
+	}
+	// a license has a single status document, even if the License server notifies it again
+	if _, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS license_ref_unique_index on license_status (license_ref)"); err != nil {
+		log.Println("Duplicate license statuses, license_ref is not unique: " + err.Error())
+	}
 	get, err := db.Prepare("SELECT * FROM license_status WHERE id = ? LIMIT 1")
 	if err != nil {
 		return
 	}
 
 	list, err := db.Prepare(`SELECT status, license_updated, status_updated, device_count, license_ref FROM license_status WHERE device_count >= ?
-		ORDER BY id DESC LIMIT ? OFFSET ?`)
+		AND (? = '' OR tenant = ?) ORDER BY id DESC LIMIT ? OFFSET ?`)
 
-	getbylicenseid, err := db.Prepare("SELECT * FROM license_status where license_ref = ?")
+	getbylicenseid, err := db.Prepare(`SELECT id, status, license_updated, status_updated, device_count, potential_rights_end, license_ref, rights_end, tenant
+		FROM license_status where license_ref = ?`)
 
 	if err != nil {
 		return
 	}
-	l = dbLicenseStatuses{db, get, nil, list, getbylicenseid, nil}
+	l = dbLicenseStatuses{db, get, nil, list, getbylicenseid, nil, make(chan struct{}, 1)}
 	return
 }
 
@@ -213,6 +275,7 @@ const tableDef = `CREATE TABLE IF NOT EXISTS license_status (
   device_count int(11) DEFAULT NULL,
   potential_rights_end datetime DEFAULT NULL,
   license_ref varchar(255) NOT NULL,
-  rights_end datetime DEFAULT NULL  
+  rights_end datetime DEFAULT NULL,
+  tenant varchar(255) DEFAULT NULL
 );
 CREATE INDEX IF NOT EXISTS license_ref_index on license_status (license_ref);`
@@ -0,0 +1,193 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package licensestatuses
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+var SyncNotFound = errors.New("License sync not found")
+
+// SyncRejected is returned by the function pushing the end of a license when the LCP Server will never accept it
+var SyncRejected = errors.New("The LCP Server rejected the end of the license")
+
+// timing of the license syncs: a failed attempt is retried after syncRetryDelay, doubled after each attempt up to syncMaxRetryDelay
+const (
+	syncPollInterval  = 10 * time.Second
+	syncRetryDelay    = 30 * time.Second
+	syncMaxRetryDelay = time.Hour
+)
+
+const syncTableDef = `CREATE TABLE IF NOT EXISTS license_sync (
+	license_ref varchar(255) PRIMARY KEY,
+	attempts int NOT NULL DEFAULT 0,
+	next_attempt datetime NOT NULL,
+	error text DEFAULT NULL,
+	created datetime NOT NULL,
+	updated datetime DEFAULT NULL
+);
+CREATE INDEX IF NOT EXISTS license_sync_next_index on license_sync (next_attempt);`
+
+// QueueSync queues a license whose end in the LCP Server may differ from the end of its saved license status,
+// e.g. when the license was updated but the change of its status could not be saved.
+// The sync sends the end of the license status as it is saved when the sync runs, not as it is now.
+func (i dbLicenseStatuses) QueueSync(licenseRef string) error {
+	now := time.Now()
+	queued, err := i.requeueSync(licenseRef, now)
+	if err == nil && !queued {
+		_, err = i.db.Exec("INSERT INTO license_sync (license_ref, attempts, next_attempt, created) VALUES (?, 0, ?, ?)", licenseRef, now, now)
+		// the license was queued meanwhile
+		if err != nil {
+			if queued, _ = i.requeueSync(licenseRef, now); queued {
+				err = nil
+			}
+		}
+	}
+	if err == nil {
+		i.wakeSync()
+	}
+	return err
+}
+
+// requeueSync makes a queued license due at now with a new series of attempts, and tells if it was queued
+func (i dbLicenseStatuses) requeueSync(licenseRef string, now time.Time) (bool, error) {
+	result, err := i.db.Exec("UPDATE license_sync SET attempts=0, next_attempt=?, updated=? WHERE license_ref=?", now, now, licenseRef)
+	if err != nil {
+		return false, err
+	}
+	r, _ := result.RowsAffected()
+	return r > 0, nil
+}
+
+// StartSync starts the worker which sends the end of the queued licenses to the LCP Server with push.
+// A failed attempt is retried with a growing delay, until push succeeds or returns SyncRejected.
+func (i dbLicenseStatuses) StartSync(push func(ls LicenseStatus) error) {
+	go func() {
+		for {
+			licenseRef, err := i.nextSync()
+			if err != nil {
+				if err != SyncNotFound {
+					log.Println("Error fetching the next license to sync with the LCP Server: " + err.Error())
+				}
+				select {
+				case <-i.wake:
+				case <-time.After(syncPollInterval):
+				}
+				continue
+			}
+			i.sync(licenseRef, push)
+		}
+	}()
+}
+
+func (i dbLicenseStatuses) wakeSync() {
+	select {
+	case i.wake <- struct{}{}:
+	default: // the worker is busy, it looks for the next license when it is done
+	}
+}
+
+// nextSync claims the next license to sync which is due:
+// its next attempt is set in advance, so that another server sharing the database does not sync it meanwhile
+func (i dbLicenseStatuses) nextSync() (string, error) {
+	for {
+		var licenseRef string
+		var attempts int
+		now := time.Now()
+		err := i.db.QueryRow("SELECT license_ref, attempts FROM license_sync WHERE next_attempt <= ? ORDER BY next_attempt LIMIT 1", now).Scan(&licenseRef, &attempts)
+		if err == sql.ErrNoRows {
+			return "", SyncNotFound
+		}
+		if err != nil {
+			return "", err
+		}
+		result, err := i.db.Exec("UPDATE license_sync SET attempts=?, next_attempt=?, updated=? WHERE license_ref=? AND attempts=?",
+			attempts+1, now.Add(syncDelay(attempts+1)), now, licenseRef, attempts)
+		if err != nil {
+			return "", err
+		}
+		if r, _ := result.RowsAffected(); r == 1 {
+			return licenseRef, nil
+		}
+	}
+}
+
+// syncDelay returns the delay before the attempt following a given attempt
+func syncDelay(attempt int) time.Duration {
+	delay := syncRetryDelay
+	for n := 1; n < attempt && delay < syncMaxRetryDelay; n++ {
+		delay *= 2
+	}
+	if delay > syncMaxRetryDelay {
+		delay = syncMaxRetryDelay
+	}
+	return delay
+}
+
+// sync pushes the end of a saved license status, then removes the license from the queue
+// unless its license status changed meanwhile, in which case the new end is pushed again
+func (i dbLicenseStatuses) sync(licenseRef string, push func(ls LicenseStatus) error) {
+	ls, err := i.GetByLicenseId(licenseRef)
+	if err == sql.ErrNoRows {
+		err = SyncRejected
+	}
+	if err == nil {
+		err = push(*ls)
+	}
+	if err == nil {
+		var saved *LicenseStatus
+		if saved, err = i.GetByLicenseId(licenseRef); err == nil && !sameTime(saved.CurrentEndLicense, ls.CurrentEndLicense) {
+			if err = i.QueueSync(licenseRef); err == nil {
+				return
+			}
+		}
+	}
+	if err == nil || err == SyncRejected {
+		if err == SyncRejected {
+			log.Println("The end of license " + licenseRef + " can't be synced with the LCP Server")
+		}
+		if _, err = i.db.Exec("DELETE FROM license_sync WHERE license_ref=?", licenseRef); err != nil {
+			log.Println("Error removing the sync of license " + licenseRef + ": " + err.Error())
+		}
+		return
+	}
+
+	log.Println("Error syncing the end of license " + licenseRef + " with the LCP Server: " + err.Error())
+	if _, dbErr := i.db.Exec("UPDATE license_sync SET error=? WHERE license_ref=?", err.Error(), licenseRef); dbErr != nil {
+		log.Println("Error updating the sync of license " + licenseRef + ": " + dbErr.Error())
+	}
+}
+
+// sameTime tells if two optional times are both unset or equal
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -27,6 +27,7 @@ package apilsd
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"io"
@@ -47,15 +48,18 @@ import (
 	"github.com/readium/readium-lcp-server/logging"
 	"github.com/readium/readium-lcp-server/problem"
 	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/tenant"
 	"github.com/readium/readium-lcp-server/transactions"
 )
 
 type Server interface {
 	Transactions() transactions.Transactions
 	LicenseStatuses() licensestatuses.LicenseStatuses
+	Tenants() *tenant.Tenants
 }
 
 //CreateLicenseStatusDocument create license status and add it to database
+//the License server may send a license again: its status document is then kept, with the date the license was updated
 func CreateLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Server) {
 	var lic license.License
 	err := apilcp.DecodeJsonLicense(r, &lic)
@@ -65,11 +69,32 @@ func CreateLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Serve
 		return
 	}
 
+	if existing, err := s.LicenseStatuses().GetByLicenseId(lic.Id); err != sql.ErrNoRows {
+		if err == nil {
+			err = updateLicenseDate(existing, lic, s)
+		}
+		if err != nil {
+			problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	var ls licensestatuses.LicenseStatus
 	makeLicenseStatus(lic, &ls)
+	// the license status belongs to the tenant of the request, or else to the tenant of the provider of the license
+	if ls.Tenant = s.Tenants().FromRequest(r).Id; ls.Tenant == "" {
+		ls.Tenant = s.Tenants().ByProvider(lic.Provider).Id
+	}
 
 	err = s.LicenseStatuses().Add(ls)
 	if err != nil {
+		// the same license was sent twice at once
+		if _, getErr := s.LicenseStatuses().GetByLicenseId(lic.Id); getErr == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
@@ -78,6 +103,16 @@ func CreateLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Serve
 	w.WriteHeader(http.StatusCreated)
 }
 
+//updateLicenseDate records that the license of a status document was updated after it was last sent,
+//so that reading systems fetch it again
+func updateLicenseDate(ls *licensestatuses.LicenseStatus, lic license.License, s Server) error {
+	if lic.Updated == nil || (ls.Updated.License != nil && !lic.Updated.After(*ls.Updated.License)) {
+		return nil
+	}
+	ls.Updated.License = lic.Updated
+	return s.LicenseStatuses().Update(*ls)
+}
+
 //GetLicenseStatusDocument get license status from database by licese id
 //checks potential_rights_end and fill it
 func GetLicenseStatusDocument(w http.ResponseWriter, r *http.Request, s Server) {
@@ -267,6 +302,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 
 	//check & set the status of license status according to its current value
+	currentStatus := licenseStatus.Status
 	switch licenseStatus.Status {
 	case status.STATUS_RETURNED:
 		problem.Error(w, r, problem.Problem{Detail: "License has been already returned"}, http.StatusForbidden)
@@ -310,14 +346,7 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 	//create event for lending return
 	event := makeEvent(status.TYPE_RETURN, deviceName, deviceId, licenseStatus.Id)
 
-	err = s.Transactions().Add(*event, 2)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError))
-		return
-	}
-
-	//update license using LCP Server
+	//update license using LCP Server, the event and the license status are saved once it is updated
 	httpStatusCode, errorr := updateLicense(event.Timestamp, licenseFk)
 	if errorr != nil {
 		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, http.StatusInternalServerError)
@@ -337,10 +366,14 @@ func LendingReturn(w http.ResponseWriter, r *http.Request, s Server) {
 	licenseStatus.Updated.Status = &event.Timestamp
 	licenseStatus.Updated.License = &event.Timestamp
 
-	err = s.LicenseStatuses().Update(*licenseStatus)
+	err = s.LicenseStatuses().Transition(*licenseStatus, currentStatus, func(tx *sql.Tx) error {
+		return s.Transactions().AddTx(tx, *event, 2)
+	})
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(http.StatusInternalServerError))
+		syncLicense(licenseFk, s)
+		code := transitionErrorStatus(err)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, code)
+		logging.WriteToFile(complianceTestNumber, RETURN_LICENSE, strconv.Itoa(code))
 		return
 	}
 
@@ -474,15 +507,9 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	}
 
 	event := makeEvent(status.TYPE_RENEW, deviceName, deviceId, licenseStatus.Id)
+	currentStatus := licenseStatus.Status
 
-	err = s.Transactions().Add(*event, 3)
-	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError))
-		return
-	}
-
-	//update license using LCP Server
+	//update license using LCP Server, the event and the license status are saved once it is updated
 	httpStatusCode, errorr := updateLicense(suggestedEnd, licenseFk)
 	if errorr != nil {
 		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, http.StatusInternalServerError)
@@ -503,10 +530,14 @@ func LendingRenewal(w http.ResponseWriter, r *http.Request, s Server) {
 	licenseStatus.Updated.License = &event.Timestamp
 	licenseStatus.Status = status.STATUS_ACTIVE
 
-	err = s.LicenseStatuses().Update(*licenseStatus)
+	err = s.LicenseStatuses().Transition(*licenseStatus, currentStatus, func(tx *sql.Tx) error {
+		return s.Transactions().AddTx(tx, *event, 3)
+	})
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(http.StatusInternalServerError))
+		syncLicense(licenseFk, s)
+		code := transitionErrorStatus(err)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, code)
+		logging.WriteToFile(complianceTestNumber, RENEW_LICENSE, strconv.Itoa(code))
 		return
 	}
 
@@ -578,7 +609,7 @@ func FilterLicenseStatuses(w http.ResponseWriter, r *http.Request, s Server) {
 
 	licenseStatuses := make([]licensestatuses.LicenseStatus, 0)
 
-	fn := s.LicenseStatuses().List(devicesLimit, perPage, page*perPage)
+	fn := s.LicenseStatuses().List(s.Tenants().FromRequest(r).Id, devicesLimit, perPage, page*perPage)
 	for it, err := fn(); err == nil; it, err = fn() {
 		licenseStatuses = append(licenseStatuses, it)
 	}
@@ -630,6 +661,10 @@ func ListRegisteredDevices(w http.ResponseWriter, r *http.Request, s Server) {
 		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
 		return
 	}
+	if !s.Tenants().FromRequest(r).Owns(licenseStatus.Tenant) {
+		problem.NotFoundHandler(w, r)
+		return
+	}
 
 	registeredDevicesList := transactions.RegisteredDevicesList{Devices: make([]transactions.Device, 0), Id: licenseStatus.LicenseRef}
 
@@ -664,10 +699,9 @@ func CancelLicenseStatus(w http.ResponseWriter, r *http.Request, s Server) {
 		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError))
 		return
 	}
-
-	if licenseStatus.Status != status.STATUS_READY {
-		problem.Error(w, r, problem.Problem{Detail: "The new status is not compatible with current status"}, http.StatusBadRequest)
-		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusBadRequest))
+	if !s.Tenants().FromRequest(r).Owns(licenseStatus.Tenant) {
+		problem.NotFoundHandler(w, r)
+		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusNotFound))
 		return
 	}
 
@@ -679,9 +713,19 @@ func CancelLicenseStatus(w http.ResponseWriter, r *http.Request, s Server) {
 		return
 	}
 
+	//a license is cancelled before it is registered by a device, it may be revoked until it is returned or expires
+	cancel := parsedLs.Status == status.STATUS_CANCELLED && licenseStatus.Status == status.STATUS_READY
+	revoke := parsedLs.Status == status.STATUS_REVOKED && (licenseStatus.Status == status.STATUS_READY || licenseStatus.Status == status.STATUS_ACTIVE)
+	if !cancel && !revoke {
+		problem.Error(w, r, problem.Problem{Detail: "The new status is not compatible with current status"}, http.StatusBadRequest)
+		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusBadRequest))
+		return
+	}
+
 	currentTime := time.Now()
+	currentStatus := licenseStatus.Status
 
-	//update license using LCP Server
+	//update license using LCP Server, the license status is saved once it is updated
 	httpStatusCode, errorr := updateLicense(currentTime, licenseFk)
 	if errorr != nil {
 		problem.Error(w, r, problem.Problem{Detail: errorr.Error()}, http.StatusInternalServerError)
@@ -701,10 +745,12 @@ func CancelLicenseStatus(w http.ResponseWriter, r *http.Request, s Server) {
 	licenseStatus.Updated.Status = &currentTime
 	licenseStatus.Updated.License = &currentTime
 
-	err = s.LicenseStatuses().Update(*licenseStatus)
+	err = s.LicenseStatuses().Transition(*licenseStatus, currentStatus, nil)
 	if err != nil {
-		problem.Error(w, r, problem.Problem{Detail: err.Error()}, http.StatusInternalServerError)
-		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(http.StatusInternalServerError))
+		syncLicense(licenseFk, s)
+		code := transitionErrorStatus(err)
+		problem.Error(w, r, problem.Problem{Detail: err.Error()}, code)
+		logging.WriteToFile(complianceTestNumber, CANCEL_REVOKE_LICENSE, strconv.Itoa(code))
 		return
 	}
 
@@ -776,10 +822,10 @@ func getEvents(ls *licensestatuses.LicenseStatus, s Server) error {
 	return err
 }
 
-//makeLinks creates and adds links to the license status
-func makeLinks(ls *licensestatuses.LicenseStatus) {
+//makeLinks creates and adds links to the license status, the license link is the one of the tenant t
+func makeLinks(ls *licensestatuses.LicenseStatus, t *tenant.Tenant) {
 	lsdBaseUrl := config.Config.LsdServer.PublicBaseUrl
-	licenseLinkUrl := config.Config.LsdServer.LicenseLinkUrl
+	licenseLinkUrl := t.LicenseLinkUrl
 	lcpBaseUrl := config.Config.LcpServer.PublicBaseUrl
 	//frontendBaseUrl := config.Config.FrontendServer.PublicBaseUrl
 	registerAvailable := config.Config.LicenseStatus.Register
@@ -888,14 +934,55 @@ func updateLicense(timeEnd time.Time, licenseRef string) (int, error) {
 	return 0, err
 }
 
+//syncLicense queues a license updated in the LCP Server whose license status could not be saved:
+//the end of its license status, as saved when the queue is processed, is sent back to the LCP Server.
+//When the status changed meanwhile, this is the end set by the request which changed it, and not the previous one.
+func syncLicense(licenseRef string, s Server) {
+	if err := s.LicenseStatuses().QueueSync(licenseRef); err != nil {
+		log.Println("Error queuing the sync of license " + licenseRef + " with the LCP Server: " + err.Error())
+	}
+}
+
+//PushLicenseEnd sets the end of a license in the LCP Server to the end of its license status,
+//it is the function of the worker which processes the licenses queued by syncLicense
+func PushLicenseEnd(ls licensestatuses.LicenseStatus) error {
+	if ls.CurrentEndLicense == nil || ls.CurrentEndLicense.IsZero() {
+		return licensestatuses.SyncRejected
+	}
+	httpStatusCode, err := updateLicense(*ls.CurrentEndLicense, ls.LicenseRef)
+	if err != nil {
+		return err
+	}
+	switch {
+	case httpStatusCode == http.StatusOK || httpStatusCode == http.StatusPartialContent:
+		return nil
+	case httpStatusCode >= 400 && httpStatusCode < 500 && httpStatusCode != http.StatusRequestTimeout && httpStatusCode != http.StatusTooManyRequests:
+		return licensestatuses.SyncRejected
+	}
+	return errors.New("LCP license PATCH returned HTTP error code " + strconv.Itoa(httpStatusCode))
+}
+
+//transitionErrorStatus returns the HTTP status of an error saving the change of a license status
+func transitionErrorStatus(err error) int {
+	if err == licensestatuses.StatusChanged {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 //fillLicenseStatus fills object 'links' and field 'message' in license status
 func fillLicenseStatus(ls *licensestatuses.LicenseStatus, r *http.Request, s Server) error {
-	makeLinks(ls)
+	// the links of a tenant which is no longer configured are the default ones
+	t, err := s.Tenants().Get(ls.Tenant)
+	if err != nil {
+		t = s.Tenants().Default()
+	}
+	makeLinks(ls, t)
 
 	acceptLanguages := r.Header.Get("Accept-Language")
 	localization.LocalizeMessage(acceptLanguages, &ls.Message, ls.Status)
 
-	err := getEvents(ls, s)
+	err = getEvents(ls, s)
 
 	return err
 }
@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package apilsd
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/license"
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/tenant"
+	"github.com/readium/readium-lcp-server/transactions"
+)
+
+type testServer struct {
+	trns    transactions.Transactions
+	lst     licensestatuses.LicenseStatuses
+	tenants *tenant.Tenants
+}
+
+func (s *testServer) Transactions() transactions.Transactions          { return s.trns }
+func (s *testServer) LicenseStatuses() licensestatuses.LicenseStatuses { return s.lst }
+func (s *testServer) Tenants() *tenant.Tenants                         { return s.tenants }
+
+func newTestServer(t *testing.T) *testServer {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "lsd.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{}
+	if s.tenants, err = tenant.New(tenant.Tenant{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.lst, err = licensestatuses.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	if s.trns, err = transactions.Open(db); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func putLicense(t *testing.T, s Server, l license.License) int {
+	body, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("PUT", "/licenses", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	CreateLicenseStatusDocument(w, r, s)
+	return w.Code
+}
+
+// TestCreateLicenseStatusDocumentAgain sends a license twice, as the License server does when a notification is retried
+func TestCreateLicenseStatusDocumentAgain(t *testing.T) {
+	s := newTestServer(t)
+
+	issued := time.Now().Add(-time.Hour).Round(time.Second)
+	l := license.License{Id: "license", Provider: "provider", Issued: issued}
+	if code := putLicense(t, s, l); code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d", http.StatusCreated, code)
+	}
+	if code := putLicense(t, s, l); code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+
+	// a license sent once it was updated updates the status document
+	updated := issued.Add(time.Minute)
+	l.Updated = &updated
+	if code := putLicense(t, s, l); code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+	}
+	ls, err := s.lst.GetByLicenseId("license")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls.Updated.License == nil || !ls.Updated.License.Equal(updated) {
+		t.Errorf("Expected the license to be updated at %v, got %v", updated, ls.Updated.License)
+	}
+
+	count := 0
+	fn := s.lst.List("", 0, 10, 0)
+	for _, err = fn(); err == nil; _, err = fn() {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("Expected a single license status, got %d", count)
+	}
+}
+
+// TestLendingReturnConflict returns a license which is revoked meanwhile: the LCP license gets the end set by the revocation
+func TestLendingReturnConflict(t *testing.T) {
+	s := newTestServer(t)
+
+	end := time.Now().Add(24 * time.Hour).Round(time.Second)
+	l := license.License{Id: "license", Provider: "provider", Issued: time.Now(), Rights: &license.UserRights{End: &end}}
+	if code := putLicense(t, s, l); code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d", http.StatusCreated, code)
+	}
+	ls, err := s.lst.GetByLicenseId("license")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls.Status = status.STATUS_ACTIVE
+	if err = s.lst.Update(*ls); err != nil {
+		t.Fatal(err)
+	}
+
+	// the license is revoked while the LCP Server updates it for the return
+	revoked := time.Now().Round(time.Second)
+	ends := make(chan time.Time, 10)
+	lcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var patch license.License
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch.Rights == nil || patch.Rights.End == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(ends) == 0 {
+			ls.Status = status.STATUS_REVOKED
+			ls.CurrentEndLicense = &revoked
+			if err := s.lst.Update(*ls); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		ends <- *patch.Rights.End
+	}))
+	defer lcp.Close()
+	config.Config.LcpServer.PublicBaseUrl = lcp.URL
+	defer func() { config.Config.LcpServer.PublicBaseUrl = "" }()
+	s.lst.StartSync(PushLicenseEnd)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/licenses/{key}/return", func(w http.ResponseWriter, r *http.Request) { LendingReturn(w, r, s) })
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/licenses/license/return", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	<-ends
+	select {
+	case synced := <-ends:
+		if !synced.Equal(revoked) {
+			t.Errorf("Expected the end of the revocation %v to be synced, got %v", revoked, synced)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the end of the license to be synced with the LCP Server")
+	}
+}
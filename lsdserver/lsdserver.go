@@ -45,7 +45,9 @@ import (
 	"github.com/readium/readium-lcp-server/license_statuses"
 	"github.com/readium/readium-lcp-server/localization"
 	"github.com/readium/readium-lcp-server/logging"
+	"github.com/readium/readium-lcp-server/lsdserver/api"
 	"github.com/readium/readium-lcp-server/lsdserver/server"
+	"github.com/readium/readium-lcp-server/tenant"
 	"github.com/readium/readium-lcp-server/transactions"
 )
 
@@ -103,6 +105,12 @@ func main() {
 		panic(err)
 	}
 
+	// the license link of the top level of the configuration is the one of the default tenant
+	tenants, err := tenant.New(tenant.Tenant{LicenseLinkUrl: config.Config.LsdServer.LicenseLinkUrl}, config.Config.Tenants)
+	if err != nil {
+		panic(err)
+	}
+
 	authFile := config.Config.LsdServer.AuthFile
 	if authFile == "" {
 		panic("Must have passwords file")
@@ -126,12 +134,15 @@ func main() {
 	HandleSignals()
 
 	parsedPort := strconv.Itoa(config.Config.LsdServer.Port)
-	s := lsdserver.New(":"+parsedPort, readonly, complianceMode, &hist, &trns, authenticator, )
+	s := lsdserver.New(":"+parsedPort, readonly, complianceMode, &hist, &trns, tenants, authenticator)
 	if readonly {
 		log.Println("License status server running in readonly mode on port " + parsedPort)
 	} else {
 		log.Println("License status server running on port " + parsedPort)
 	}
+	if !readonly {
+		hist.StartSync(apilsd.PushLicenseEnd)
+	}
 	log.Println("Using database " + dbURI)
 	log.Println("Public base URL=" + config.Config.LsdServer.PublicBaseUrl)
 
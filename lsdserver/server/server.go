@@ -35,6 +35,7 @@ import (
 	"github.com/readium/readium-lcp-server/api"
 	"github.com/readium/readium-lcp-server/license_statuses"
 	"github.com/readium/readium-lcp-server/lsdserver/api"
+	"github.com/readium/readium-lcp-server/tenant"
 	"github.com/readium/readium-lcp-server/transactions"
 )
 
@@ -43,6 +44,7 @@ type Server struct {
 	readonly bool
 	lst      licensestatuses.LicenseStatuses
 	trns     transactions.Transactions
+	tenants  *tenant.Tenants
 }
 
 func (s *Server) LicenseStatuses() licensestatuses.LicenseStatuses {
@@ -53,13 +55,17 @@ func (s *Server) Transactions() transactions.Transactions {
 	return s.trns
 }
 
-func New(bindAddr string, readonly bool, complianceMode bool, lst *licensestatuses.LicenseStatuses, trns *transactions.Transactions, basicAuth *auth.BasicAuth) *Server {
+func (s *Server) Tenants() *tenant.Tenants {
+	return s.tenants
+}
+
+func New(bindAddr string, readonly bool, complianceMode bool, lst *licensestatuses.LicenseStatuses, trns *transactions.Transactions, tenants *tenant.Tenants, basicAuth *auth.BasicAuth) *Server {
 
 	sr := api.CreateServerRouter("")
 
 	s := &Server{
 		Server: http.Server{
-			Handler:        sr.N,
+			Handler:        tenants.Handler(sr.N, basicAuth),
 			Addr:           bindAddr,
 			WriteTimeout:   15 * time.Second,
 			ReadTimeout:    15 * time.Second,
@@ -68,6 +74,7 @@ func New(bindAddr string, readonly bool, complianceMode bool, lst *licensestatus
 		readonly: readonly,
 		lst:      *lst,
 		trns:     *trns,
+		tenants:  tenants,
 	}
 
 	// Route.PathPrefix: http://www.gorillatoolkit.org/pkg/mux#Route.PathPrefix
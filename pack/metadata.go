@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pack
+
+import (
+	"strings"
+
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/rwpm"
+)
+
+// EpubMetadata returns the metadata of the first package document of the epub
+func EpubMetadata(ep epub.Epub) index.Metadata {
+	var m index.Metadata
+	if len(ep.Package) == 0 {
+		return m
+	}
+	opf := ep.Package[0].Metadata
+	m.Title = strings.TrimSpace(opf.Title)
+	for _, author := range opf.Authors {
+		if author = strings.TrimSpace(author); author != "" {
+			m.Authors = append(m.Authors, author)
+		}
+	}
+	if len(opf.Language) > 0 {
+		m.Language = strings.TrimSpace(opf.Language[0])
+	}
+	m.Publisher = strings.TrimSpace(opf.Publisher)
+	for _, id := range opf.Identifiers {
+		if value := strings.TrimSpace(id.Value); value != "" {
+			m.Identifiers = append(m.Identifiers, value)
+		}
+	}
+	return m
+}
+
+// RWPMetadata returns the metadata of a Readium package from its manifest
+func RWPMetadata(manifest rwpm.Publication) index.Metadata {
+	m := index.Metadata{Title: manifest.Metadata.Title.String(), Authors: manifest.Metadata.Author.Names()}
+	if len(manifest.Metadata.Language) > 0 {
+		m.Language = manifest.Metadata.Language[0]
+	}
+	if manifest.Metadata.Identifier != "" {
+		m.Identifiers = []string{manifest.Metadata.Identifier}
+	}
+	return m
+}
@@ -51,9 +51,7 @@ func Do(encrypter crypto.Encrypter, ep epub.Epub, w io.Writer) (enc *xmlenc.Mani
 
 	for _, res := range ep.Resource {
 		if _, alreadyEncrypted := ep.Encryption.DataForFile(res.Path); !alreadyEncrypted && canEncrypt(res, ep) {
-			// TODO: Disable compression for now -- etsakov@2017.11.18
-			// toCompress := mustCompressBeforeEncryption(*res, ep)
-			toCompress := false
+			toCompress := mustCompressBeforeEncryption(*res, ep)
 
 			err = encryptFile(encrypter, key, ep.Encryption, res, toCompress, ew)
 			if err != nil {
@@ -120,13 +118,17 @@ func encryptFile(encrypter crypto.Encrypter, key []byte, m *xmlenc.Manifest, fil
 
 	if compress {
 		var buf bytes.Buffer
-		w, err := flate.NewWriter(&buf, 9)
+		fw, err := flate.NewWriter(&buf, flate.BestCompression)
 		if err != nil {
 			return err
 		}
 
-		io.Copy(w, file.Contents)
-		w.Close()
+		if _, err = io.Copy(fw, file.Contents); err != nil {
+			return err
+		}
+		if err = fw.Close(); err != nil {
+			return err
+		}
 		file.ContentsSize = uint64(buf.Len())
 
 		input = ioutil.NopCloser(&buf)
@@ -29,11 +29,17 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/flate"
+	"crypto/sha1"
+	"encoding/json"
+	"image/jpeg"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/rwpm"
 	"github.com/readium/readium-lcp-server/xmlenc"
 )
 
@@ -132,3 +138,442 @@ func TestPacking(t *testing.T) {
 		}
 	}
 }
+
+func TestDoPDF(t *testing.T) {
+	pdf := []byte("%PDF-1.4\n% not really a pdf, but the bytes are kept as they are\n%%EOF\n")
+
+	var buf bytes.Buffer
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	key, err := DoPDF(encrypter, "Sample", bytes.NewReader(pdf), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	mf, ok := files[rwpm.ManifestFile]
+	if !ok {
+		t.Fatal("Expected a manifest in the package")
+	}
+	r, _ := mf.Open()
+	manifest, err := rwpm.Read(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Metadata.Title.String() != "Sample" {
+		t.Errorf("Expected the title to be Sample, got %s", manifest.Metadata.Title.String())
+	}
+	if len(manifest.ReadingOrder) != 1 || manifest.ReadingOrder[0].Href != PDFFile {
+		t.Fatalf("Expected %s as the only item of the reading order, got %#v", PDFFile, manifest.ReadingOrder)
+	}
+	enc := manifest.ReadingOrder[0].Properties.Encrypted
+	if enc == nil || enc.Scheme != rwpm.SCHEME_LCP || enc.Algorithm != encrypter.Signature() {
+		t.Errorf("Unexpected encryption properties %#v", enc)
+	}
+
+	pf, ok := files[PDFFile]
+	if !ok {
+		t.Fatal("Expected the pdf in the package")
+	}
+	if pf.Method != zip.Store {
+		t.Errorf("Expected the encrypted pdf to be stored")
+	}
+	r, _ = pf.Open()
+	var clear bytes.Buffer
+	err = encrypter.(crypto.Decrypter).Decrypt(key, r, &clear)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clear.Bytes(), pdf) {
+		t.Errorf("Expected the pdf to be equal before and after")
+	}
+}
+
+func TestDoRWP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audiobook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	audio := []byte("ID3 not really mp3 data")
+	ioutil.WriteFile(filepath.Join(dir, "02.mp3"), audio, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "01.m4a"), audio, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not listed"), 0644)
+
+	var clear bytes.Buffer
+	if err = PackageDir(dir, &clear); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(clear.Bytes()), int64(clear.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := rwpm.FindManifest(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.LCPContentType() != rwpm.ContentType_LCP_AUDIOBOOK {
+		t.Errorf("Expected an audiobook, got %s", manifest.LCPContentType())
+	}
+	if len(manifest.ReadingOrder) != 2 || manifest.ReadingOrder[0].Href != "01.m4a" || manifest.ReadingOrder[1].Type != "audio/mpeg" {
+		t.Fatalf("Unexpected reading order %#v", manifest.ReadingOrder)
+	}
+
+	var buf bytes.Buffer
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	key, err := DoRWP(encrypter, zr, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected, err := rwpm.FindManifest(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range protected.ReadingOrder {
+		if link.Properties == nil || link.Properties.Encrypted == nil || link.Properties.Encrypted.Algorithm != encrypter.Signature() {
+			t.Errorf("Expected encryption properties for %s", link.Href)
+		}
+	}
+
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		switch f.Name {
+		case "01.m4a", "02.mp3":
+			var out bytes.Buffer
+			if err = encrypter.(crypto.Decrypter).Decrypt(key, bytes.NewReader(data), &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), audio) {
+				t.Errorf("Expected %s to be equal before and after", f.Name)
+			}
+		case "notes.txt":
+			if string(data) != "not listed" {
+				t.Errorf("Expected %s to be left in clear", f.Name)
+			}
+		}
+	}
+}
+
+func TestDoRWPKeepsManifest(t *testing.T) {
+	var clear bytes.Buffer
+	zw := zip.NewWriter(&clear)
+	fw, _ := zw.Create(rwpm.ManifestFile)
+	fw.Write([]byte(`{"metadata":{"@type":"http://schema.org/Audiobook","title":"T","narrator":"N"},
+		"readingOrder":[{"href":"a.mp3","type":"audio/mpeg","duration":12.5}],
+		"toc":[{"href":"a.mp3#t=0","title":"One"}]}`))
+	fw, _ = zw.Create("a.mp3")
+	fw.Write([]byte("audio"))
+	zw.Close()
+
+	zr, _ := zip.NewReader(bytes.NewReader(clear.Bytes()), int64(clear.Len()))
+	var buf bytes.Buffer
+	if _, err := DoRWP(crypto.NewAESEncrypter_PUBLICATION_RESOURCES(), zr, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, _ = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	r, _ := zr.File[0].Open()
+	var manifest map[string]interface{}
+	json.NewDecoder(r).Decode(&manifest)
+	if _, ok := manifest["toc"]; !ok {
+		t.Errorf("Expected the toc to be kept")
+	}
+	if manifest["metadata"].(map[string]interface{})["narrator"] != "N" {
+		t.Errorf("Expected the narrator to be kept")
+	}
+	link := manifest["readingOrder"].([]interface{})[0].(map[string]interface{})
+	if link["duration"] != 12.5 || link["properties"] == nil {
+		t.Errorf("Unexpected reading order item %#v", link)
+	}
+}
+
+func TestPackingRoundTrip(t *testing.T) {
+	for _, mode := range []string{crypto.ENCRYPTION_CBC, crypto.ENCRYPTION_GCM} {
+		for _, sample := range []string{"../test/samples/sample.epub", "../test/samples/lorem.epub"} {
+			testPackingRoundTrip(t, mode, sample)
+		}
+	}
+}
+
+func testPackingRoundTrip(t *testing.T, mode string, sample string) {
+	z, err := zip.OpenReader(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := make(map[string][]byte)
+	for _, f := range z.File {
+		r, _ := f.Open()
+		source[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	input, err := epub.Read(&z.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	encrypter, _ := crypto.NewAESEncrypter(mode)
+	encryption, key, err := Do(encrypter, input, &buf)
+	z.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := 0
+	for _, f := range zr.File {
+		if f.Name == epub.EncryptionFile {
+			continue
+		}
+		r, _ := f.Open()
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+
+		if item, ok := encryption.DataForFile(f.Name); ok {
+			decrypter, err := crypto.NewAESDecrypter(string(item.Method.Algorithm))
+			if err != nil || item.Method.Algorithm != xmlenc.URI(encrypter.Signature()) {
+				t.Fatalf("%s: unexpected algorithm %s for %s", sample, item.Method.Algorithm, f.Name)
+			}
+			var clear bytes.Buffer
+			if err = decrypter.Decrypt(key, bytes.NewReader(data), &clear); err != nil {
+				t.Fatalf("%s: could not decrypt %s: %s", sample, f.Name, err)
+			}
+			data = clear.Bytes()
+			compression := item.Properties.Properties[0].Compression
+			if compression.Method == Deflate {
+				compressed++
+				if data, err = ioutil.ReadAll(flate.NewReader(&clear)); err != nil {
+					t.Fatalf("%s: could not inflate %s: %s", sample, f.Name, err)
+				}
+			} else if compression.Method != NoCompression {
+				t.Errorf("%s: unexpected compression method %d for %s", sample, compression.Method, f.Name)
+			}
+			if compression.OriginalLength != uint64(len(data)) {
+				t.Errorf("%s: expected an original length of %d for %s, got %d", sample, len(data), f.Name, compression.OriginalLength)
+			}
+		}
+
+		if !bytes.Equal(data, source[f.Name]) {
+			t.Errorf("%s: expected %s to be equal before and after", sample, f.Name)
+		}
+		delete(source, f.Name)
+	}
+	for name := range source {
+		t.Errorf("%s: expected %s in the output", sample, name)
+	}
+	if compressed == 0 {
+		t.Errorf("%s: expected some resources to be compressed before encryption", sample)
+	}
+}
+
+// obfuscatedSample returns sample.epub with a font obfuscated with the IDPF algorithm,
+// along with the clear font
+func obfuscatedSample(t *testing.T) (*zip.Reader, []byte) {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	key := sha1.Sum([]byte("code.google.com.epub-samples.moby-dick-basic"))
+	var font []byte
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range z.File {
+		r, _ := f.Open()
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if f.Name == fontPath {
+			font = append([]byte(nil), data...)
+			for i := 0; i < 1040; i++ {
+				data[i] ^= key[i%len(key)]
+			}
+		}
+		fw, _ := zw.Create(f.Name)
+		fw.Write(data)
+	}
+	fw, _ := zw.Create(epub.EncryptionFile)
+	fw.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#" xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <ds:KeyInfo><ds:KeyName>publisher-obfuscation</ds:KeyName></ds:KeyInfo>
+    <enc:CipherData><enc:CipherReference URI="` + fontPath + `"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`))
+	zw.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr, font
+}
+
+const fontPath = "OPS/fonts/STIXGeneral.otf"
+
+func TestPackingKeepsObfuscatedFonts(t *testing.T) {
+	zr, _ := obfuscatedSample(t)
+	input, err := epub.Read(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obfuscated, _ := findFile(fontPath, input)
+	obfuscatedBytes, _ := ioutil.ReadAll(obfuscated.Contents)
+	obfuscated.Contents = bytes.NewReader(obfuscatedBytes)
+
+	var buf bytes.Buffer
+	if _, _, err = Do(crypto.NewAESEncrypter_PUBLICATION_RESOURCES(), input, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, _ = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		switch f.Name {
+		case fontPath:
+			if !bytes.Equal(data, obfuscatedBytes) {
+				t.Errorf("Expected the obfuscated font to be kept as is")
+			}
+		case epub.EncryptionFile:
+			if !bytes.Contains(data, []byte("publisher-obfuscation")) {
+				t.Errorf("Expected the obfuscation entry to be kept as is, got %s", data)
+			}
+		}
+	}
+
+	output, _ := epub.Read(zr)
+	data, ok := output.Encryption.DataForFile(fontPath)
+	if !ok || data.Method.Algorithm != epub.ALGORITHM_IDPF_OBFUSCATION {
+		t.Errorf("Expected the font to be listed as obfuscated, got %#v", data)
+	}
+}
+
+func TestPackingDeobfuscatedFonts(t *testing.T) {
+	zr, font := obfuscatedSample(t)
+	input, err := epub.Read(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = input.Deobfuscate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	encryption, key, err := Do(encrypter, input, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := encryption.DataForFile(fontPath)
+	if !ok || string(data.Method.Algorithm) != encrypter.Signature() || len(encryption.Data) == 0 {
+		t.Fatalf("Expected the font to be encrypted, got %#v", data)
+	}
+	for _, d := range encryption.Data {
+		if epub.IsObfuscation(string(d.Method.Algorithm)) {
+			t.Errorf("Expected no obfuscation entry left")
+		}
+	}
+
+	zr, _ = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	output, _ := epub.Read(zr)
+	res, _ := findFile(fontPath, output)
+	var clear bytes.Buffer
+	if err = encrypter.(crypto.Decrypter).Decrypt(key, res.Contents, &clear); err != nil {
+		t.Fatal(err)
+	}
+	var clearFont []byte = clear.Bytes()
+	if data.Properties.Properties[0].Compression.Method == Deflate {
+		clearFont, _ = ioutil.ReadAll(flate.NewReader(&clear))
+	}
+	if !bytes.Equal(clearFont, font) {
+		t.Errorf("Expected the deobfuscated font to be equal to the original")
+	}
+}
+
+func TestEpubMetadata(t *testing.T) {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	input, err := epub.Read(&z.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := EpubMetadata(input)
+	if m.Title != "Moby-Dick" {
+		t.Errorf("Expected the title to be Moby-Dick, got %s", m.Title)
+	}
+	if len(m.Authors) != 1 || m.Authors[0] != "Herman Melville" {
+		t.Errorf("Expected Herman Melville as the author, got %v", m.Authors)
+	}
+	if m.Language != "en-US" || m.Publisher != "Harper & Brothers, Publishers" {
+		t.Errorf("Unexpected language %s or publisher %s", m.Language, m.Publisher)
+	}
+	if len(m.Identifiers) != 1 || m.Identifiers[0] != "code.google.com.epub-samples.moby-dick-basic" {
+		t.Errorf("Unexpected identifiers %v", m.Identifiers)
+	}
+}
+
+func TestCover(t *testing.T) {
+	z, err := zip.OpenReader("../test/samples/sample.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	input, err := epub.Read(&z.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cover, err := Cover(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cover) != 348700 {
+		t.Fatalf("Expected the 348700 bytes of the cover image, got %d", len(cover))
+	}
+
+	thumbnail, err := Thumbnail(cover, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Width != 150 {
+		t.Errorf("Expected a thumbnail 150 pixels wide, got %d", conf.Width)
+	}
+
+	// the cover is still packaged after it was read
+	_, res := input.Cover()
+	contents, err := ioutil.ReadAll(res.Contents)
+	if err != nil || len(contents) != len(cover) {
+		t.Errorf("Expected the cover resource to be readable again, got %d bytes (%v)", len(contents), err)
+	}
+}
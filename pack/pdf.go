@@ -0,0 +1,86 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pack
+
+import (
+	"archive/zip"
+	"io"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/rwpm"
+)
+
+// path of the encrypted PDF in a .lcpdf package
+const PDFFile = "publication.pdf"
+
+// DoPDF writes to w a Readium package (.lcpdf) protecting the PDF read from pdf.
+// The PDF is encrypted with a new content key and listed, with its encryption
+// properties, in a manifest.json left in clear.
+func DoPDF(encrypter crypto.Encrypter, title string, pdf io.Reader, w io.Writer) (key crypto.ContentKey, err error) {
+	key, err = encrypter.GenerateKey()
+	if err != nil {
+		return
+	}
+
+	manifest := rwpm.Publication{
+		Context: rwpm.Context,
+		Metadata: rwpm.Metadata{
+			Type:  "http://schema.org/Book",
+			Title: rwpm.LocalizedString{Text: title},
+		},
+		ReadingOrder: []rwpm.Link{{
+			Href: PDFFile,
+			Type: rwpm.ContentType_PDF,
+			Properties: &rwpm.Properties{
+				Encrypted: &rwpm.Encrypted{
+					Scheme:    rwpm.SCHEME_LCP,
+					Algorithm: encrypter.Signature(),
+				},
+			},
+		}},
+	}
+
+	pw := epub.NewWriter(w)
+	fw, err := pw.AddResource(rwpm.ManifestFile, zip.Deflate)
+	if err != nil {
+		return
+	}
+	if err = manifest.Write(fw); err != nil {
+		return
+	}
+
+	// a PDF is compressed already, the encrypted data is stored as is
+	fw, err = pw.AddResource(PDFFile, zip.Store)
+	if err != nil {
+		return
+	}
+	if err = encrypter.Encrypt(key, pdf, fw); err != nil {
+		return
+	}
+
+	return key, pw.Close()
+}
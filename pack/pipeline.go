@@ -27,40 +27,38 @@ package pack
 
 import (
 	"archive/zip"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/satori/go.uuid"
 
+	"github.com/readium/readium-lcp-server/config"
 	"github.com/readium/readium-lcp-server/crypto"
 	"github.com/readium/readium-lcp-server/epub"
 	"github.com/readium/readium-lcp-server/index"
+	"github.com/readium/readium-lcp-server/jobs"
+	"github.com/readium/readium-lcp-server/rwpm"
 	"github.com/readium/readium-lcp-server/storage"
 )
 
-type Source interface {
-	Feed(chan<- *Task)
-}
-
-type Task struct {
-	Name string
-	Body io.ReaderAt
-	Size int64
-	done chan Result
-}
+// idle workers look for queued jobs at least this often
+const pollInterval = 10 * time.Second
 
 type EncryptedFileInfo struct {
-	File   *os.File
-	Size   int64
-	Sha256 string
-}
-
-func NewTask(name string, body io.ReaderAt, size int64) *Task {
-	return &Task{Name: name, Body: body, Size: size, done: make(chan Result, 1)}
+	File      *os.File
+	Size      int64
+	Sha256    string
+	Algorithm string
 }
 
 type Result struct {
@@ -69,55 +67,161 @@ type Result struct {
 	Elapsed time.Duration
 }
 
-func (t *Task) Wait() Result {
-	r := <-t.done
-	return r
+type Packager struct {
+	wake  chan struct{}
+	store storage.Store
+	idx   index.Index
+	jobs  jobs.Jobs
+	conf  config.Packaging
 }
 
-func (t *Task) Done(r Result) {
-	t.done <- r
-}
+// Enqueue saves the publication read from body in the packaging directory,
+// persists a packaging job for it and wakes up an idle worker.
+// A new content id is generated if contentId is empty.
+// encryption selects CBC or GCM for the resources, the server setting applies if it is empty.
+// A new content belongs to tenant, a new version keeps the tenant of the content.
+func (p Packager) Enqueue(tenant string, name string, contentId string, encryption string, body io.Reader) (jobs.Job, error) {
+	if contentId == "" {
+		contentId = uuid.NewV4().String()
+	}
 
-type ManualSource struct {
-	ch chan<- *Task
-}
+	file, err := ioutil.TempFile(p.conf.Directory, "job")
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	_, err = io.Copy(file, body)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return jobs.Job{}, err
+	}
 
-func (s *ManualSource) Feed(ch chan<- *Task) {
-	s.ch = ch
+	job, err := p.jobs.Add(jobs.Job{ContentId: contentId, Name: name, Encryption: encryption, Tenant: tenant, Input: file.Name()})
+	if err != nil {
+		os.Remove(file.Name())
+		return job, err
+	}
+
+	select {
+	case p.wake <- struct{}{}:
+	default: // all workers are busy, the job will be picked up later
+	}
+	return job, nil
 }
 
-func (s *ManualSource) Post(t *Task) Result {
-	s.ch <- t
-	return t.Wait()
+func (p Packager) work() {
+	for {
+		job, err := p.jobs.Next()
+		if err != nil {
+			if err != jobs.NotFound {
+				log.Println("Error fetching the next packaging job: " + err.Error())
+			}
+			select {
+			case <-p.wake:
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		p.run(job)
+	}
 }
 
-type Packager struct {
-	Incoming  chan *Task
-	done      chan struct{}
-	store     storage.Store
-	idx       index.Index
+// run packages the input of a job, then either completes it, queues it again
+// for another attempt or marks it as failed
+func (p Packager) run(job jobs.Job) {
+	start := time.Now()
+	r := Result{Id: job.ContentId}
+	in, size := p.openInput(&r, job.Input)
+	name, contentType := job.Name, epub.ContentType_EPUB
+	var encrypted *EncryptedFileInfo
+	var key []byte
+	var metadata index.Metadata
+	var cover []byte
+	if p.isPDF(&r, in) {
+		title := strings.TrimSuffix(name, filepath.Ext(name))
+		name, contentType = title+rwpm.Extension_LCP_PDF, rwpm.ContentType_LCP_PDF
+		metadata.Title = title
+		encrypted, key = p.encrypt(&r, job.Encryption, func(encrypter crypto.Encrypter, w io.Writer) (crypto.ContentKey, error) {
+			return DoPDF(encrypter, title, io.NewSectionReader(in, 0, size), w)
+		})
+	} else if zr := p.readZip(&r, in, size); p.isRWP(&r, zr) {
+		manifest := p.readManifest(&r, zr)
+		contentType = p.rwpContentType(&r, manifest)
+		metadata = RWPMetadata(manifest)
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + rwpm.Extension(contentType)
+		encrypted, key = p.encrypt(&r, job.Encryption, func(encrypter crypto.Encrypter, w io.Writer) (crypto.ContentKey, error) {
+			return DoRWP(encrypter, zr, w)
+		})
+	} else {
+		job.Validation = p.validate(&r, zr)
+		ep := p.readEpub(&r, zr)
+		metadata = EpubMetadata(ep)
+		cover = p.readCover(&r, ep)
+		encrypted, key = p.encrypt(&r, job.Encryption, func(encrypter crypto.Encrypter, w io.Writer) (crypto.ContentKey, error) {
+			_, key, err := Do(encrypter, ep, w)
+			return key, err
+		})
+	}
+	content := p.nextVersion(&r, job.Tenant)
+	p.addToStore(&r, content.StorageKey(), encrypted)
+	p.addToIndex(&r, content, key, name, contentType, metadata, encrypted)
+	p.addCover(&r, cover)
+	if in != nil {
+		in.Close()
+	}
+	r.Elapsed = time.Since(start)
+
+	job.Attempts++
+	if r.Error == nil {
+		job.Status = jobs.STATUS_DONE
+		job.Error = ""
+	} else {
+		job.Error = r.Error.Error()
+		// an invalid publication will not get better
+		if _, invalid := r.Error.(epub.ValidationError); !invalid && job.Attempts < p.conf.MaxAttempts {
+			job.Status = jobs.STATUS_QUEUED
+		} else {
+			job.Status = jobs.STATUS_FAILED
+		}
+		log.Printf("Packaging job %d (%s) attempt %d: %s", job.Id, job.ContentId, job.Attempts, job.Error)
+	}
+	if job.Status != jobs.STATUS_QUEUED {
+		os.Remove(job.Input)
+	}
+	if err := p.jobs.Update(job); err != nil {
+		log.Printf("Error updating packaging job %d: %s", job.Id, err.Error())
+	}
+	log.Printf("Packaging job %d (%s) %s in %s", job.Id, job.ContentId, job.Status, r.Elapsed)
 }
 
-func (p Packager) work() {
-	for t := range p.Incoming {
-		r := Result{}
-		p.genKey(&r)
-		zr := p.readZip(&r, t.Body, t.Size)
-		epub := p.readEpub(&r, zr)
-		encrypted, key := p.encrypt(&r, epub)
-		p.addToStore(&r, encrypted.File)
-		p.addToIndex(&r, key, t.Name, encrypted.Size, encrypted.Sha256)
+func (p Packager) openInput(r *Result, name string) (*os.File, int64) {
+	if r.Error != nil {
+		return nil, 0
+	}
 
-		t.Done(r)
+	f, err := os.Open(name)
+	if err != nil {
+		r.Error = err
+		return nil, 0
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		r.Error = err
+		return nil, 0
 	}
+	return f, stat.Size()
 }
 
-func (p Packager) genKey(r *Result) {
+// isPDF tells whether the input starts with the PDF file signature
+func (p Packager) isPDF(r *Result, in io.ReaderAt) bool {
 	if r.Error != nil {
-		return
+		return false
 	}
 
-	r.Id = uuid.NewV4().String()
+	magic := make([]byte, 5)
+	n, _ := in.ReadAt(magic, 0)
+	return n == len(magic) && string(magic) == "%PDF-"
 }
 
 func (p Packager) readZip(r *Result, in io.ReaderAt, size int64) *zip.Reader {
@@ -130,31 +234,100 @@ func (p Packager) readZip(r *Result, in io.ReaderAt, size int64) *zip.Reader {
 	return zr
 }
 
+// isRWP tells whether the zip package is a Readium package, with a manifest at its root
+func (p Packager) isRWP(r *Result, zr *zip.Reader) bool {
+	if r.Error != nil {
+		return false
+	}
+
+	for _, f := range zr.File {
+		if f.Name == rwpm.ManifestFile {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Packager) readManifest(r *Result, zr *zip.Reader) rwpm.Publication {
+	if r.Error != nil {
+		return rwpm.Publication{}
+	}
+
+	manifest, err := rwpm.FindManifest(zr)
+	r.Error = err
+	return manifest
+}
+
+func (p Packager) rwpContentType(r *Result, manifest rwpm.Publication) string {
+	if r.Error != nil {
+		return ""
+	}
+
+	contentType := manifest.LCPContentType()
+	if contentType == "" {
+		r.Error = errors.New("Unsupported Readium package, neither an audiobook nor a pdf")
+	}
+	return contentType
+}
+
+// validate checks the epub and returns the validation report as json, if there is anything to report
+func (p Packager) validate(r *Result, zr *zip.Reader) []byte {
+	if r.Error != nil {
+		return nil
+	}
+
+	report, err := epub.Check(zr, p.conf.Validation)
+	r.Error = err
+	if report.Empty() {
+		return nil
+	}
+	out, _ := json.Marshal(report)
+	return out
+}
+
 func (p Packager) readEpub(r *Result, zr *zip.Reader) epub.Epub {
 	if r.Error != nil {
 		return epub.Epub{}
 	}
 
 	ep, err := epub.Read(zr)
+	if err == nil && p.conf.DeobfuscateFonts {
+		err = ep.Deobfuscate()
+	}
 	r.Error = err
 
 	return ep
 }
 
-func (p Packager) encrypt(r *Result, ep epub.Epub) (*EncryptedFileInfo, []byte) {
+// encrypt runs pack with the encrypter selected by mode to build the protected
+// publication in a temporary file
+func (p Packager) encrypt(r *Result, mode string, pack func(crypto.Encrypter, io.Writer) (crypto.ContentKey, error)) (*EncryptedFileInfo, []byte) {
 	if r.Error != nil {
 		return nil, nil
 	}
+	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
+	if mode != "" {
+		var err error
+		if encrypter, err = crypto.NewAESEncrypter(mode); err != nil {
+			r.Error = err
+			return nil, nil
+		}
+	}
 	tmpFile, err := ioutil.TempFile(os.TempDir(), "out-readium-lcp")
 	if err != nil {
 		r.Error = err
 		return nil, nil
 	}
-	encrypter := crypto.NewAESEncrypter_PUBLICATION_RESOURCES()
-	_, key, err := Do(encrypter, ep, tmpFile)
-	r.Error = err
+	key, err := pack(encrypter, tmpFile)
+	if err != nil {
+		r.Error = err
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, nil
+	}
 	var encryptedFileInfo EncryptedFileInfo
 	encryptedFileInfo.File = tmpFile
+	encryptedFileInfo.Algorithm = encrypter.Signature()
 	//get file length & hash (sha256)
 	hasher := sha256.New()
 	encryptedFileInfo.File.Seek(0, 0)
@@ -162,6 +335,8 @@ func (p Packager) encrypt(r *Result, ep epub.Epub) (*EncryptedFileInfo, []byte)
 	//hasher.Write(s)
 	if err != nil {
 		r.Error = err
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
 		return nil, nil
 	}
 	encryptedFileInfo.Size = written
@@ -171,36 +346,130 @@ func (p Packager) encrypt(r *Result, ep epub.Epub) (*EncryptedFileInfo, []byte)
 	return &encryptedFileInfo, key
 }
 
-func (p Packager) addToStore(r *Result, f *os.File) {
+// nextVersion returns the content with the version the publication is packaged as:
+// the first one for a new content, the one following the latest otherwise
+func (p Packager) nextVersion(r *Result, tenant string) index.Content {
+	if r.Error != nil {
+		return index.Content{}
+	}
+
+	c, err := p.idx.Get(r.Id)
+	if err == index.NotFound {
+		c.Tenant, err = tenant, nil
+	}
+	if err == nil {
+		c.Version, err = p.idx.ReserveVersion(r.Id)
+	}
+	r.Error = err
+	return index.Content{Id: r.Id, Version: c.Version, Tenant: c.Tenant}
+}
+
+func (p Packager) addToStore(r *Result, key string, encrypted *EncryptedFileInfo) {
+	if encrypted == nil {
+		return
+	}
+	f := encrypted.File
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if r.Error != nil {
+		return
+	}
+
+	_, r.Error = p.store.Add(key, f)
+}
+
+// readCover reads the cover image of the epub before its resources are encrypted
+func (p Packager) readCover(r *Result, ep epub.Epub) []byte {
+	if r.Error != nil {
+		return nil
+	}
+
+	cover, err := Cover(ep)
+	r.Error = err
+	return cover
+}
+
+// addCover stores the cover in the clear next to the protected publication, with its thumbnails,
+// once the new version is in the index: the cover is the one of the latest version, and a version without cover
+// removes the cover of the previous one. The version is already available, so errors are logged and do not fail the job;
+// a cover which cannot be decoded is kept without thumbnails.
+func (p Packager) addCover(r *Result, cover []byte) {
 	if r.Error != nil {
 		return
 	}
+	if cover == nil {
+		if err := p.RemoveCover(r.Id); err != nil {
+			log.Printf("Error removing the cover of %s: %s", r.Id, err.Error())
+		}
+		return
+	}
 
-	_, r.Error = p.store.Add(r.Id, f)
+	if _, err := p.store.Add(CoverKey(r.Id), bytes.NewReader(cover)); err != nil {
+		log.Printf("Error storing the cover of %s: %s", r.Id, err.Error())
+		return
+	}
+	for _, width := range p.conf.Thumbnails {
+		thumbnail, err := Thumbnail(cover, width)
+		if err != nil {
+			log.Printf("No thumbnail for the cover of %s: %s", r.Id, err.Error())
+			return
+		}
+		if _, err = p.store.Add(ThumbnailKey(r.Id, width), bytes.NewReader(thumbnail)); err != nil {
+			log.Printf("Error storing the thumbnail of the cover of %s: %s", r.Id, err.Error())
+			return
+		}
+	}
+}
 
-	f.Close()
-	os.Remove(f.Name())
+// RemoveCover removes the cover of a content and its thumbnails from the store
+func (p Packager) RemoveCover(contentId string) error {
+	keys := []string{CoverKey(contentId)}
+	for _, width := range p.conf.Thumbnails {
+		keys = append(keys, ThumbnailKey(contentId, width))
+	}
+	for _, key := range keys {
+		if err := p.store.Remove(key); err != nil && err != storage.NotFound {
+			return err
+		}
+	}
+	return nil
 }
 
-func (p Packager) addToIndex(r *Result, key []byte, name string, contentSize int64, contentHash string) {
+func (p Packager) addToIndex(r *Result, c index.Content, key []byte, name string, contentType string, metadata index.Metadata, encrypted *EncryptedFileInfo) {
 	if r.Error != nil {
 		return
 	}
 
-	r.Error = p.idx.Add(index.Content{r.Id, key, name, contentSize, contentHash})
+	c.EncryptionKey, c.Location, c.Length, c.Sha256 = key, name, encrypted.Size, encrypted.Sha256
+	c.Type, c.Algorithm, c.Metadata = contentType, encrypted.Algorithm, metadata
+	r.Error = p.idx.AddVersion(c)
 }
 
-func NewPackager(store storage.Store, idx index.Index, concurrency int) *Packager {
+// NewPackager starts conf.Workers workers processing the jobs queued in jbs.
+// Uploaded publications are kept in conf.Directory until their job completes,
+// and a failing job is attempted up to conf.MaxAttempts times.
+// Obfuscated fonts are kept as they are, unless conf.DeobfuscateFonts is set: they are then
+// restored and encrypted like the other resources.
+// EPUB files are validated first, and rejected if they have errors when conf.Validation is "reject".
+// The cover of an EPUB file is stored in the clear, with a thumbnail for each width of conf.Thumbnails.
+func NewPackager(store storage.Store, idx index.Index, jbs jobs.Jobs, conf config.Packaging) (*Packager, error) {
 	packager := Packager{
-		Incoming:  make(chan *Task),
-		done:      make(chan struct{}),
-		store:     store,
-		idx:       idx,
+		wake:  make(chan struct{}),
+		store: store,
+		idx:   idx,
+		jobs:  jbs,
+		conf:  conf,
+	}
+
+	// jobs left running by a previous run of the server are attempted again
+	if err := jbs.Requeue(); err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < concurrency; i++ {
+	for i := 0; i < conf.Workers; i++ {
 		go packager.work()
 	}
 
-	return &packager
+	return &packager, nil
 }
@@ -0,0 +1,224 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pack
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/readium/readium-lcp-server/crypto"
+	"github.com/readium/readium-lcp-server/epub"
+	"github.com/readium/readium-lcp-server/rwpm"
+)
+
+// content types of the audio files accepted in a folder
+var audioTypes = map[string]string{
+	".mp3": "audio/mpeg",
+	".m4a": "audio/mp4",
+}
+
+// DoRWP writes to w a protected copy of the Readium package read from zr.
+// Every resource of the package listed in the reading order or the resources
+// of the manifest is encrypted with a new content key and gets its encryption
+// properties in the manifest, which is left in clear. Other properties of the
+// manifest are kept as they are.
+func DoRWP(encrypter crypto.Encrypter, zr *zip.Reader, w io.Writer) (key crypto.ContentKey, err error) {
+	key, err = encrypter.GenerateKey()
+	if err != nil {
+		return
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	mf, ok := files[rwpm.ManifestFile]
+	if !ok {
+		return nil, rwpm.ErrNoManifest
+	}
+
+	// the manifest is decoded generically, in order to keep what rwpm does not model
+	var manifest map[string]interface{}
+	r, err := mf.Open()
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	err = dec.Decode(&manifest)
+	r.Close()
+	if err != nil {
+		return
+	}
+
+	toEncrypt := make(map[string]bool)
+	for _, collection := range []string{"readingOrder", "resources"} {
+		links, _ := manifest[collection].([]interface{})
+		for _, l := range links {
+			link, ok := l.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			href, _ := link["href"].(string)
+			if i := strings.Index(href, "#"); i >= 0 {
+				href = href[:i]
+			}
+			// remote resources are not in the package
+			if _, inPackage := files[href]; !inPackage || href == rwpm.ManifestFile {
+				continue
+			}
+			properties, _ := link["properties"].(map[string]interface{})
+			if properties == nil {
+				properties = make(map[string]interface{})
+				link["properties"] = properties
+			}
+			// resources encrypted by another scheme are left as they are
+			if _, encrypted := properties["encrypted"]; encrypted && !toEncrypt[href] {
+				continue
+			}
+			properties["encrypted"] = rwpm.Encrypted{Scheme: rwpm.SCHEME_LCP, Algorithm: encrypter.Signature()}
+			toEncrypt[href] = true
+		}
+	}
+
+	pw := epub.NewWriter(w)
+	fw, err := pw.AddResource(rwpm.ManifestFile, zip.Deflate)
+	if err != nil {
+		return
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(manifest); err != nil {
+		return
+	}
+
+	for _, f := range zr.File {
+		switch {
+		case f.Name == rwpm.ManifestFile || f.Name == rwpm.LicenseFile:
+			continue
+		case toEncrypt[f.Name]:
+			err = encryptEntry(encrypter, key, f, pw)
+		default:
+			err = pw.CopyRaw(f)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return key, pw.Close()
+}
+
+// encryptEntry stores the encrypted content of f under the same name, without compression
+func encryptEntry(encrypter crypto.Encrypter, key crypto.ContentKey, f *zip.File, w *epub.Writer) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fw, err := w.AddResource(f.Name, zip.Store)
+	if err != nil {
+		return err
+	}
+	return encrypter.Encrypt(key, r, fw)
+}
+
+// PackageDir writes to w a clear Readium audiobook package of the files in dir.
+// The manifest.json of the folder is used if there is one, otherwise a manifest
+// is generated with the MP3 and M4A files of the folder, in name order,
+// as the reading order.
+func PackageDir(dir string, w io.Writer) error {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	pw := epub.NewWriter(w)
+	if _, err = os.Stat(filepath.Join(dir, rwpm.ManifestFile)); os.IsNotExist(err) {
+		manifest := rwpm.Publication{
+			Context: rwpm.Context,
+			Metadata: rwpm.Metadata{
+				Type:       rwpm.TYPE_AUDIOBOOK,
+				ConformsTo: rwpm.PROFILE_AUDIOBOOK,
+				Title:      rwpm.LocalizedString{Text: filepath.Base(filepath.Clean(dir))},
+			},
+		}
+		for _, path := range paths {
+			if contentType, ok := audioTypes[strings.ToLower(filepath.Ext(path))]; ok {
+				manifest.ReadingOrder = append(manifest.ReadingOrder, rwpm.Link{Href: path, Type: contentType})
+			}
+		}
+		fw, err := pw.AddResource(rwpm.ManifestFile, zip.Deflate)
+		if err != nil {
+			return err
+		}
+		if err = manifest.Write(fw); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range paths {
+		method := uint16(zip.Deflate)
+		if _, audio := audioTypes[strings.ToLower(filepath.Ext(path))]; audio {
+			method = zip.Store
+		}
+		fw, err := pw.AddResource(path, method)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return pw.Close()
+}
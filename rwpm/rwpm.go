@@ -0,0 +1,284 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package rwpm describes Readium Web Publication Manifests, the manifest.json
+// file found at the root of Readium packages (.lcpdf, .lcpau)
+package rwpm
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+var ErrNoManifest = errors.New("No manifest.json in the package")
+
+const (
+	ManifestFile = "manifest.json"
+	LicenseFile  = "license.lcpl"
+
+	ContentType_PDF           = "application/pdf"
+	ContentType_LCP_PDF       = "application/pdf+lcp"
+	ContentType_AUDIOBOOK     = "application/audiobook+zip"
+	ContentType_LCP_AUDIOBOOK = "application/audiobook+lcp"
+	ContentType_MANIFEST      = "application/webpub+json"
+
+	Extension_LCP_PDF       = ".lcpdf"
+	Extension_LCP_AUDIOBOOK = ".lcpau"
+
+	TYPE_AUDIOBOOK    = "http://schema.org/Audiobook"
+	PROFILE_AUDIOBOOK = "https://readium.org/webpub-manifest/profiles/audiobook"
+
+	Context = "https://readium.org/webpub-manifest/context.jsonld"
+
+	// scheme of resources encrypted with a LCP content key
+	SCHEME_LCP = "http://readium.org/2014/11/lcp"
+)
+
+type Publication struct {
+	Context      string   `json:"@context,omitempty"`
+	Metadata     Metadata `json:"metadata"`
+	Links        []Link   `json:"links,omitempty"`
+	ReadingOrder []Link   `json:"readingOrder"`
+	Resources    []Link   `json:"resources,omitempty"`
+}
+
+type Metadata struct {
+	Type       string          `json:"@type,omitempty"`
+	ConformsTo string          `json:"conformsTo,omitempty"`
+	Identifier string          `json:"identifier,omitempty"`
+	Title      LocalizedString `json:"title"`
+	Author     Contributors    `json:"author,omitempty"`
+	Language   Strings         `json:"language,omitempty"`
+	Duration   float64         `json:"duration,omitempty"`
+}
+
+// LocalizedString is a string, or its translations by language: "title": {"en": "Moby-Dick", "fr": "Moby Dick"}
+type LocalizedString struct {
+	Text         string
+	Translations map[string]string
+}
+
+// String returns the text of a localized string, its undetermined or english translation
+// or else the first one in the order of the languages
+func (s LocalizedString) String() string {
+	if s.Translations == nil {
+		return s.Text
+	}
+	for _, lang := range []string{"und", "en"} {
+		if text, ok := s.Translations[lang]; ok {
+			return text
+		}
+	}
+	langs := make([]string, 0, len(s.Translations))
+	for lang := range s.Translations {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	if len(langs) == 0 {
+		return ""
+	}
+	return s.Translations[langs[0]]
+}
+
+func (s *LocalizedString) UnmarshalJSON(data []byte) error {
+	*s = LocalizedString{}
+	if isObject(data) {
+		return json.Unmarshal(data, &s.Translations)
+	}
+	return json.Unmarshal(data, &s.Text)
+}
+
+func (s LocalizedString) MarshalJSON() ([]byte, error) {
+	if s.Translations != nil {
+		return json.Marshal(s.Translations)
+	}
+	return json.Marshal(s.Text)
+}
+
+// Strings is a list of strings, which may be written as a single string: "language": "en"
+type Strings []string
+
+func (s *Strings) UnmarshalJSON(data []byte) error {
+	if isArray(data) || isNull(data) {
+		return json.Unmarshal(data, (*[]string)(s))
+	}
+	var one string
+	if err := json.Unmarshal(data, &one); err != nil {
+		return err
+	}
+	*s = Strings{one}
+	return nil
+}
+
+// Contributor is an author, or another contributor of the publication
+type Contributor struct {
+	Name       LocalizedString `json:"name"`
+	SortAs     string          `json:"sortAs,omitempty"`
+	Identifier string          `json:"identifier,omitempty"`
+	Role       Strings         `json:"role,omitempty"`
+	Links      []Link          `json:"links,omitempty"`
+}
+
+// contributor has the fields of Contributor, without its json methods
+type contributor Contributor
+
+// UnmarshalJSON reads a contributor written as its name, or as an object
+func (c *Contributor) UnmarshalJSON(data []byte) error {
+	*c = Contributor{}
+	if isObject(data) {
+		return json.Unmarshal(data, (*contributor)(c))
+	}
+	return json.Unmarshal(data, &c.Name)
+}
+
+// MarshalJSON writes a contributor as its name when it has no other property
+func (c Contributor) MarshalJSON() ([]byte, error) {
+	if c.Name.Translations == nil && c.SortAs == "" && c.Identifier == "" && len(c.Role) == 0 && len(c.Links) == 0 {
+		return json.Marshal(c.Name.Text)
+	}
+	return json.Marshal(contributor(c))
+}
+
+// Contributors is a list of contributors, which may be written as a single one
+type Contributors []Contributor
+
+func (cs *Contributors) UnmarshalJSON(data []byte) error {
+	if isArray(data) || isNull(data) {
+		return json.Unmarshal(data, (*[]Contributor)(cs))
+	}
+	var one Contributor
+	if err := json.Unmarshal(data, &one); err != nil {
+		return err
+	}
+	*cs = Contributors{one}
+	return nil
+}
+
+// Names returns the names of the contributors
+func (cs Contributors) Names() []string {
+	var names []string
+	for _, c := range cs {
+		names = append(names, c.Name.String())
+	}
+	return names
+}
+
+func isObject(data []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(data)), "{")
+}
+
+func isArray(data []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(data)), "[")
+}
+
+func isNull(data []byte) bool {
+	return strings.TrimSpace(string(data)) == "null"
+}
+
+type Link struct {
+	Href       string      `json:"href"`
+	Type       string      `json:"type,omitempty"`
+	Rel        []string    `json:"rel,omitempty"`
+	Title      string      `json:"title,omitempty"`
+	Duration   float64     `json:"duration,omitempty"`
+	Properties *Properties `json:"properties,omitempty"`
+}
+
+type Properties struct {
+	Encrypted *Encrypted `json:"encrypted,omitempty"`
+}
+
+// Encrypted tells a reading system how a resource of the package was encrypted
+type Encrypted struct {
+	Scheme         string `json:"scheme"`
+	Profile        string `json:"profile,omitempty"`
+	Algorithm      string `json:"algorithm"`
+	Compression    string `json:"compression,omitempty"`
+	OriginalLength int64  `json:"originalLength,omitempty"`
+}
+
+// LCPContentType returns the content type of the LCP protected package of the
+// publication, or an empty string if it is neither an audiobook nor a pdf
+func (p Publication) LCPContentType() string {
+	if p.Metadata.Type == TYPE_AUDIOBOOK || p.Metadata.ConformsTo == PROFILE_AUDIOBOOK || allOfType(p.ReadingOrder, "audio/") {
+		return ContentType_LCP_AUDIOBOOK
+	}
+	if allOfType(p.ReadingOrder, ContentType_PDF) {
+		return ContentType_LCP_PDF
+	}
+	return ""
+}
+
+func allOfType(links []Link, prefix string) bool {
+	for _, l := range links {
+		if !strings.HasPrefix(l.Type, prefix) {
+			return false
+		}
+	}
+	return len(links) > 0
+}
+
+// Extension returns the file extension of a LCP protected package of the given content type
+func Extension(contentType string) string {
+	switch contentType {
+	case ContentType_LCP_PDF:
+		return Extension_LCP_PDF
+	case ContentType_LCP_AUDIOBOOK:
+		return Extension_LCP_AUDIOBOOK
+	}
+	return ""
+}
+
+// FindManifest reads the manifest of the Readium package read from zr
+// ErrNoManifest is returned if zr is not a Readium package
+func FindManifest(zr *zip.Reader) (Publication, error) {
+	for _, f := range zr.File {
+		if f.Name == ManifestFile {
+			r, err := f.Open()
+			if err != nil {
+				return Publication{}, err
+			}
+			defer r.Close()
+			return Read(r)
+		}
+	}
+	return Publication{}, ErrNoManifest
+}
+
+func Read(r io.Reader) (Publication, error) {
+	var p Publication
+	err := json.NewDecoder(r).Decode(&p)
+	return p, err
+}
+
+func (p Publication) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rwpm
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadMetadata(t *testing.T) {
+	tests := []struct {
+		metadata string
+		title    string
+		authors  []string
+		language []string
+	}{
+		{`{"title": "Moby-Dick", "author": "Herman Melville", "language": "en"}`,
+			"Moby-Dick", []string{"Herman Melville"}, []string{"en"}},
+		{`{"title": "Moby-Dick", "author": ["Herman Melville", "Anonymous"], "language": ["en", "fr"]}`,
+			"Moby-Dick", []string{"Herman Melville", "Anonymous"}, []string{"en", "fr"}},
+		{`{"title": {"fr": "Moby Dick", "en": "Moby-Dick"}, "author": {"name": "Herman Melville", "sortAs": "Melville, Herman"}}`,
+			"Moby-Dick", []string{"Herman Melville"}, nil},
+		{`{"title": {"fr": "Moby Dick"}, "author": [{"name": {"fr": "Herman Melville"}}, "Anonymous"], "language": null}`,
+			"Moby Dick", []string{"Herman Melville", "Anonymous"}, nil},
+	}
+	for _, test := range tests {
+		p, err := Read(strings.NewReader(`{"metadata": ` + test.metadata + `, "readingOrder": []}`))
+		if err != nil {
+			t.Errorf("%s: %v", test.metadata, err)
+			continue
+		}
+		if title := p.Metadata.Title.String(); title != test.title {
+			t.Errorf("%s: expected the title %q, got %q", test.metadata, test.title, title)
+		}
+		if authors := p.Metadata.Author.Names(); !reflect.DeepEqual(authors, test.authors) {
+			t.Errorf("%s: expected the authors %q, got %q", test.metadata, test.authors, authors)
+		}
+		if language := []string(p.Metadata.Language); !reflect.DeepEqual(language, test.language) {
+			t.Errorf("%s: expected the languages %q, got %q", test.metadata, test.language, language)
+		}
+
+		// the manifest written back is read the same
+		var buf bytes.Buffer
+		if err = p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		written, err := Read(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(written.Metadata, p.Metadata) {
+			t.Errorf("%s: expected the same metadata once written, got %#v", test.metadata, written.Metadata)
+		}
+	}
+}
+
+func TestReadInvalidMetadata(t *testing.T) {
+	for _, metadata := range []string{`{"title": 1}`, `{"title": "Moby-Dick", "author": 1}`, `{"title": "Moby-Dick", "language": {"en": "en"}}`} {
+		if _, err := Read(strings.NewReader(`{"metadata": ` + metadata + `}`)); err == nil {
+			t.Errorf("%s: expected an error", metadata)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+var ErrNoValidCertificate = errors.New("No provider certificate is valid at this time")
+
+// CertificateStatus reports the validity window of a configured certificate
+type CertificateStatus struct {
+	File      string    `json:"file"`
+	Subject   string    `json:"subject"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Current   bool      `json:"current"`
+}
+
+type loadedCertificate struct {
+	file string
+	cert *tls.Certificate
+}
+
+// Certificates holds the certificates of a provider: the configured one and those of its rotation list.
+// The licenses are signed with the valid certificate which became valid last, so that the next certificate
+// takes over as soon as its validity window starts, while the previous one is used until then.
+type Certificates struct {
+	mu    sync.RWMutex
+	certs []loadedCertificate
+}
+
+// LoadCertificates loads the certificates configured in conf
+func LoadCertificates(conf config.Certificate) (*Certificates, error) {
+	cs := &Certificates{}
+	return cs, cs.Load(conf)
+}
+
+// Load replaces the certificates with the ones configured in conf, e.g. after they were renewed.
+// Each certificate must be signed by the root CA when one is configured.
+// The certificates in use are kept if one of the new ones can't be loaded.
+func (cs *Certificates) Load(conf config.Certificate) error {
+	var roots *x509.CertPool
+	if conf.RootCA != "" {
+		var err error
+		if roots, err = readRoots(conf.RootCA); err != nil {
+			return err
+		}
+	}
+	var certs []loadedCertificate
+	for _, c := range append([]config.Certificate{conf}, conf.Rotation...) {
+		cert, err := LoadCertificate(c)
+		if err == nil && cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err == nil && roots != nil {
+			err = verifyChain(cert, roots)
+		}
+		if err != nil {
+			return errors.New(c.Cert + ": " + err.Error())
+		}
+		certs = append(certs, loadedCertificate{c.Cert, &cert})
+	}
+
+	cs.mu.Lock()
+	cs.certs = certs
+	cs.mu.Unlock()
+	return nil
+}
+
+// Use replaces the certificates with those of other, which are shared without being loaded again
+func (cs *Certificates) Use(other *Certificates) {
+	other.mu.RLock()
+	certs := other.certs
+	other.mu.RUnlock()
+
+	cs.mu.Lock()
+	cs.certs = certs
+	cs.mu.Unlock()
+}
+
+// Current returns the certificate which signs the licenses now
+func (cs *Certificates) Current() (*tls.Certificate, error) {
+	return cs.At(time.Now())
+}
+
+// At returns the certificate which signs the licenses at the time t
+func (cs *Certificates) At(t time.Time) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	var current *tls.Certificate
+	for _, c := range cs.certs {
+		if t.Before(c.cert.Leaf.NotBefore) || t.After(c.cert.Leaf.NotAfter) {
+			continue
+		}
+		if current == nil || c.cert.Leaf.NotBefore.After(current.Leaf.NotBefore) {
+			current = c.cert
+		}
+	}
+	if current == nil {
+		return nil, ErrNoValidCertificate
+	}
+	return current, nil
+}
+
+// ValidUntil returns the end of the period which starts at t and is covered by the validity windows of the certificates,
+// t itself if no certificate is valid at this time
+func (cs *Certificates) ValidUntil(t time.Time) time.Time {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	windows := make([]*x509.Certificate, 0, len(cs.certs))
+	for _, c := range cs.certs {
+		windows = append(windows, c.cert.Leaf)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].NotBefore.Before(windows[j].NotBefore) })
+	end := t
+	for _, leaf := range windows {
+		if leaf.NotBefore.After(end) {
+			break
+		}
+		if leaf.NotAfter.After(end) {
+			end = leaf.NotAfter
+		}
+	}
+	return end
+}
+
+// Warnings returns the warnings about the certificates at the time t:
+// none is valid, or they all expire before t + warn
+func (cs *Certificates) Warnings(t time.Time, warn time.Duration) []string {
+	if _, err := cs.At(t); err != nil {
+		return []string{err.Error()}
+	}
+	if until := cs.ValidUntil(t); until.Before(t.Add(warn)) {
+		days := int(until.Sub(t).Hours() / 24)
+		return []string{"The provider certificates expire on " + until.Format(time.RFC3339) + ", in " + strconv.Itoa(days) + " days"}
+	}
+	return nil
+}
+
+// Status reports the validity window of each certificate at the time t
+func (cs *Certificates) Status(t time.Time) []CertificateStatus {
+	current, _ := cs.At(t)
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	status := make([]CertificateStatus, 0, len(cs.certs))
+	for _, c := range cs.certs {
+		leaf := c.cert.Leaf
+		status = append(status, CertificateStatus{
+			File:      c.file,
+			Subject:   leaf.Subject.String(),
+			Serial:    leaf.SerialNumber.String(),
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+			Current:   c.cert == current,
+		})
+	}
+	return status
+}
+
+// readRoots reads the PEM root certificates which the provider certificates must chain to
+func readRoots(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errors.New("No certificate found in " + file)
+	}
+	return roots, nil
+}
+
+// verifyChain checks that the certificate is signed by one of the roots, through the intermediate certificates of its chain.
+// It is checked at the start of its validity window, so that the next certificate may be configured in advance.
+func verifyChain(cert tls.Certificate, roots *x509.CertPool) error {
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   cert.Leaf.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
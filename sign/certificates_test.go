@@ -0,0 +1,147 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// writeCertificate creates a certificate valid from notBefore to notAfter, signed by parent or self-signed,
+// and writes it with its private key in dir
+func writeCertificate(t *testing.T, dir string, name string, notBefore, notAfter time.Time, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (config.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	conf := config.Certificate{Cert: filepath.Join(dir, name+".crt"), PrivateKey: filepath.Join(dir, name+".pem")}
+	ioutil.WriteFile(conf.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(conf.PrivateKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return conf, cert, key
+}
+
+func TestCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	day := 24 * time.Hour
+	rootConf, root, rootKey := writeCertificate(t, dir, "root", now.Add(-365*day), now.Add(365*day), nil, nil)
+	current, _, _ := writeCertificate(t, dir, "current", now.Add(-10*day), now.Add(5*day), root, rootKey)
+	next, nextCert, _ := writeCertificate(t, dir, "next", now.Add(2*day), now.Add(100*day), root, rootKey)
+	other, _, _ := writeCertificate(t, dir, "other", now.Add(-10*day), now.Add(100*day), nil, nil)
+
+	conf := current
+	conf.Rotation = []config.Certificate{next}
+	conf.RootCA = rootConf.Cert
+	cs, err := LoadCertificates(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := cs.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.Subject.CommonName != "current" {
+		t.Errorf("Expected the current certificate, got %s", cert.Leaf.Subject.CommonName)
+	}
+	if _, err = NewSigner(cert); err != nil {
+		t.Error(err)
+	}
+	if cert, _ = cs.At(now.Add(3 * day)); cert == nil || cert.Leaf.Subject.CommonName != "next" {
+		t.Error("Expected the next certificate once it is valid")
+	}
+	if _, err = cs.At(now.Add(200 * day)); err != ErrNoValidCertificate {
+		t.Error("Expected no valid certificate after the last one expired")
+	}
+	if until := cs.ValidUntil(now); !until.Equal(nextCert.NotAfter) {
+		t.Errorf("Expected the certificates to be valid until %s, got %s", nextCert.NotAfter, until)
+	}
+	if status := cs.Status(now); len(status) != 2 || !status[0].Current || status[1].Current {
+		t.Errorf("Unexpected status %v", status)
+	}
+
+	if warnings := cs.Warnings(now, 30*day); len(warnings) != 0 {
+		t.Errorf("Expected no warning while the next certificate is valid, got %v", warnings)
+	}
+	if warnings := cs.Warnings(now, 120*day); len(warnings) != 1 {
+		t.Error("Expected a warning when the certificates expire within the warning period")
+	}
+	if warnings := cs.Warnings(now.Add(200*day), day); len(warnings) != 1 || warnings[0] != ErrNoValidCertificate.Error() {
+		t.Error("Expected a warning when no certificate is valid")
+	}
+
+	// a certificate which is not signed by the root CA is refused, and the certificates in use are kept
+	conf.Rotation = []config.Certificate{other}
+	if err = cs.Load(conf); err == nil {
+		t.Error("Expected a certificate of another CA to be refused")
+	}
+	if status := cs.Status(now); len(status) != 2 {
+		t.Error("Expected the certificates in use to be kept")
+	}
+
+	// without rotation, the certificates are valid until the current one expires
+	conf.Rotation = nil
+	if err = cs.Load(conf); err != nil {
+		t.Fatal(err)
+	}
+	if until := cs.ValidUntil(now); until.Sub(now) > 6*day {
+		t.Errorf("Expected the certificates to expire with the current one, got %s", until)
+	}
+}
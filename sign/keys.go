@@ -0,0 +1,101 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// types of signer, where the private key of the provider is
+const (
+	SIGNER_FILE   = "file"
+	SIGNER_PKCS11 = "pkcs11"
+	SIGNER_HTTP   = "http"
+)
+
+// LoadCertificate returns the provider certificate with its private key.
+// With the file signer the key is read from its file; with the pkcs11 and http signers
+// the private key is a crypto.Signer which never leaves the token or the remote service.
+func LoadCertificate(conf config.Certificate) (tls.Certificate, error) {
+	if conf.Signer.Type == "" || conf.Signer.Type == SIGNER_FILE {
+		return tls.LoadX509KeyPair(conf.Cert, conf.PrivateKey)
+	}
+
+	cert, err := readCertificate(conf.Cert)
+	if err != nil {
+		return cert, err
+	}
+	var key crypto.Signer
+	release := func() {}
+	switch conf.Signer.Type {
+	case SIGNER_PKCS11:
+		key, release, err = pkcs11Key(conf.Signer.Pkcs11)
+	case SIGNER_HTTP:
+		key, err = NewRemoteKey(conf.Signer.Http, cert.Leaf.PublicKey)
+	default:
+		err = errors.New("Unknown signer type " + conf.Signer.Type + ", must be file, pkcs11 or http")
+	}
+	if err != nil {
+		return cert, err
+	}
+	if publicKey, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(cert.Leaf.PublicKey) {
+		release()
+		return cert, errors.New("The private key of the signer does not match the certificate")
+	}
+	cert.PrivateKey = key
+	return cert, nil
+}
+
+// readCertificate reads a PEM certificate chain without its private key
+func readCertificate(certFile string) (tls.Certificate, error) {
+	var cert tls.Certificate
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return cert, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, errors.New("No certificate found in " + certFile)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// pkcs11Token identifies a token, which keeps a single context: a context opens a pool of sessions
+// on the token, so the certificates reloaded on SIGHUP reuse it instead of opening a new one
+type pkcs11Token struct {
+	library, label, pin string
+}
+
+var pkcs11Contexts = struct {
+	sync.Mutex
+	contexts map[pkcs11Token]*crypto11.Context
+}{contexts: make(map[pkcs11Token]*crypto11.Context)}
+
+// Pkcs11Key finds the key pair of the provider in a PKCS#11 token (an HSM, or SoftHSM for tests),
+// by its label or its hex encoded id. The private key stays in the token, which signs the digests.
+// The PIN may be set in the PKCS11_PIN environment variable instead of the configuration.
+func Pkcs11Key(conf config.Pkcs11Signer) (crypto.Signer, error) {
+	key, _, err := pkcs11Key(conf)
+	return key, err
+}
+
+// pkcs11Key returns the key pair and a function releasing the context of the token
+// if it was opened for this key, when the key is finally not used
+func pkcs11Key(conf config.Pkcs11Signer) (crypto.Signer, func(), error) {
+	pin := conf.Pin
+	if pin == "" {
+		pin = os.Getenv("PKCS11_PIN")
+	}
+	var id, label []byte
+	var err error
+	if conf.KeyId != "" {
+		if id, err = hex.DecodeString(conf.KeyId); err != nil {
+			return nil, nil, err
+		}
+	}
+	if conf.KeyLabel != "" {
+		label = []byte(conf.KeyLabel)
+	}
+	if id == nil && label == nil {
+		return nil, nil, errors.New("Must specify the label or the id of the PKCS#11 key")
+	}
+
+	token := pkcs11Token{library: conf.Library, label: conf.TokenLabel, pin: pin}
+	pkcs11Contexts.Lock()
+	defer pkcs11Contexts.Unlock()
+	release := func() {}
+	ctx, ok := pkcs11Contexts.contexts[token]
+	if !ok {
+		if ctx, err = crypto11.Configure(&crypto11.Config{Path: conf.Library, TokenLabel: conf.TokenLabel, Pin: pin}); err != nil {
+			return nil, nil, err
+		}
+		pkcs11Contexts.contexts[token] = ctx
+		release = func() {
+			pkcs11Contexts.Lock()
+			defer pkcs11Contexts.Unlock()
+			if pkcs11Contexts.contexts[token] == ctx {
+				delete(pkcs11Contexts.contexts, token)
+			}
+			ctx.Close()
+		}
+	}
+
+	key, err := ctx.FindKeyPair(id, label)
+	if err == nil && key == nil {
+		err = errors.New("The key was not found in the PKCS#11 token")
+	}
+	if err != nil {
+		if !ok {
+			delete(pkcs11Contexts.contexts, token)
+			ctx.Close()
+		}
+		return nil, nil, err
+	}
+	return key, release, nil
+}
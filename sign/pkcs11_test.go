@@ -0,0 +1,105 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ThalesIgnite/crypto11"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// TestPkcs11Signer runs against a SoftHSM token, e.g. after
+// softhsm2-util --init-token --free --label lcp --pin 1234 --so-pin 1234
+// with PKCS11_LIBRARY=/usr/lib/softhsm/libsofthsm2.so PKCS11_TOKEN=lcp PKCS11_PIN=1234
+func TestPkcs11Signer(t *testing.T) {
+	library, token := os.Getenv("PKCS11_LIBRARY"), os.Getenv("PKCS11_TOKEN")
+	if library == "" || token == "" {
+		t.Skip("PKCS11_LIBRARY and PKCS11_TOKEN are not set")
+	}
+	conf := config.Pkcs11Signer{Library: library, TokenLabel: token, KeyLabel: "lcp-test"}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: library, TokenLabel: token, Pin: os.Getenv("PKCS11_PIN")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := ctx.GenerateRSAKeyPairWithLabel([]byte("lcp-test-id"), []byte(conf.KeyLabel), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generated.Delete()
+
+	key, err := Pkcs11Key(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a reloaded certificate reuses the context of the token
+	if _, err = Pkcs11Key(conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(pkcs11Contexts.contexts) != 1 {
+		t.Errorf("Expected a single context for the token, got %d", len(pkcs11Contexts.contexts))
+	}
+	missing := conf
+	missing.KeyLabel = "lcp-missing"
+	if _, err = Pkcs11Key(missing); err == nil {
+		t.Error("Expected an error for a key which is not in the token")
+	}
+	if len(pkcs11Contexts.contexts) != 1 {
+		t.Errorf("Expected the context of the token to be kept, got %d contexts", len(pkcs11Contexts.contexts))
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lcp-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := map[string]string{"test": "test"}
+	sig, err := signer.Sign(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(input, sig); err != nil {
+		t.Errorf("Expected the PKCS#11 signature to be valid, got %s", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+// RemoteSignRequest is sent to a remote signer, the digest is the SHA-256 hash of the canonical license
+type RemoteSignRequest struct {
+	KeyId  string `json:"key_id,omitempty"`
+	Hash   string `json:"hash"`
+	Digest []byte `json:"digest"`
+}
+
+// RemoteSignResponse holds a PKCS#1 v1.5 signature for an RSA key, an ASN.1 signature for an ECDSA key
+type RemoteSignResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// remoteKey is a crypto.Signer which posts the digests to a remote signing service
+type remoteKey struct {
+	conf      config.HttpSigner
+	publicKey crypto.PublicKey
+	client    *http.Client
+}
+
+// NewRemoteKey returns a crypto.Signer for the key of a remote signer, whose public key is in the provider certificate
+func NewRemoteKey(conf config.HttpSigner, publicKey crypto.PublicKey) (crypto.Signer, error) {
+	if conf.Url == "" {
+		return nil, errors.New("Must specify the url of the remote signer")
+	}
+	return &remoteKey{conf: conf, publicKey: publicKey, client: &http.Client{Timeout: 15 * time.Second}}, nil
+}
+
+func (k *remoteKey) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+func (k *remoteKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("The remote signer only signs SHA-256 digests")
+	}
+	body, err := json.Marshal(RemoteSignRequest{KeyId: k.conf.KeyId, Hash: "SHA-256", Digest: digest})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", k.conf.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.conf.Username != "" {
+		req.SetBasicAuth(k.conf.Username, k.conf.Password)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("The remote signer returned " + resp.Status)
+	}
+	var res RemoteSignResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Signature) == 0 {
+		return nil, errors.New("The remote signer returned no signature")
+	}
+	return res.Signature, nil
+}
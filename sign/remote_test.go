@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func TestRemoteSigner(t *testing.T) {
+	for _, name := range []string{"rsa", "ecdsa"} {
+		sample, err := tls.LoadX509KeyPair("cert/sample_"+name+".crt", "cert/sample_"+name+".pem")
+		if err != nil {
+			t.Fatal("Couldn't load sample certificate ", err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req RemoteSignRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Hash != "SHA-256" || req.KeyId != "provider" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			value, err := sample.PrivateKey.(crypto.Signer).Sign(rand.Reader, req.Digest, crypto.SHA256)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(RemoteSignResponse{Signature: value})
+		}))
+
+		conf := config.Certificate{Cert: "cert/sample_" + name + ".crt"}
+		conf.Signer.Type = SIGNER_HTTP
+		conf.Signer.Http = config.HttpSigner{Url: server.URL, KeyId: "provider"}
+		cert, err := LoadCertificate(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := NewSigner(&cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input := map[string]string{"test": "test"}
+		sig, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Verify(input, sig); err != nil {
+			t.Errorf("Expected the remote %s signature to be valid, got %s", name, err)
+		}
+		server.Close()
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	conf := config.Certificate{Cert: "cert/sample_rsa.crt", PrivateKey: "cert/sample_rsa.pem"}
+	cert, err := LoadCertificate(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSigner(&cert); err != nil {
+		t.Error(err)
+	}
+
+	conf.Signer.Type = SIGNER_HTTP
+	if _, err = LoadCertificate(conf); err == nil {
+		t.Error("Expected a remote signer without url to be refused")
+	}
+
+	conf.Signer.Type = "unknown"
+	if _, err = LoadCertificate(conf); err == nil {
+		t.Error("Expected an unknown signer to be refused")
+	}
+}
@@ -32,8 +32,15 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/asn1"
 	"errors"
 	"math"
+	"math/big"
+)
+
+const (
+	ALGORITHM_ECDSA_SHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	ALGORITHM_RSA_SHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
 )
 
 type Signer interface {
@@ -81,7 +88,7 @@ func (signer *ecdsaSigner) Sign(in interface{}) (sig Signature, err error) {
 	copyWithLeftPad(sig.Value[0:curveSizeInBytes], r.Bytes())
 	copyWithLeftPad(sig.Value[curveSizeInBytes:], s.Bytes())
 
-	sig.Algorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	sig.Algorithm = ALGORITHM_ECDSA_SHA256
 	sig.Certificate = signer.cert.Certificate[0]
 	return
 }
@@ -104,20 +111,65 @@ func (signer *rsaSigner) Sign(in interface{}) (sig Signature, err error) {
 		return
 	}
 
-	sig.Algorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	sig.Algorithm = ALGORITHM_RSA_SHA256
 	sig.Certificate = signer.cert.Certificate[0]
 
 	return
 }
 
+// Any other key, which signs without exposing the private key: a PKCS#11 token or a remote signer
+type keySigner struct {
+	key  crypto.Signer
+	cert *tls.Certificate
+}
+
+func (signer *keySigner) Sign(in interface{}) (sig Signature, err error) {
+	plain, err := Canon(in)
+	if err != nil {
+		return
+	}
+
+	hashed := sha256.Sum256(plain)
+	value, err := signer.key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return
+	}
+
+	switch publicKey := signer.key.Public().(type) {
+	case *rsa.PublicKey:
+		sig.Value = value
+		sig.Algorithm = ALGORITHM_RSA_SHA256
+	case *ecdsa.PublicKey:
+		// a crypto.Signer returns an ASN.1 sequence of r and s, padded and concatenated as in ecdsaSigner
+		var rs struct{ R, S *big.Int }
+		if _, err = asn1.Unmarshal(value, &rs); err != nil {
+			return
+		}
+		curveSizeInBytes := int(math.Ceil(float64(publicKey.Curve.Params().BitSize) / 8))
+		sig.Value = make([]byte, 2*curveSizeInBytes)
+		copyWithLeftPad(sig.Value[0:curveSizeInBytes], rs.R.Bytes())
+		copyWithLeftPad(sig.Value[curveSizeInBytes:], rs.S.Bytes())
+		sig.Algorithm = ALGORITHM_ECDSA_SHA256
+	default:
+		err = errors.New("Unsupported certificate type")
+		return
+	}
+
+	sig.Certificate = signer.cert.Certificate[0]
+	return
+}
+
 // Creates a new signer given the certificate type. Currently supports
-// RSA (PKCS1v15) and ECDSA (SHA256 is used in both cases)
+// RSA (PKCS1v15) and ECDSA (SHA256 is used in both cases), with a private key
+// in memory or held by a crypto.Signer
 func NewSigner(certificate *tls.Certificate) (Signer, error) {
 	switch k := certificate.PrivateKey.(type) {
 	case *ecdsa.PrivateKey:
 		return &ecdsaSigner{k, certificate}, nil
 	case *rsa.PrivateKey:
 		return &rsaSigner{k, certificate}, nil
+	case crypto.Signer:
+		return &keySigner{k, certificate}, nil
 	}
 
 	return nil, errors.New("Unsupported certificate type")
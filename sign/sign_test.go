@@ -112,3 +112,30 @@ func getParamsFromECDSASignature(b []byte) (*big.Int, *big.Int) {
 
 	return r, s
 }
+
+func TestVerify(t *testing.T) {
+	for _, name := range []string{"rsa", "ecdsa"} {
+		cert, err := tls.LoadX509KeyPair("cert/sample_"+name+".crt", "cert/sample_"+name+".pem")
+		if err != nil {
+			t.Fatal("Couldn't load sample certificate ", err)
+		}
+		signer, err := NewSigner(&cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input := map[string]string{"test": "test"}
+		sig, err := signer.Sign(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Verify(input, sig); err != nil {
+			t.Errorf("Expected the %s signature to be valid, got %s", name, err)
+		}
+
+		tampered := map[string]string{"test": "tampered"}
+		if err = Verify(tampered, sig); err != ErrInvalidSignature {
+			t.Errorf("Expected the %s signature of a tampered input to be invalid, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"math/big"
+)
+
+var ErrInvalidSignature = errors.New("Invalid signature")
+
+// Verify checks that sig is a valid signature of the canonical form of in,
+// using the public key of the certificate embedded in the signature
+func Verify(in interface{}, sig Signature) error {
+	cert, err := x509.ParseCertificate(sig.Certificate)
+	if err != nil {
+		return err
+	}
+
+	plain, err := Canon(in)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(plain)
+
+	switch sig.Algorithm {
+	case ALGORITHM_RSA_SHA256:
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("The certificate does not hold an RSA public key")
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig.Value) != nil {
+			return ErrInvalidSignature
+		}
+	case ALGORITHM_ECDSA_SHA256:
+		key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("The certificate does not hold an ECDSA public key")
+		}
+		// the signature is the concatenation of r and s, see ecdsaSigner
+		half := len(sig.Value) / 2
+		r := new(big.Int).SetBytes(sig.Value[:half])
+		s := new(big.Int).SetBytes(sig.Value[half:])
+		if !ecdsa.Verify(key, hashed[:], r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return errors.New("Unsupported signature algorithm " + sig.Algorithm)
+	}
+
+	return nil
+}
@@ -26,6 +26,7 @@
 package storage
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -55,6 +56,29 @@ func (i fsItem) Contents() (io.ReadCloser, error) {
 	return os.Open(filepath.Join(i.storageDir, i.name))
 }
 
+func (i fsItem) ReaderAt() (ReadAtCloser, int64, error) {
+	file, err := os.Open(filepath.Join(i.storageDir, i.name))
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, stat.Size(), nil
+}
+
+// Stat derives the entity tag of the file from its size and modification time
+func (i fsItem) Stat() (ItemInfo, error) {
+	stat, err := os.Stat(filepath.Join(i.storageDir, i.name))
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	etag := fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size())
+	return ItemInfo{Size: stat.Size(), ModTime: stat.ModTime(), ETag: etag}, nil
+}
+
 func (s fsStorage) Add(key string, r io.ReadSeeker) (Item, error) {
 	file, err := os.Create(filepath.Join(s.fspath, key))
 	if err != nil {
@@ -84,7 +108,11 @@ func (s fsStorage) Get(key string) (Item, error) {
 }
 
 func (s fsStorage) Remove(key string) error {
-	return os.Remove(filepath.Join(s.fspath, key))
+	err := os.Remove(filepath.Join(s.fspath, key))
+	if os.IsNotExist(err) {
+		return NotFound
+	}
+	return err
 }
 
 func (s fsStorage) List() ([]Item, error) {
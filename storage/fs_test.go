@@ -75,6 +75,14 @@ func TestFileSystemStorage(t *testing.T) {
 		}
 	}
 
+	info, err := item.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 8 || info.ETag == "" {
+		t.Errorf("expected the size and entity tag of the item, got %d %s", info.Size, info.ETag)
+	}
+
 	results, err := store.List()
 	if err != nil {
 		t.Fatal(err)
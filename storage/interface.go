@@ -28,14 +28,33 @@ package storage
 import (
 	"errors"
 	"io"
+	"time"
 )
 
 var NotFound = errors.New("Item could not be found")
 
+// ReadAtCloser gives random access to the contents of an item
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// ItemInfo describes the stored contents of an item
+type ItemInfo struct {
+	Size    int64
+	ModTime time.Time
+	ETag    string
+}
+
 type Item interface {
 	Key() string
 	PublicUrl() string
 	Contents() (io.ReadCloser, error)
+	// ReaderAt returns random access to the contents of the item and its size,
+	// so that large items can be read without holding them in memory
+	ReaderAt() (ReadAtCloser, int64, error)
+	// Stat returns the size, modification time and entity tag of the item
+	Stat() (ItemInfo, error)
 }
 
 type Store interface {
@@ -28,6 +28,10 @@ package storage
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -50,8 +54,9 @@ func (i s3item) Key() string {
 	return i.key
 }
 
+// PublicUrl returns the path-style URL of the object, the endpoint of the client includes the scheme
 func (i s3item) PublicUrl() string {
-	return fmt.Sprintf("http://%s/%s/%s", i.store.client.Endpoint, i.bucket, i.key)
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(i.store.client.Endpoint, "/"), i.bucket, i.key)
 }
 
 func (i s3item) Contents() (io.ReadCloser, error) {
@@ -63,6 +68,105 @@ func (i s3item) Contents() (io.ReadCloser, error) {
 	return resp.Body, err
 }
 
+// s3ChunkSize is the size of the ranged GETs issued by ReaderAt;
+// only the last chunk read is kept in memory
+const s3ChunkSize = 1 << 20
+
+func (i s3item) ReaderAt() (ReadAtCloser, int64, error) {
+	head, err := i.store.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(i.store.bucket),
+		Key:    aws.String(i.key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	size := aws.Int64Value(head.ContentLength)
+	return &s3reader{item: i, size: size}, size, nil
+}
+
+// Stat returns the entity tag given by S3
+func (i s3item) Stat() (ItemInfo, error) {
+	head, err := i.store.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(i.store.bucket),
+		Key:    aws.String(i.key),
+	})
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	return ItemInfo{
+		Size:    aws.Int64Value(head.ContentLength),
+		ModTime: aws.TimeValue(head.LastModified),
+		ETag:    aws.StringValue(head.ETag),
+	}, nil
+}
+
+// s3reader implements io.ReaderAt over ranged GET requests
+type s3reader struct {
+	sync.Mutex
+	item  s3item
+	size  int64
+	off   int64
+	chunk []byte
+}
+
+func (r *s3reader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for n < len(p) && off < r.size {
+		if off < r.off || off >= r.off+int64(len(r.chunk)) {
+			if err := r.fetch(off, len(p)-n); err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], r.chunk[off-r.off:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch loads at least min bytes starting at off, in chunks of s3ChunkSize
+func (r *s3reader) fetch(off int64, min int) error {
+	length := int64(s3ChunkSize)
+	if int64(min) > length {
+		length = int64(min)
+	}
+	if off+length > r.size {
+		length = r.size - off
+	}
+	resp, err := r.item.store.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.item.store.bucket),
+		Key:    aws.String(r.item.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+length-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	chunk, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if len(chunk) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.off = off
+	r.chunk = chunk
+	return nil
+}
+
+func (r *s3reader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
 func (s *s3store) Add(key string, r io.ReadSeeker) (Item, error) {
 	_, err := s.client.PutObject(&s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -75,6 +179,15 @@ func (s *s3store) Add(key string, r io.ReadSeeker) (Item, error) {
 	return item, err
 }
 
+// SignedUrl returns a presigned URL of the object, valid for ttl
+func (s *s3store) SignedUrl(key string, ttl time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
 func (s *s3store) Get(key string) (Item, error) {
 	_, err := s.client.HeadObject(&s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -92,22 +205,34 @@ func (s *s3store) Remove(key string) error {
 	return err
 }
 
+// List returns all the objects of the bucket, reading the listing page by page
 func (s *s3store) List() ([]Item, error) {
-	objects, err := s.client.ListObjects(&s3.ListObjectsInput{
-		Bucket: aws.String(s.bucket),
-	})
+	var items []Item
+	var marker *string
 
-	if err != nil {
-		return nil, err
-	}
+	for {
+		objects, err := s.client.ListObjects(&s3.ListObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Marker: marker,
+		})
 
-	var items []Item
+		if err != nil {
+			return nil, err
+		}
 
-	for _, o := range objects.Contents {
-		items = append(items, s3item{bucket: s.bucket, key: *o.Key, store: s})
-	}
+		for _, o := range objects.Contents {
+			items = append(items, s3item{bucket: s.bucket, key: *o.Key, store: s})
+		}
 
-	return items, nil
+		if !aws.BoolValue(objects.IsTruncated) || len(objects.Contents) == 0 {
+			return items, nil
+		}
+		// the next marker is only returned with a delimiter, otherwise the listing resumes after the last key
+		marker = objects.NextMarker
+		if marker == nil {
+			marker = objects.Contents[len(objects.Contents)-1].Key
+		}
+	}
 }
 
 type S3Config struct {
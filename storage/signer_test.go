@@ -0,0 +1,67 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACSigner(t *testing.T) {
+	signer := HMACSigner{BaseUrl: "http://localhost/files", Secret: []byte("secret")}
+
+	signed, err := signer.SignedUrl("test.v2", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed, "http://localhost/files/test.v2?") {
+		t.Fatalf("expected the url of the item, got %s", signed)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, signature := u.Query().Get("expires"), u.Query().Get("signature")
+
+	if err = signer.Verify("test.v2", expires, signature); err != nil {
+		t.Error(err)
+	}
+	if err = signer.Verify("test", expires, signature); err != ErrInvalidSignature {
+		t.Error("expected the signature of another item to be refused")
+	}
+	other := HMACSigner{BaseUrl: signer.BaseUrl, Secret: []byte("other")}
+	if err = other.Verify("test.v2", expires, signature); err != ErrInvalidSignature {
+		t.Error("expected a signature with another secret to be refused")
+	}
+
+	expired, _ := signer.SignedUrl("test.v2", -time.Minute)
+	u, _ = url.Parse(expired)
+	if err = signer.Verify("test.v2", u.Query().Get("expires"), u.Query().Get("signature")); err != ErrInvalidSignature {
+		t.Error("expected an expired signature to be refused")
+	}
+}
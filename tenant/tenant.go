@@ -0,0 +1,271 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tenant
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/readium/readium-lcp-server/config"
+	"github.com/readium/readium-lcp-server/problem"
+	"github.com/readium/readium-lcp-server/sign"
+)
+
+// PATH_PREFIX binds a request to a tenant: /tenants/{id}/licenses is /licenses for the tenant id
+const PATH_PREFIX = "/tenants/"
+
+var ErrUnknownTenant = errors.New("Unknown tenant")
+
+// Tenant holds the settings of a publisher or imprint.
+// The default tenant, whose id is empty, holds the settings of the top level of the configuration;
+// it is used when an authenticated request is not bound to a tenant, and sees the rows of all the tenants.
+// The anonymous tenant has the settings of the default tenant, but sees no row: it is used for unauthenticated requests.
+type Tenant struct {
+	Id             string
+	Provider       string
+	Links          map[string]string
+	LicenseLinkUrl string
+	Certificate    *sign.Certificates
+	certificate    config.Certificate
+	anonymous      bool
+}
+
+// Owns tells if a row stored for the tenant owner may be used by t
+func (t *Tenant) Owns(owner string) bool {
+	return !t.anonymous && (t.Id == "" || t.Id == owner)
+}
+
+// Anonymous tells if t is the tenant of an unauthenticated request
+func (t *Tenant) Anonymous() bool {
+	return t.anonymous
+}
+
+// Tenants is the registry of the configured tenants
+type Tenants struct {
+	def       *Tenant
+	anonymous *Tenant
+	byId      map[string]*Tenant
+	byUser    map[string]*Tenant
+}
+
+type contextKey struct{}
+
+// New builds the registry of the tenants configured in confs, def being the default tenant.
+// The provider, links and license link of def apply to the tenants which do not set them.
+func New(def Tenant, confs []config.Tenant) (*Tenants, error) {
+	if def.Certificate == nil {
+		def.Certificate = &sign.Certificates{}
+	}
+	anonymous := def
+	anonymous.anonymous = true
+	ts := &Tenants{def: &def, anonymous: &anonymous, byId: make(map[string]*Tenant), byUser: make(map[string]*Tenant)}
+	for _, conf := range confs {
+		if conf.Id == "" || strings.Contains(conf.Id, "/") {
+			return nil, errors.New("Invalid tenant id: \"" + conf.Id + "\"")
+		}
+		if _, exists := ts.byId[conf.Id]; exists {
+			return nil, errors.New("Duplicate tenant id: " + conf.Id)
+		}
+		// the license status server finds the tenant of a license by its provider
+		for _, other := range ts.byId {
+			if conf.Provider != "" && other.Provider == conf.Provider {
+				return nil, errors.New("The tenants " + other.Id + " and " + conf.Id + " have the same provider")
+			}
+		}
+		t := &Tenant{Id: conf.Id, Provider: conf.Provider, LicenseLinkUrl: conf.LicenseLinkUrl, Certificate: &sign.Certificates{}, certificate: conf.Certificate}
+		if t.Provider == "" {
+			t.Provider = def.Provider
+		}
+		if t.LicenseLinkUrl == "" {
+			t.LicenseLinkUrl = def.LicenseLinkUrl
+		}
+		t.Links = make(map[string]string)
+		for rel, href := range def.Links {
+			t.Links[rel] = href
+		}
+		for rel, href := range conf.Links {
+			t.Links[rel] = href
+		}
+		for _, user := range conf.Users {
+			if other, exists := ts.byUser[user]; exists {
+				return nil, errors.New("User " + user + " belongs to the tenants " + other.Id + " and " + conf.Id)
+			}
+			ts.byUser[user] = t
+		}
+		ts.byId[conf.Id] = t
+	}
+	return ts, nil
+}
+
+// LoadCertificates loads the signing certificates of the tenants, conf being the certificate of the default tenant.
+// The tenants without their own certificate sign with the certificates of the default tenant,
+// those without their own root CA are checked against the root CA of conf.
+// The certificates are loaded again when it is called again, e.g. after they were renewed:
+// all of them are loaded before any is replaced, the certificates in use are kept if one fails.
+func (ts *Tenants) LoadCertificates(conf config.Certificate) error {
+	return ts.loadCertificates(conf, nil)
+}
+
+// ReloadCertificates updates the certificate settings of the tenants from a new configuration, then loads their certificates again.
+// The other settings of the tenants are not updated, and the tenants which were not configured before are ignored.
+// Neither the settings nor the certificates are changed if one of the certificates can't be loaded.
+func (ts *Tenants) ReloadCertificates(conf config.Certificate, confs []config.Tenant) error {
+	settings := make(map[string]config.Certificate)
+	for _, c := range confs {
+		settings[c.Id] = c.Certificate
+	}
+	return ts.loadCertificates(conf, settings)
+}
+
+// loadCertificates loads the certificates of the default tenant from conf and those of the tenants from settings,
+// or else from their current settings, then replaces the certificates of all the tenants
+func (ts *Tenants) loadCertificates(conf config.Certificate, settings map[string]config.Certificate) error {
+	def, err := sign.LoadCertificates(conf)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[*Tenant]*sign.Certificates)
+	newSettings := make(map[*Tenant]config.Certificate)
+	for _, t := range ts.byId {
+		c, ok := settings[t.Id]
+		if !ok {
+			c = t.certificate
+		}
+		newSettings[t] = c
+		if c.Cert == "" {
+			loaded[t] = def
+			continue
+		}
+		if c.RootCA == "" {
+			c.RootCA = conf.RootCA
+		}
+		if loaded[t], err = sign.LoadCertificates(c); err != nil {
+			return errors.New("Certificate of the tenant " + t.Id + ": " + err.Error())
+		}
+	}
+
+	ts.def.Certificate.Use(def)
+	for t, certs := range loaded {
+		t.Certificate.Use(certs)
+		t.certificate = newSettings[t]
+	}
+	return nil
+}
+
+// All returns the default tenant, then the configured tenants in the order of their ids
+func (ts *Tenants) All() []*Tenant {
+	ids := make([]string, 0, len(ts.byId))
+	for id := range ts.byId {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	all := []*Tenant{ts.def}
+	for _, id := range ids {
+		all = append(all, ts.byId[id])
+	}
+	return all
+}
+
+// Default returns the default tenant
+func (ts *Tenants) Default() *Tenant {
+	return ts.def
+}
+
+// Get returns the tenant id, the default tenant if id is empty
+func (ts *Tenants) Get(id string) (*Tenant, error) {
+	if id == "" {
+		return ts.def, nil
+	}
+	if t, ok := ts.byId[id]; ok {
+		return t, nil
+	}
+	return nil, ErrUnknownTenant
+}
+
+// ByProvider returns the tenant of a provider, the default tenant if no tenant has this provider
+func (ts *Tenants) ByProvider(provider string) *Tenant {
+	for _, t := range ts.byId {
+		if t.Provider == provider && t.Provider != ts.def.Provider {
+			return t
+		}
+	}
+	return ts.def
+}
+
+// FromRequest returns the tenant a request was bound to by Handler, the default tenant if it was not handled by Handler
+func (ts *Tenants) FromRequest(r *http.Request) *Tenant {
+	if t, ok := r.Context().Value(contextKey{}).(*Tenant); ok {
+		return t
+	}
+	return ts.def
+}
+
+// Handler binds the requests to their tenant before passing them to next.
+// The /tenants/{id} prefix of the path selects a tenant and is removed from the path.
+// Only a request authenticated by authenticator is bound to a tenant: a user of a tenant is bound to it
+// and may not use the prefix of another tenant, the other users are bound to the tenant of the prefix,
+// or else to the default tenant. A request which is not authenticated is bound to the anonymous tenant.
+func (ts *Tenants) Handler(next http.Handler, authenticator *auth.BasicAuth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := ts.def
+		prefixed := strings.HasPrefix(r.URL.Path, PATH_PREFIX)
+		if prefixed {
+			id := strings.TrimPrefix(r.URL.Path, PATH_PREFIX)
+			path := "/"
+			if i := strings.Index(id, "/"); i >= 0 {
+				id, path = id[:i], id[i:]
+			}
+			var err error
+			if t, err = ts.Get(id); err != nil || id == "" {
+				problem.Error(w, r, problem.Problem{Detail: ErrUnknownTenant.Error(), Instance: id}, http.StatusNotFound)
+				return
+			}
+			u := *r.URL
+			u.Path, u.RawPath = path, ""
+			r = r.WithContext(r.Context())
+			r.URL = &u
+		}
+		user := ""
+		if authenticator != nil && r.Header.Get("Authorization") != "" {
+			user = authenticator.CheckAuth(r)
+		}
+		if user == "" {
+			t = ts.anonymous
+		} else if ut, ok := ts.byUser[user]; ok {
+			if prefixed && ut != t {
+				problem.Error(w, r, problem.Problem{Detail: "User " + user + " does not belong to the tenant " + t.Id}, http.StatusForbidden)
+				return
+			}
+			t = ut
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, t)))
+	})
+}
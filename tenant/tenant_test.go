@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tenant
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+
+	"github.com/readium/readium-lcp-server/config"
+)
+
+func testTenants(t *testing.T) *Tenants {
+	def := Tenant{Provider: "http://example.com", Links: map[string]string{"hint": "http://example.com/hint", "status": "http://lsd/{license_id}"}}
+	ts, err := New(def, []config.Tenant{
+		{Id: "alpha", Provider: "http://alpha.com", Users: []string{"alice"}, Links: map[string]string{"hint": "http://alpha.com/hint"}},
+		{Id: "beta", Users: []string{"bob"}, LicenseLinkUrl: "http://beta.com/licenses/{license_id}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func TestTenants(t *testing.T) {
+	ts := testTenants(t)
+
+	alpha, err := ts.Get("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alpha.Links["hint"] != "http://alpha.com/hint" || alpha.Links["status"] != "http://lsd/{license_id}" {
+		t.Errorf("expected the links of the tenant over the default links, got %v", alpha.Links)
+	}
+	beta, _ := ts.Get("beta")
+	if beta.Provider != "http://example.com" {
+		t.Errorf("expected the default provider, got %s", beta.Provider)
+	}
+	if _, err = ts.Get("gamma"); err != ErrUnknownTenant {
+		t.Error("expected an unknown tenant")
+	}
+	if def, _ := ts.Get(""); def != ts.Default() || !def.Owns("alpha") {
+		t.Error("expected the default tenant to own the rows of all the tenants")
+	}
+	if alpha.Owns("beta") || !alpha.Owns("alpha") {
+		t.Error("expected a tenant to own only its rows")
+	}
+	if ts.ByProvider("http://alpha.com") != alpha || ts.ByProvider("http://example.com") != ts.Default() {
+		t.Error("expected the tenants to be found by their provider")
+	}
+
+	invalid := [][]config.Tenant{
+		{{Id: ""}},
+		{{Id: "a/b"}},
+		{{Id: "alpha"}, {Id: "alpha"}},
+		{{Id: "alpha", Users: []string{"alice"}}, {Id: "beta", Users: []string{"alice"}}},
+		{{Id: "alpha", Provider: "http://alpha.com"}, {Id: "beta", Provider: "http://alpha.com"}},
+	}
+	for _, confs := range invalid {
+		if _, err = New(Tenant{}, confs); err == nil {
+			t.Errorf("expected an error for %v", confs)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ts := testTenants(t)
+	hash := sha1.Sum([]byte("password"))
+	secrets := func(user, realm string) string {
+		return "{SHA}" + base64.StdEncoding.EncodeToString(hash[:])
+	}
+	authenticator := auth.NewBasicAuthenticator("test", secrets)
+
+	var tenant, path string
+	var owns bool
+	handler := ts.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, path, owns = ts.FromRequest(r).Id, r.URL.Path, ts.FromRequest(r).Owns("alpha")
+	}), authenticator)
+
+	tests := []struct {
+		path   string
+		user   string
+		status int
+		tenant string
+		rest   string
+	}{
+		{"/tenants/alpha", "alice", http.StatusOK, "alpha", "/"},
+		{"/licenses", "bob", http.StatusOK, "beta", "/licenses"},
+		{"/licenses", "admin", http.StatusOK, "", "/licenses"},
+		{"/tenants/alpha/licenses", "alice", http.StatusOK, "alpha", "/licenses"},
+		{"/tenants/alpha/licenses", "admin", http.StatusOK, "alpha", "/licenses"},
+		{"/tenants/alpha/licenses", "bob", http.StatusForbidden, "", ""},
+		{"/tenants/gamma/licenses", "", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		tenant, path = "", ""
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, "password")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || tenant != test.tenant || path != test.rest {
+			t.Errorf("%s as %q: expected %d %q %q, got %d %q %q", test.path, test.user, test.status, test.tenant, test.rest, w.Code, tenant, path)
+		}
+	}
+
+	// a request without valid credentials is anonymous, even with the prefix of a tenant
+	for _, test := range []struct {
+		path     string
+		password string
+		rest     string
+	}{
+		{"/licenses", "", "/licenses"},
+		{"/tenants/alpha/licenses", "", "/licenses"},
+		{"/licenses", "wrong", "/licenses"},
+		{"/tenants/alpha/licenses", "wrong", "/licenses"},
+	} {
+		tenant, path, owns = "unset", "", true
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.password != "" {
+			r.SetBasicAuth("alice", test.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || tenant != "" || path != test.rest || owns {
+			t.Errorf("%s with password %q: expected the anonymous tenant on %q, got %d %q %q owning alpha: %t", test.path, test.password, test.rest, w.Code, tenant, path, owns)
+		}
+	}
+}
+
+func TestReloadCertificates(t *testing.T) {
+	rsa := config.Certificate{Cert: "../sign/cert/sample_rsa.crt", PrivateKey: "../sign/cert/sample_rsa.pem"}
+	ecdsa := config.Certificate{Cert: "../sign/cert/sample_ecdsa.crt", PrivateKey: "../sign/cert/sample_ecdsa.pem"}
+	ts, err := New(Tenant{}, []config.Tenant{{Id: "alpha", Certificate: ecdsa}, {Id: "beta"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ts.LoadCertificates(rsa); err != nil {
+		t.Fatal(err)
+	}
+	alpha, _ := ts.Get("alpha")
+	beta, _ := ts.Get("beta")
+	file := func(tn *Tenant) string {
+		status := tn.Certificate.Status(time.Now())
+		if len(status) != 1 {
+			t.Fatalf("Expected a certificate for the tenant %q, got %v", tn.Id, status)
+		}
+		return status[0].File
+	}
+	if file(ts.Default()) != rsa.Cert || file(alpha) != ecdsa.Cert || file(beta) != rsa.Cert {
+		t.Fatal("Expected the certificates of the tenants, or else of the default tenant")
+	}
+
+	// the default certificate would be loaded, but not the one of alpha: nothing changes
+	missing := config.Certificate{Cert: "missing.crt", PrivateKey: "missing.pem"}
+	if err = ts.ReloadCertificates(ecdsa, []config.Tenant{{Id: "alpha", Certificate: missing}}); err == nil {
+		t.Fatal("Expected an error loading a missing certificate")
+	}
+	if file(ts.Default()) != rsa.Cert || file(alpha) != ecdsa.Cert || file(beta) != rsa.Cert {
+		t.Error("Expected the certificates in use to be kept when one can't be loaded")
+	}
+	if alpha.certificate.Cert != ecdsa.Cert {
+		t.Error("Expected the certificate settings to be kept when one can't be loaded")
+	}
+
+	if err = ts.ReloadCertificates(ecdsa, []config.Tenant{{Id: "alpha", Certificate: rsa}}); err != nil {
+		t.Fatal(err)
+	}
+	if file(ts.Default()) != ecdsa.Cert || file(alpha) != rsa.Cert || file(beta) != ecdsa.Cert {
+		t.Error("Expected all the certificates to be replaced")
+	}
+}
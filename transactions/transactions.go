@@ -38,6 +38,7 @@ var NotFound = errors.New("Event not found")
 type Transactions interface {
 	Get(id int) (Event, error)
 	Add(e Event, typeEvent int) error
+	AddTx(tx *sql.Tx, e Event, typeEvent int) error
 	GetByLicenseStatusId(licenseStatusFk int) func() (Event, error)
 	CheckDeviceStatus(licenseStatusFk int, deviceId string) (string, error)
 	ListRegisteredDevices(licenseStatusFk int) func() (Device, error)
@@ -104,6 +105,13 @@ func (i dbTransactions) Add(e Event, typeEvent int) error {
 	return err
 }
 
+//AddTx adds event in a database transaction, so that it is saved with the change of its license status
+func (i dbTransactions) AddTx(tx *sql.Tx, e Event, typeEvent int) error {
+	_, err := tx.Exec("INSERT INTO event (device_name, timestamp, type, device_id, license_status_fk) VALUES (?, ?, ?, ?, ?)",
+		e.DeviceName, e.Timestamp, typeEvent, e.DeviceId, e.LicenseStatusFk)
+	return err
+}
+
 //GetByLicenseStatusId returns all events by licensestatus id
 func (i dbTransactions) GetByLicenseStatusId(licenseStatusFk int) func() (Event, error) {
 	rows, err := i.getbylicensestatusid.Query(licenseStatusFk)
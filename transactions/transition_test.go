@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transactions_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/readium/readium-lcp-server/license_statuses"
+	"github.com/readium/readium-lcp-server/status"
+	"github.com/readium/readium-lcp-server/transactions"
+)
+
+//TestTransition checks that an event is saved only with the change of its license status
+func TestTransition(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	lst, err := licensestatuses.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trns, err := transactions.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := time.Now()
+	ls := licensestatuses.LicenseStatus{Status: status.STATUS_ACTIVE, LicenseRef: "license", Updated: &licensestatuses.Updated{License: &timestamp, Status: &timestamp}}
+	if err = lst.Add(ls); err != nil {
+		t.Fatal(err)
+	}
+	current, err := lst.GetByLicenseId("license")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Status = status.STATUS_RETURNED
+	e := transactions.Event{DeviceName: "testdevice", Timestamp: timestamp, Type: status.TYPE_RETURN, DeviceId: "deviceid", LicenseStatusFk: current.Id}
+	record := func(tx *sql.Tx) error { return trns.AddTx(tx, e, 2) }
+
+	// the license status is no longer ready: neither the event nor the status are saved
+	if err = lst.Transition(*current, status.STATUS_READY, record); err != licensestatuses.StatusChanged {
+		t.Fatalf("Expected %v, got %v", licensestatuses.StatusChanged, err)
+	}
+	if _, err = trns.GetByLicenseStatusId(current.Id)(); err != transactions.NotFound {
+		t.Errorf("Expected no event, got %v", err)
+	}
+
+	if err = lst.Transition(*current, status.STATUS_ACTIVE, record); err != nil {
+		t.Fatal(err)
+	}
+	events := 0
+	fn := trns.GetByLicenseStatusId(current.Id)
+	for _, err = fn(); err == nil; _, err = fn() {
+		events++
+	}
+	if events != 1 {
+		t.Errorf("Expected the return event, got %d events", events)
+	}
+	saved, err := lst.GetByLicenseId("license")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != status.STATUS_RETURNED {
+		t.Errorf("Expected status %s, got %s", status.STATUS_RETURNED, saved.Status)
+	}
+}
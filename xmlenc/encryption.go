@@ -26,8 +26,10 @@
 package xmlenc
 
 import (
+	"bytes"
 	"encoding/xml"
 	"io"
+	"net/url"
 )
 
 type Manifest struct {
@@ -39,7 +41,7 @@ type Manifest struct {
 func (m Manifest) DataForFile(path string) (Data, bool) {
 	uri := URI(path)
 	for _, datum := range m.Data {
-		if datum.CipherData.CipherReference.URI == uri {
+		if datum.CipherData.CipherReference.URI == uri || datum.CipherData.CipherReference.URI.Path() == path {
 			return datum, true
 		}
 	}
@@ -76,6 +78,16 @@ func Read(r io.Reader) (Manifest, error) {
 
 type URI string
 
+// Path returns the path in the container referenced by a relative URI,
+// e.g. with escaped characters decoded
+func (u URI) Path() string {
+	path, err := url.PathUnescape(string(u))
+	if err != nil {
+		return string(u)
+	}
+	return path
+}
+
 type Method struct {
 	KeySize int `xml:"KeySize,omitempty"`
 	//OAEPParams []byte `xml:"AOEParams,omitempty"`
@@ -132,8 +144,8 @@ type encryptedType struct {
 	CipherData CipherData `xml:"http://www.w3.org/2001/04/xmlenc# CipherData"`
 	Id         string     `xml:"Id,attr,omitempty"`
 	Type       URI        `xml:"Type,attr,omitempty"`
-	MimeType   string     `xml:"MimeType,omitempty"`
-	Encoding   URI        `xml:"Encoding,omitempty"`
+	MimeType   string     `xml:"MimeType,attr,omitempty"`
+	Encoding   URI        `xml:"Encoding,attr,omitempty"`
 }
 
 type ReferenceList struct {
@@ -163,4 +175,80 @@ type EncryptionProperties struct {
 type Data struct {
 	encryptedType
 	Properties *EncryptionProperties `xml:"http://www.w3.org/2001/04/xmlenc# EncryptionProperties,omitempty"`
+
+	// tokens of an element read from an existing encryption.xml
+	raw []xml.Token
+}
+
+// UnmarshalXML decodes an EncryptedData element and keeps its tokens, so that
+// entries the server does not create, e.g. for font obfuscation, are written back as they were read
+func (d *Data) UnmarshalXML(dec *xml.Decoder, start xml.StartElement) error {
+	raw := []xml.Token{start.Copy()}
+	for depth := 1; depth > 0; {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+		raw = append(raw, xml.CopyToken(t))
+	}
+
+	type data Data // without the xml methods
+	var parsed data
+	if err := xml.NewTokenDecoder(&tokens{raw: raw}).Decode(&parsed); err != nil {
+		return err
+	}
+	*d = Data(parsed)
+	d.raw = raw
+	return nil
+}
+
+func (d Data) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	if d.raw == nil {
+		type data Data // without the xml methods
+		return enc.EncodeElement(data(d), start)
+	}
+
+	for _, t := range d.raw {
+		switch tt := t.(type) {
+		case xml.StartElement:
+			// namespace declarations are written by the encoder
+			attrs := make([]xml.Attr, 0, len(tt.Attr))
+			for _, a := range tt.Attr {
+				if a.Name.Space != "xmlns" && !(a.Name.Space == "" && a.Name.Local == "xmlns") {
+					attrs = append(attrs, a)
+				}
+			}
+			tt.Attr = attrs
+			t = tt
+		case xml.CharData:
+			// so is the indentation
+			if len(bytes.TrimSpace(tt)) == 0 {
+				continue
+			}
+		}
+		if err := enc.EncodeToken(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokens replays the tokens of an element
+type tokens struct {
+	raw []xml.Token
+}
+
+func (t *tokens) Token() (xml.Token, error) {
+	if len(t.raw) == 0 {
+		return nil, io.EOF
+	}
+	token := t.raw[0]
+	t.raw = t.raw[1:]
+	return token, nil
 }
@@ -0,0 +1,81 @@
+// Copyright (c) 2016 Readium Foundation
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation and/or
+//    other materials provided with the distribution.
+// 3. Neither the name of the organization nor the names of its contributors may be
+//    used to endorse or promote products derived from this software without specific
+//    prior written permission
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package xmlenc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const sample = `<?xml version="1.0" encoding="UTF-8"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#" xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+  <enc:EncryptedData MimeType="font/otf">
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <ds:KeyInfo><ds:KeyName>publisher</ds:KeyName></ds:KeyInfo>
+    <enc:CipherData><enc:CipherReference URI="OPS/fonts/My%20Font.otf"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`
+
+func TestReadWriteKeepsEntries(t *testing.T) {
+	m, err := Read(strings.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := m.DataForFile("OPS/fonts/My Font.otf")
+	if !ok {
+		t.Fatal("Expected an entry for the escaped URI")
+	}
+	if data.Method.Algorithm != "http://www.idpf.org/2008/embedding" || data.MimeType != "font/otf" {
+		t.Errorf("Unexpected entry %#v", data)
+	}
+
+	m.Data = append(m.Data, Data{})
+	m.Data[1].Method.Algorithm = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	m.Data[1].CipherData.CipherReference.URI = "OPS/chapter.xhtml"
+
+	var buf bytes.Buffer
+	if err = m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "publisher") {
+		t.Errorf("Expected the KeyInfo of the entry to be kept, got %s", buf.String())
+	}
+
+	m, err = Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Data) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(m.Data))
+	}
+	if data, ok := m.DataForFile("OPS/fonts/My Font.otf"); !ok || data.MimeType != "font/otf" {
+		t.Errorf("Expected the entry to be read back, got %#v", data)
+	}
+	if _, ok := m.DataForFile("OPS/chapter.xhtml"); !ok {
+		t.Errorf("Expected the new entry to be read back")
+	}
+}